@@ -3,7 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
-	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
@@ -13,6 +16,8 @@ import (
 	"github.com/urfave/cli/v2"
 	"github.com/knadh/koanf/v2"
 	"github.com/mdp/qrterminal/v3"
+	"github.com/braydonf/go-nwc"
+	"gorm.io/gorm"
 )
 
 type User struct {
@@ -27,11 +32,35 @@ type User struct {
 	NWCPubKey string `koanf:"nwcpubkey"`
 	NWCSecret string `koanf:"nwcsecret"`
 	NWCRelay string `koanf:"nwcrelay"`
+	NWCRelays []string `koanf:"nwcrelays"`
+	NWCMethods []string `koanf:"nwcmethods"`
+	NWCMaxAmount uint64 `koanf:"nwcmaxamount"` // sats
+	NWCMaxFee uint64 `koanf:"nwcmaxfee"` // sats
+	NWCBudget uint64 `koanf:"nwcbudget"` // sats
+	NWCBudgetRenewal string `koanf:"nwcbudgetrenewal"`
+}
+
+// nwcRelays returns the relays of nwcrelay and nwcrelays.
+func (u User) nwcRelays() []string {
+	var relays []string
+
+	if u.NWCRelay != "" {
+		relays = append(relays, u.NWCRelay)
+	}
+
+	for _, relay := range u.NWCRelays {
+		if relay != "" && !slices.Contains(relays, relay) {
+			relays = append(relays, relay)
+		}
+	}
+
+	return relays
 }
 
 type Settings struct {
 	Users []User `koanf:"users"`
 	NostrPrivateKey    string `koanf:"nostrprivatekey"`
+	DataDir string `koanf:"datadir"`
 }
 
 var (
@@ -183,6 +212,18 @@ func createSecret(ctx *cli.Context) error {
 	return nil
 }
 
+// configConnection returns the connection of the nwcsecret in the
+// config of the user.
+func configConnection(user User) *nwc.Connection {
+	return &nwc.Connection{
+		Secret: user.NWCSecret,
+		Relays: strings.Join(user.nwcRelays(), " "),
+		Methods: strings.Join(user.NWCMethods, " "),
+		Budget: user.NWCBudget * 1000,
+		BudgetRenewal: user.NWCBudgetRenewal,
+	}
+}
+
 func connectQRCode(ctx *cli.Context) error {
 	loadSettings(ctx)
 
@@ -196,7 +237,7 @@ func connectQRCode(ctx *cli.Context) error {
 			log.Fatal().Err(err).Msg("unable to get pubkey")
 		}
 
-		if user.NWCRelay == "" {
+		if len(user.nwcRelays()) == 0 {
 			log.Fatal().Err(err).Msg("missing relay")
 		}
 
@@ -204,11 +245,7 @@ func connectQRCode(ctx *cli.Context) error {
 			log.Fatal().Err(err).Msg("missing secret")
 		}
 
-		params := url.Values{}
-		params.Add("relay", user.NWCRelay)
-		params.Add("secret", user.NWCSecret)
-
-		connect := "nostr+walletconnect://"+pubkey+"?"+params.Encode()
+		connect := configConnection(user).ConnectURI(pubkey)
 
 		qrterminal.Generate(connect, qrterminal.M, os.Stdout)
 	} else {
@@ -231,7 +268,7 @@ func connectString(ctx *cli.Context) error {
 			log.Fatal().Err(err).Msg("unable to get pubkey")
 		}
 
-		if user.NWCRelay == "" {
+		if len(user.nwcRelays()) == 0 {
 			log.Fatal().Err(err).Msg("missing relay")
 		}
 
@@ -239,11 +276,7 @@ func connectString(ctx *cli.Context) error {
 			log.Fatal().Err(err).Msg("missing secret")
 		}
 
-		params := url.Values{}
-		params.Add("relay", user.NWCRelay)
-		params.Add("secret", user.NWCSecret)
-
-		fmt.Println("nostr+walletconnect://"+pubkey+"?"+params.Encode())
+		fmt.Println(configConnection(user).ConnectURI(pubkey))
 	} else {
 		log.Fatal().Msg("no user")
 	}
@@ -251,6 +284,135 @@ func connectString(ctx *cli.Context) error {
 	return nil
 }
 
+func openDB() *gorm.DB {
+	dbpath := filepath.Join(s.DataDir, "nwc.db")
+
+	db, err := nwc.OpenDB(dbpath)
+	if err != nil {
+		log.Fatal().Err(err).Str("dbpath", dbpath).Msg("error loading database")
+	}
+
+	return db
+}
+
+func createConnection(ctx *cli.Context) error {
+	loadSettings(ctx)
+
+	user, ok := userMap[ctx.String("user")]
+	if !ok {
+		log.Fatal().Msg("no user")
+	}
+
+	relays := ctx.StringSlice("relays")
+	if len(relays) == 0 {
+		relays = user.nwcRelays()
+	}
+
+	if len(relays) == 0 {
+		log.Fatal().Msg("missing relay")
+	}
+
+	pubkey, err := nostr.GetPublicKey(s.NostrPrivateKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to get pubkey")
+	}
+
+	var expiresAt *time.Time
+	if expires := ctx.Duration("expires"); expires > 0 {
+		t := time.Now().Add(expires)
+		expiresAt = &t
+	}
+
+	connection, err := nwc.NewConnection(user.Name, ctx.String("name"), relays, nwc.Policy{
+		Methods: ctx.StringSlice("methods"),
+		MaxAmount: ctx.Uint64("max-amount") * 1000,
+		MaxFee: ctx.Uint64("max-fee") * 1000,
+		Budget: ctx.Uint64("budget") * 1000,
+		BudgetRenewal: ctx.String("budget-renewal"),
+	}, expiresAt)
+
+	if err != nil {
+		return err
+	}
+
+	if err := nwc.CreateConnection(openDB(), connection); err != nil {
+		return err
+	}
+
+	fmt.Println(connection.ConnectURI(pubkey))
+
+	return nil
+}
+
+func listConnections(ctx *cli.Context) error {
+	loadSettings(ctx)
+
+	connections, err := nwc.ListConnections(openDB(), ctx.String("user"))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, c := range connections {
+		lastUsed := "never"
+		if c.LastUsedAt != nil {
+			lastUsed = c.LastUsedAt.Format(time.RFC3339)
+		}
+
+		expires := "never"
+		if c.ExpiresAt != nil {
+			expires = c.ExpiresAt.Format(time.RFC3339)
+		}
+
+		fmt.Printf("%s\t%s\t%s\tcreated: %s\texpires: %s\tlast used: %s\tpubkey: %s\n",
+			c.User, c.Name, c.Status(now), c.CreatedAt.Format(time.RFC3339), expires, lastUsed, c.PubKey)
+	}
+
+	return nil
+}
+
+func showConnection(ctx *cli.Context) error {
+	loadSettings(ctx)
+
+	pubkey, err := nostr.GetPublicKey(s.NostrPrivateKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("unable to get pubkey")
+	}
+
+	connection, err := nwc.GetConnection(openDB(), ctx.String("user"), ctx.String("name"))
+	if err != nil {
+		return err
+	}
+
+	if !connection.Active(time.Now()) {
+		log.Warn().Str("status", connection.Status(time.Now())).Msg("connection is not active")
+	}
+
+	connect := connection.ConnectURI(pubkey)
+
+	if ctx.Bool("qrcode") {
+		qrterminal.Generate(connect, qrterminal.M, os.Stdout)
+	} else {
+		fmt.Println(connect)
+	}
+
+	return nil
+}
+
+func revokeConnection(ctx *cli.Context) error {
+	loadSettings(ctx)
+
+	err := nwc.RevokeConnection(openDB(), ctx.String("user"), ctx.String("name"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("revoked: %s\n", ctx.String("name"))
+
+	return nil
+}
+
 func main() {
 	app := &cli.App{
 		Name: "satdress-cli",
@@ -324,6 +486,107 @@ func main() {
 							},
 						},
 					},
+					{
+						Name:  "connections",
+						Usage: "manage the wallet connections in the nwc database",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "create",
+								Usage: "create a wallet connection and view its connect string",
+								Action: createConnection,
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "user",
+										Value: "alice",
+										Usage: "the username",
+									},
+									&cli.StringFlag{
+										Name:  "name",
+										Usage: "the name of the connection (e.g. the app)",
+										Required: true,
+									},
+									&cli.StringSliceFlag{
+										Name:  "relays",
+										Usage: "the relays of the connection, those of the user when not given",
+									},
+									&cli.StringSliceFlag{
+										Name:  "methods",
+										Usage: "the allowed methods, all when not given",
+									},
+									&cli.Uint64Flag{
+										Name:  "max-amount",
+										Usage: "the maximum amount per payment (sats)",
+									},
+									&cli.Uint64Flag{
+										Name:  "max-fee",
+										Usage: "the maximum fee per payment (sats)",
+									},
+									&cli.Uint64Flag{
+										Name:  "budget",
+										Usage: "the budget per renewal period (sats)",
+									},
+									&cli.StringFlag{
+										Name:  "budget-renewal",
+										Value: "never",
+										Usage: "daily, weekly, monthly, yearly or never",
+									},
+									&cli.DurationFlag{
+										Name:  "expires",
+										Usage: "expire the connection after the duration (e.g. 720h)",
+									},
+								},
+							},
+							{
+								Name:  "list",
+								Usage: "list wallet connections",
+								Action: listConnections,
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "user",
+										Usage: "the username, all users when not given",
+									},
+								},
+							},
+							{
+								Name:  "show",
+								Usage: "view the connect string of a wallet connection",
+								Action: showConnection,
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "user",
+										Value: "alice",
+										Usage: "the username",
+									},
+									&cli.StringFlag{
+										Name:  "name",
+										Usage: "the name of the connection",
+										Required: true,
+									},
+									&cli.BoolFlag{
+										Name:  "qrcode",
+										Usage: "view as qrcode",
+									},
+								},
+							},
+							{
+								Name:  "revoke",
+								Usage: "revoke a wallet connection",
+								Action: revokeConnection,
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "user",
+										Value: "alice",
+										Usage: "the username",
+									},
+									&cli.StringFlag{
+										Name:  "name",
+										Usage: "the name of the connection",
+										Required: true,
+									},
+								},
+							},
+						},
+					},
 				},
 			},
 		},
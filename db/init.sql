@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS "invoices" (`id` integer,`payment_hash` text UNIQUE,`user` text,`link` text,`msat` integer,`bolt11` text,`comment` text,`payer_data` text,`zap_request` text,`relays` text,`status` text,`preimage` text,`created_at` datetime,`updated_at` datetime,`expires_at` datetime,`settled_at` datetime,PRIMARY KEY (`id`));
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_invoices_payment_hash` ON `invoices`(`payment_hash`);
+CREATE INDEX IF NOT EXISTS `idx_invoices_status` ON `invoices`(`status`);
@@ -1,20 +1,28 @@
 module github.com/braydonf/satdress
 
-go 1.21
+go 1.22
 
 toolchain go1.22.0
 
 require (
 	github.com/braydonf/go-nwc v0.0.0-00010101000000-000000000000
+	github.com/btcsuite/btcd v0.24.1-0.20240123000108-62e6af035ec5
+	github.com/btcsuite/btcd/btcec/v2 v2.3.2
+	github.com/btcsuite/btcd/chaincfg/chainhash v1.1.0
 	github.com/dustin/go-humanize v1.0.1
+	github.com/fiatjaf/eclair-go v0.2.3
 	github.com/fiatjaf/go-lnurl v1.13.1
+	github.com/fiatjaf/lightningd-gjson-rpc v1.6.2
 	github.com/fiatjaf/makeinvoice v1.5.5
+	github.com/glebarez/sqlite v1.11.0
 	github.com/gorilla/mux v1.8.1
-	github.com/hashicorp/golang-lru/v2 v2.0.7
+	github.com/gorilla/websocket v1.5.1
+	github.com/jb55/lnsocket/go v0.0.0-20230807153023-0fad35b1352d
 	github.com/knadh/koanf/parsers/yaml v0.1.0
 	github.com/knadh/koanf/providers/file v0.1.0
 	github.com/knadh/koanf/providers/posflag v0.1.0
 	github.com/knadh/koanf/v2 v2.1.0
+	github.com/lightningnetwork/lnd v0.17.4-beta.rc1
 	github.com/nbd-wtf/go-nostr v0.30.2
 	github.com/nbd-wtf/ln-decodepay v1.12.1
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
@@ -24,15 +32,13 @@ require (
 	github.com/spf13/pflag v1.0.5
 	github.com/tidwall/gjson v1.17.1
 	github.com/tidwall/sjson v1.2.5
+	gorm.io/gorm v1.25.10
 )
 
 require (
 	github.com/aead/siphash v1.0.1 // indirect
-	github.com/btcsuite/btcd v0.24.1-0.20240123000108-62e6af035ec5 // indirect
-	github.com/btcsuite/btcd/btcec/v2 v2.3.2 // indirect
 	github.com/btcsuite/btcd/btcutil v1.1.5 // indirect
 	github.com/btcsuite/btcd/btcutil/psbt v1.1.9 // indirect
-	github.com/btcsuite/btcd/chaincfg/chainhash v1.1.0 // indirect
 	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f // indirect
 	github.com/btcsuite/btcwallet v0.16.10-0.20240127010340-16b422a2e8bf // indirect
 	github.com/btcsuite/btcwallet/wallet/txauthor v1.3.4 // indirect
@@ -47,20 +53,15 @@ require (
 	github.com/decred/dcrd/crypto/blake256 v1.0.1 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.2.0 // indirect
 	github.com/decred/dcrd/lru v1.1.2 // indirect
-	github.com/fiatjaf/eclair-go v0.2.3 // indirect
-	github.com/fiatjaf/lightningd-gjson-rpc v1.6.2 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/glebarez/go-sqlite v1.21.2 // indirect
-	github.com/glebarez/sqlite v1.11.0 // indirect
 	github.com/go-errors/errors v1.5.1 // indirect
 	github.com/go-viper/mapstructure/v2 v2.0.0-alpha.1 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/gobwas/ws v1.2.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.1 // indirect
 	github.com/imroc/req v0.3.2 // indirect
-	github.com/jb55/lnsocket/go v0.0.0-20230807153023-0fad35b1352d // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
@@ -69,7 +70,6 @@ require (
 	github.com/lightninglabs/gozmq v0.0.0-20191113021534-d20a764486bf // indirect
 	github.com/lightninglabs/neutrino v0.16.0 // indirect
 	github.com/lightninglabs/neutrino/cache v1.1.2 // indirect
-	github.com/lightningnetwork/lnd v0.17.4-beta.rc1 // indirect
 	github.com/lightningnetwork/lnd/clock v1.1.1 // indirect
 	github.com/lightningnetwork/lnd/fn v1.0.4 // indirect
 	github.com/lightningnetwork/lnd/queue v1.1.1 // indirect
@@ -104,7 +104,6 @@ require (
 	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/tools v0.19.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	gorm.io/gorm v1.25.10 // indirect
 	modernc.org/libc v1.49.3 // indirect
 	modernc.org/mathutil v1.6.0 // indirect
 	modernc.org/memory v1.8.0 // indirect
@@ -121,10 +121,6 @@ type LNBackendParams interface {
 }
 
 func MakeInvoice(params LNParams) (bolt11 string, err error) {
-	defer func(prevTransport http.RoundTripper) {
-		Client.Transport = prevTransport
-	}(Client.Transport)
-
 	specialTransport := &http.Transport{}
 
 	// use a cert or skip TLS verification?
@@ -142,7 +138,8 @@ func MakeInvoice(params LNParams) (bolt11 string, err error) {
 		specialTransport.Proxy = http.ProxyURL(torURL)
 	}
 
-	Client.Transport = specialTransport
+	// use a client per call so concurrent invoices don't share a transport
+	client := &http.Client{Timeout: Client.Timeout, Transport: specialTransport}
 
 	// description hash?
 	var hexh, b64h string
@@ -205,7 +202,7 @@ func MakeInvoice(params LNParams) (bolt11 string, err error) {
 		}
 
 		req.Header.Set("Grpc-Metadata-macaroon", backend.Macaroon)
-		resp, err := Client.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			return "", err
 		}
@@ -250,7 +247,7 @@ func MakeInvoice(params LNParams) (bolt11 string, err error) {
 
 		req.Header.Set("X-Api-Key", backend.Key)
 		req.Header.Set("Content-Type", "application/json")
-		resp, err := Client.Do(req)
+		resp, err := client.Do(req)
 		if err != nil {
 			return "", err
 		}
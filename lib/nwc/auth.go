@@ -0,0 +1,81 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var ErrAuthFailed = errors.New("relay authentication failed")
+
+// AuthRequired checks whether the relay rejected an event or subscription
+// until the client authenticates with NIP-42.
+func AuthRequired(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "auth-required:")
+}
+
+// RequiresAuth checks whether the url is in the list of relays that are
+// authenticated with right after connecting.
+func RequiresAuth(urls []string, url string) bool {
+	url = nostr.NormalizeURL(url)
+
+	for _, u := range urls {
+		if nostr.NormalizeURL(u) == url {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthHandler signs the auth events of relays with the key.
+func AuthHandler(privateKey string) func(*nostr.Event) error {
+	return func(event *nostr.Event) error {
+		return event.Sign(privateKey)
+	}
+}
+
+// Authenticate responds to the AUTH challenge of the relay with an event
+// signed by the key. The challenge is sent by the relay once connected,
+// so it's tried a few times in case it has not arrived yet.
+func Authenticate(ctx context.Context, relay *nostr.Relay, privateKey string) error {
+	var err error
+
+	for i := 0; i < 3; i++ {
+		actx, cancel := context.WithTimeout(ctx, Timeout)
+		err = relay.Auth(actx, AuthHandler(privateKey))
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	return fmt.Errorf("%w: %s: %w", ErrAuthFailed, relay.URL, err)
+}
+
+// PublishWithAuth publishes the event, authenticating and publishing
+// again if the relay requires it.
+func PublishWithAuth(ctx context.Context, relay *nostr.Relay, privateKey string, event nostr.Event) error {
+	err := relay.Publish(ctx, event)
+
+	if !AuthRequired(err) {
+		return err
+	}
+
+	if err := Authenticate(ctx, relay, privateKey); err != nil {
+		return err
+	}
+
+	return relay.Publish(ctx, event)
+}
@@ -0,0 +1,248 @@
+package nwc
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testRelay is a relay that requires NIP-42 authentication before it
+// accepts events or subscriptions.
+type testRelay struct {
+	URL string
+
+	mu     sync.Mutex
+	events []nostr.Event
+	authed []string // pubkeys that authenticated
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	t.Helper()
+
+	relay := &testRelay{}
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		relay.serve(conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	relay.URL = "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	return relay
+}
+
+func (relay *testRelay) add(evt nostr.Event) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	relay.events = append(relay.events, evt)
+}
+
+func (relay *testRelay) stored(id string) bool {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	for _, evt := range relay.events {
+		if evt.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (relay *testRelay) authenticated(pubkey string) bool {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	for _, pk := range relay.authed {
+		if pk == pubkey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serve sends the challenge once connected and handles the messages of
+// the connection until it's closed.
+func (relay *testRelay) serve(conn *websocket.Conn) {
+	challenge := nostr.GeneratePrivateKey()[:16]
+	pubkey := ""
+
+	send := func(env nostr.Envelope) {
+		msg, _ := env.MarshalJSON()
+		conn.WriteMessage(websocket.TextMessage, msg)
+	}
+
+	// the client drops messages that arrive along with the handshake
+	time.Sleep(50 * time.Millisecond)
+
+	send(&nostr.AuthEnvelope{Challenge: &challenge})
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch env := nostr.ParseMessage(msg).(type) {
+		case *nostr.AuthEnvelope:
+			evt := env.Event
+			ok, _ := evt.CheckSignature()
+
+			tag := evt.Tags.GetFirst([]string{"challenge", ""})
+			if !ok || evt.Kind != 22242 || tag == nil || tag.Value() != challenge {
+				send(&nostr.OKEnvelope{EventID: evt.ID, Reason: "auth-required: invalid challenge"})
+				continue
+			}
+
+			pubkey = evt.PubKey
+
+			relay.mu.Lock()
+			relay.authed = append(relay.authed, pubkey)
+			relay.mu.Unlock()
+
+			send(&nostr.OKEnvelope{EventID: evt.ID, OK: true})
+		case *nostr.EventEnvelope:
+			if pubkey == "" {
+				send(&nostr.OKEnvelope{EventID: env.Event.ID, Reason: "auth-required: authenticate to publish"})
+				continue
+			}
+
+			relay.add(env.Event)
+			send(&nostr.OKEnvelope{EventID: env.Event.ID, OK: true})
+		case *nostr.ReqEnvelope:
+			if pubkey == "" {
+				send(&nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: "auth-required: authenticate to subscribe"})
+				continue
+			}
+
+			relay.mu.Lock()
+			events := append([]nostr.Event(nil), relay.events...)
+			relay.mu.Unlock()
+
+			for _, evt := range events {
+				if env.Filters.Match(&evt) {
+					send(&nostr.EventEnvelope{SubscriptionID: &env.SubscriptionID, Event: evt})
+				}
+			}
+
+			eose := nostr.EOSEEnvelope(env.SubscriptionID)
+			send(&eose)
+		}
+	}
+}
+
+// relayAuthTests are the relays that are authenticated with once
+// connected, and those that ask for it.
+var relayAuthTests = []struct {
+	name     string
+	authOnce bool
+}{
+	{name: "auth relay", authOnce: true},
+	{name: "auth required"},
+}
+
+func TestRelaysPublishAuth(t *testing.T) {
+	for _, test := range relayAuthTests {
+		t.Run(test.name, func(t *testing.T) {
+			relay := newTestRelay(t)
+
+			db := newTestDB(t)
+			p := newTestParams(t, db)
+
+			if test.authOnce {
+				p.AuthRelays = []string{relay.URL}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			relays := NewRelays(ctx, p)
+
+			evt := nostr.Event{
+				PubKey:    p.PublicKey,
+				CreatedAt: nostr.Now(),
+				Kind:      NIP47_RESPONSE_KIND,
+				Tags:      nostr.Tags{},
+				Content:   "response",
+			}
+			if err := evt.Sign(p.PrivateKey); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := relays.Publish(ctx, []string{relay.URL}, evt); err != nil {
+				t.Fatal(err)
+			}
+
+			if !relay.authenticated(p.PublicKey) {
+				t.Fatal("not authenticated")
+			}
+
+			if !relay.stored(evt.ID) {
+				t.Fatal("event was not stored")
+			}
+		})
+	}
+}
+
+// TestListenerAuth subscribes to an auth relay, the subscriptions closed
+// with auth-required are subscribed again by the pool, which races in
+// go-nostr v0.30.
+func TestListenerAuth(t *testing.T) {
+	relay := newTestRelay(t)
+
+	db := newTestDB(t)
+	user := NWCUser{Name: "jane", Relays: []string{relay.URL}, Backend: newFakeBackend()}
+	p := newTestParams(t, db, user)
+	p.AuthRelays = []string{relay.URL}
+
+	c := newTestConnection(t, db, "jane")
+
+	invoice, _ := newTestInvoice(t, 1000, "")
+	evt := newTestRequest(t, p, c, NIP47_PAY_INVOICE_METHOD, Nip47PayParams{Invoice: invoice}, time.Now())
+	relay.add(*evt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	relays := NewRelays(ctx, p)
+
+	requests := make(chan RequestEvent, 1)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		StartListener(ctx, db, p, user, relays, requests, make(chan ResponseEvent, 1))
+	}()
+
+	select {
+	case request := <-requests:
+		if request.NostrId != evt.ID {
+			t.Fatalf("request %+v", request)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("request was not received")
+	}
+
+	cancel()
+	<-stopped
+
+	if !relay.authenticated(p.PublicKey) {
+		t.Fatal("not authenticated")
+	}
+}
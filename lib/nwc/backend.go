@@ -0,0 +1,363 @@
+package nwc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/makeinvoice"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+var (
+	TorProxyURL = "socks5://127.0.0.1:9050"
+	Timeout     = 25 * time.Second
+)
+
+var (
+	ErrNotImplemented      = errors.New("not implemented")
+	ErrNotFound            = errors.New("not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrPaymentFailed       = errors.New("payment failed")
+	ErrRestricted          = errors.New("restricted")
+)
+
+// Backend is a lightning node or wallet, used for lightning address
+// invoices, watching for their payment and nostr wallet connect.
+type Backend interface {
+	MakeInvoice(context.Context, InvoiceParams) (*Transaction, error)
+	LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error)
+	PayInvoice(context.Context, PayParams) (*Transaction, error)
+	PayKeysend(context.Context, KeysendParams) (*Transaction, error)
+	GetBalance(context.Context) (uint64, error) // msats
+	GetInfo(context.Context) (*NodeInfo, error)
+
+	// ListTransactions returns up to Limit of the newest transactions,
+	// the offset is applied by the caller. It's used to import the
+	// transactions from before they were recorded.
+	ListTransactions(context.Context, Nip47ListTransactionsParams) ([]Transaction, error)
+
+	// SubscribeSettlements sends every paid incoming invoice to settled
+	// until the context is done or the connection fails.
+	SubscribeSettlements(ctx context.Context, settled chan<- Settlement) error
+
+	// Capabilities returns the supported NIP-47 methods.
+	Capabilities() []string
+}
+
+// BackendConfig is the configuration of a user's backend.
+type BackendConfig struct {
+	Kind     string
+	Host     string
+	Key      string
+	AdminKey string
+	Pak      string
+	Waki     string
+	NodeId   string
+	Rune     string
+}
+
+type BackendFactory func(BackendConfig) Backend
+
+var backends = make(map[string]BackendFactory)
+
+// RegisterBackend makes a backend available for the kind.
+func RegisterBackend(kind string, factory BackendFactory) {
+	backends[kind] = factory
+}
+
+func NewBackend(config BackendConfig) (Backend, error) {
+	factory, ok := backends[config.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported backend: %s", config.Kind)
+	}
+
+	return factory(config), nil
+}
+
+type InvoiceParams struct {
+	Amount      uint64 // msats
+	Description string
+
+	// setting this to true will cause Description to be hashed and used
+	// as the description_hash (h) field on the bolt11 invoice
+	UseDescriptionHash bool
+
+	// hex, used when only the hash of the description is known
+	DescriptionHash string
+
+	Expiry uint // seconds
+	Label  string
+
+	// hex, the preimage of the invoice when it's made by the caller, not
+	// every backend accepts one
+	Preimage string
+}
+
+type PayParams struct {
+	Invoice string
+	Amount  uint64 // msats, for invoices without an amount
+	MaxFee  uint64 // msats, the backend default when zero, not every backend can limit fees
+}
+
+// the tlv record type of the keysend preimage
+const KEYSEND_RECORD_TYPE = 5482373484
+
+type TLVRecord struct {
+	Type  uint64 `json:"type"`
+	Value string `json:"value"` // hex
+}
+
+type KeysendParams struct {
+	PubKey     string
+	Amount     uint64 // msats
+	Preimage   string // hex, optional
+	TLVRecords []TLVRecord
+	MaxFee     uint64 // msats
+}
+
+// keysendPreimageChooser is implemented by backends whose keysend
+// chooses the preimage itself, the payment hash is only known once
+// paid.
+type keysendPreimageChooser interface {
+	ChoosesKeysendPreimage() bool
+}
+
+// keysendPreimage decodes the preimage, or creates a random one, and
+// returns it with its payment hash.
+func keysendPreimage(preimageHex string) ([]byte, []byte, error) {
+	preimage := make([]byte, 32)
+
+	if preimageHex == "" {
+		if _, err := rand.Read(preimage); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		preimage, err = hex.DecodeString(preimageHex)
+		if err != nil || len(preimage) != 32 {
+			return nil, nil, fmt.Errorf("invalid preimage: %s", preimageHex)
+		}
+	}
+
+	hash := sha256.Sum256(preimage)
+
+	return preimage, hash[:], nil
+}
+
+// Transaction is an incoming invoice or outgoing payment.
+type Transaction struct {
+	Type            string // incoming or outgoing
+	Invoice         string
+	Description     string
+	DescriptionHash string
+	Preimage        string
+	PaymentHash     string
+	Amount          uint64 // msats
+	FeesPaid        uint64 // msats
+	CreatedAt       uint   // seconds
+	ExpiresAt       uint   // seconds
+	SettledAt       uint   // seconds
+	Settled         bool
+	Failed          bool // outgoing payments that will not complete
+}
+
+func (t *Transaction) Nip47Result() Nip47InvoiceResult {
+	result := Nip47InvoiceResult{
+		Type:            t.Type,
+		Invoice:         t.Invoice,
+		Description:     t.Description,
+		DescriptionHash: t.DescriptionHash,
+		PaymentHash:     t.PaymentHash,
+		Amount:          t.Amount,
+		FeesPaid:        t.FeesPaid,
+		CreatedAt:       t.CreatedAt,
+		ExpiresAt:       t.ExpiresAt,
+	}
+
+	if t.Settled {
+		result.Preimage = t.Preimage
+		result.SettledAt = t.SettledAt
+	}
+
+	return result
+}
+
+type NodeInfo struct {
+	Alias       string
+	Color       string
+	PubKey      string
+	Network     string
+	BlockHeight uint
+	BlockHash   string
+}
+
+// Settlement is a paid invoice reported by a backend.
+type Settlement struct {
+	PaymentHash string
+	Preimage    string
+}
+
+func sendSettlement(ctx context.Context, settled chan<- Settlement, settlement Settlement) error {
+	select {
+	case settled <- settlement:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backendClient returns an http client for talking to a backend, using
+// the tor proxy for onion hosts. A zero timeout is used for streaming
+// subscriptions.
+func backendClient(host string, timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	// use a tor proxy?
+	if strings.Contains(host, ".onion") {
+		torURL, _ := url.Parse(TorProxyURL)
+		transport.Proxy = http.ProxyURL(torURL)
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// HTTPError is a response of a backend with an error status.
+type HTTPError struct {
+	Backend    string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("call to %s failed (%d): %s", e.Backend, e.StatusCode, e.Body)
+}
+
+func readBody(res *http.Response, backend string) ([]byte, error) {
+	if res.StatusCode == 404 {
+		return nil, ErrNotFound
+	}
+
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(res.Body)
+		text := string(body)
+		if len(text) > 300 {
+			text = text[:300]
+		}
+		return nil, &HTTPError{Backend: backend, StatusCode: res.StatusCode, Body: text}
+	}
+
+	return io.ReadAll(res.Body)
+}
+
+// unsupportedBackend is embedded by backends to return ErrNotImplemented
+// for everything they don't override.
+type unsupportedBackend struct{}
+
+func (unsupportedBackend) MakeInvoice(context.Context, InvoiceParams) (*Transaction, error) {
+	return nil, ErrNotImplemented
+}
+
+func (unsupportedBackend) LookupInvoice(context.Context, string) (*Transaction, error) {
+	return nil, ErrNotImplemented
+}
+
+func (unsupportedBackend) PayInvoice(context.Context, PayParams) (*Transaction, error) {
+	return nil, ErrNotImplemented
+}
+
+func (unsupportedBackend) PayKeysend(context.Context, KeysendParams) (*Transaction, error) {
+	return nil, ErrNotImplemented
+}
+
+func (unsupportedBackend) GetBalance(context.Context) (uint64, error) {
+	return 0, ErrNotImplemented
+}
+
+func (unsupportedBackend) GetInfo(context.Context) (*NodeInfo, error) {
+	return nil, ErrNotImplemented
+}
+
+func (unsupportedBackend) ListTransactions(context.Context, Nip47ListTransactionsParams) ([]Transaction, error) {
+	return nil, ErrNotImplemented
+}
+
+func (unsupportedBackend) SubscribeSettlements(context.Context, chan<- Settlement) error {
+	return ErrNotImplemented
+}
+
+// newestTransactions sorts the transactions with the newest first and
+// keeps up to limit of them, a zero limit keeps all.
+func newestTransactions(txs []Transaction, limit uint) []Transaction {
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].CreatedAt > txs[j].CreatedAt
+	})
+
+	if limit > 0 && int(limit) < len(txs) {
+		txs = txs[:limit]
+	}
+
+	return txs
+}
+
+// invoiceTransaction returns the transaction for an incoming invoice,
+// as far as it is known from the invoice itself.
+func invoiceTransaction(invoice string) (*Transaction, error) {
+	bolt11, err := decodepay.Decodepay(invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{
+		Type:            "incoming",
+		Invoice:         invoice,
+		Description:     bolt11.Description,
+		DescriptionHash: bolt11.DescriptionHash,
+		PaymentHash:     bolt11.PaymentHash,
+		Amount:          uint64(bolt11.MSatoshi),
+		CreatedAt:       uint(bolt11.CreatedAt),
+	}
+
+	if bolt11.Expiry > 0 {
+		tx.ExpiresAt = uint(bolt11.CreatedAt + bolt11.Expiry)
+	}
+
+	return tx, nil
+}
+
+// makeInvoiceWith creates an invoice with the makeinvoice library, for
+// backends without a native implementation.
+func makeInvoiceWith(backend makeinvoice.LNBackendParams, params InvoiceParams) (*Transaction, error) {
+	if params.DescriptionHash != "" && !params.UseDescriptionHash {
+		return nil, fmt.Errorf("description hash without description: %w", ErrNotImplemented)
+	}
+
+	if params.Preimage != "" {
+		return nil, fmt.Errorf("invoice with preimage: %w", ErrNotImplemented)
+	}
+
+	bolt11, err := makeinvoice.MakeInvoice(makeinvoice.LNParams{
+		Backend:            backend,
+		Msatoshi:           int64(params.Amount),
+		Description:        params.Description,
+		UseDescriptionHash: params.UseDescriptionHash,
+		Label:              params.Label,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return invoiceTransaction(bolt11)
+}
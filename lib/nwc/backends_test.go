@@ -0,0 +1,410 @@
+package nwc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tidwall/gjson"
+)
+
+// lookupTest is a lookup of an invoice from a backend with a fake api.
+type lookupTest struct {
+	name     string
+	paid     bool
+	found    bool
+	preimage string
+}
+
+var lookupTests = []lookupTest{
+	{name: "paid", paid: true, found: true, preimage: "0606060606060606060606060606060606060606060606060606060606060606"},
+	{name: "pending", found: true},
+	{name: "not found"},
+}
+
+func checkLookup(t *testing.T, test lookupTest, paymentHash string, tx *Transaction, err error) {
+	t.Helper()
+
+	if !test.found {
+		if err == nil {
+			t.Fatalf("found transaction %+v", tx)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.PaymentHash != paymentHash || tx.Settled != test.paid || tx.Preimage != test.preimage {
+		t.Fatalf("transaction %+v", tx)
+	}
+}
+
+func TestEclairLookupInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+
+	for _, test := range lookupTests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, password, _ := r.BasicAuth()
+
+				if r.URL.Path != "/getreceivedinfo" || password != "secret" || r.FormValue("paymentHash") != paymentHash {
+					w.WriteHeader(400)
+					fmt.Fprint(w, `{"error":"unexpected call"}`)
+					return
+				}
+
+				if !test.found {
+					w.WriteHeader(404)
+					fmt.Fprint(w, `{"error":"Not found"}`)
+					return
+				}
+
+				status := map[string]interface{}{"type": "pending"}
+				if test.paid {
+					status = map[string]interface{}{"type": "received", "amount": 21000, "receivedAt": map[string]interface{}{"unix": 1700000000}}
+				}
+
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"paymentRequest":  map[string]interface{}{"serialized": invoice},
+					"paymentPreimage": test.preimage,
+					"status":          status,
+				})
+			}))
+			defer srv.Close()
+
+			b := &EclairBackend{Host: srv.URL, Password: "secret"}
+
+			tx, err := b.LookupInvoice(context.Background(), paymentHash)
+			checkLookup(t, test, paymentHash, tx, err)
+		})
+	}
+}
+
+func TestSparkoLookupInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+
+	for _, test := range lookupTests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var msg struct {
+					Method string          `json:"method"`
+					Params json.RawMessage `json:"params"`
+				}
+				json.NewDecoder(r.Body).Decode(&msg)
+
+				if r.URL.Path != "/rpc" || r.Header.Get("X-Access") != "secret" || msg.Method != "listinvoices" || gjson.GetBytes(msg.Params, "payment_hash").String() != paymentHash {
+					w.WriteHeader(400)
+					fmt.Fprint(w, `{"code":-32600,"message":"unexpected call"}`)
+					return
+				}
+
+				invoices := []interface{}{}
+
+				if test.found {
+					status := "unpaid"
+					if test.paid {
+						status = "paid"
+					}
+
+					invoices = append(invoices, map[string]interface{}{
+						"bolt11":           invoice,
+						"payment_hash":     paymentHash,
+						"status":           status,
+						"payment_preimage": test.preimage,
+						"paid_at":          1700000000,
+					})
+				}
+
+				json.NewEncoder(w).Encode(map[string]interface{}{"invoices": invoices})
+			}))
+			defer srv.Close()
+
+			b := &SparkoBackend{Host: srv.URL, Key: "secret"}
+
+			tx, err := b.LookupInvoice(context.Background(), paymentHash)
+			checkLookup(t, test, paymentHash, tx, err)
+
+			if !test.found && !errors.Is(err, ErrNotFound) {
+				t.Fatalf("error %v", err)
+			}
+		})
+	}
+}
+
+func TestLNPayLookupInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+	other, otherHash := newTestInvoice(t, 1000, "")
+
+	defaultURL := LNPayURL
+	defer func() { LNPayURL = defaultURL }()
+
+	for _, test := range lookupTests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/wallet/waki/transactions" || r.Header.Get("X-Api-Key") != "pak" {
+					w.WriteHeader(401)
+					return
+				}
+
+				txs := []interface{}{
+					map[string]interface{}{"lnTx": map[string]interface{}{"r_hash_decoded": otherHash, "payment_request": other, "settled": 1}},
+				}
+
+				if test.found {
+					settled := 0
+					if test.paid {
+						settled = 1
+					}
+
+					txs = append(txs, map[string]interface{}{"lnTx": map[string]interface{}{
+						"r_hash_decoded":   paymentHash,
+						"payment_request":  invoice,
+						"payment_preimage": test.preimage,
+						"settled":          settled,
+						"settled_at":       1700000000,
+					}})
+				}
+
+				json.NewEncoder(w).Encode(txs)
+			}))
+			defer srv.Close()
+
+			LNPayURL = srv.URL
+
+			b := &LNPayBackend{Pak: "pak", Waki: "waki"}
+
+			tx, err := b.LookupInvoice(context.Background(), paymentHash)
+			checkLookup(t, test, paymentHash, tx, err)
+
+			if !test.found && !errors.Is(err, ErrNotFound) {
+				t.Fatalf("error %v", err)
+			}
+		})
+	}
+}
+
+// receiveSettlement runs the subscription until a settlement is received.
+func receiveSettlement(t *testing.T, subscribe func(context.Context, chan<- Settlement) error) Settlement {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	settled := make(chan Settlement)
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- subscribe(ctx, settled)
+	}()
+
+	select {
+	case settlement := <-settled:
+		cancel()
+		<-errs
+		return settlement
+	case err := <-errs:
+		t.Fatalf("subscription closed: %v", err)
+	case <-ctx.Done():
+		t.Fatal("no settlement")
+	}
+
+	return Settlement{}
+}
+
+func TestLNbitsSubscribeSettlements(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/payments/sse" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(401)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		// outgoing payments are sent as other events
+		fmt.Fprint(w, "event: payment-sent\ndata: {\"payment_hash\":\"aa\"}\n\n")
+		fmt.Fprint(w, ": keepalive\n\n")
+		fmt.Fprint(w, "event: payment-received\ndata: {\"payment_hash\":\"bb\",\"preimage\":\"cc\"}\n\n")
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	b := &LNbitsBackend{Host: srv.URL, Key: "key"}
+
+	settlement := receiveSettlement(t, b.SubscribeSettlements)
+
+	if settlement.PaymentHash != "bb" || settlement.Preimage != "cc" {
+		t.Fatalf("settlement %+v", settlement)
+	}
+}
+
+func TestPhoenixSubscribeSettlements(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("phoenix-cli:key"))
+
+		if r.URL.Path != "/websocket" || r.Header.Get("Authorization") != auth {
+			w.WriteHeader(401)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"payment_sent","paymentHash":"aa"}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"payment_received","paymentHash":"bb","amountSat":21}`))
+
+		// until the client closes
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	b := &PhoenixBackend{Host: strings.TrimPrefix(srv.URL, "http://"), Key: "key"}
+
+	settlement := receiveSettlement(t, b.SubscribeSettlements)
+
+	if settlement.PaymentHash != "bb" {
+		t.Fatalf("settlement %+v", settlement)
+	}
+}
+
+func TestPhoenixLookupInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+	preimage := "0808080808080808080808080808080808080808080808080808080808080808"
+
+	tests := []struct {
+		name    string
+		payment map[string]interface{} // outgoing, nil when not found
+		settled bool
+		failed  bool
+	}{
+		{"paid", map[string]interface{}{"isPaid": true, "preimage": preimage, "completedAt": 1700000010000}, true, false},
+		{"pending", map[string]interface{}{"isPaid": false}, false, false},
+		{"failed", map[string]interface{}{"isPaid": false, "completedAt": 1700000010000}, false, true},
+		{"not found", nil, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("phoenix-cli:key"))
+
+				if r.Header.Get("Authorization") != auth || r.URL.Path != "/payments/outgoingbyhash/"+paymentHash || test.payment == nil {
+					w.WriteHeader(404)
+					return
+				}
+
+				payment := map[string]interface{}{
+					"paymentHash": paymentHash,
+					"invoice":     invoice,
+					"createdAt":   1700000000000,
+				}
+				for k, v := range test.payment {
+					payment[k] = v
+				}
+
+				json.NewEncoder(w).Encode(payment)
+			}))
+			defer srv.Close()
+
+			b := &PhoenixBackend{Host: strings.TrimPrefix(srv.URL, "http://"), Key: "key"}
+
+			tx, err := b.LookupInvoice(context.Background(), paymentHash)
+
+			if test.payment == nil {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("error %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tx.Type != "outgoing" || tx.PaymentHash != paymentHash || tx.Settled != test.settled || tx.Failed != test.failed {
+				t.Fatalf("transaction %+v", tx)
+			}
+
+			if test.settled && (tx.Preimage != preimage || tx.SettledAt != 1700000010) {
+				t.Fatalf("transaction %+v", tx)
+			}
+		})
+	}
+}
+
+func TestPhoenixPayInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+	preimage := "0909090909090909090909090909090909090909090909090909090909090909"
+
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    error // nil for an unknown outcome, when status is not 200
+	}{
+		{"paid", 200, `{"recipientAmountSat":21,"routingFeeSat":1,"paymentHash":"` + paymentHash + `","paymentPreimage":"` + preimage + `"}`, nil},
+		{"failed", 200, `{"paymentHash":"` + paymentHash + `","reason":"route not found"}`, ErrPaymentFailed},
+		{"insufficient balance", 200, `{"paymentHash":"` + paymentHash + `","reason":"not enough funds"}`, ErrInsufficientBalance},
+		{"rejected", 400, `invalid invoice`, ErrPaymentFailed},
+		{"unauthorized", 401, ``, ErrPaymentFailed},
+		{"internal error", 500, `timeout`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/payinvoice" || r.FormValue("invoice") != invoice {
+					w.WriteHeader(404)
+					return
+				}
+
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer srv.Close()
+
+			b := &PhoenixBackend{Host: strings.TrimPrefix(srv.URL, "http://"), Key: "key"}
+
+			tx, err := b.PayInvoice(context.Background(), PayParams{Invoice: invoice})
+
+			switch {
+			case test.status == 200 && test.err == nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !tx.Settled || tx.Preimage != preimage || tx.FeesPaid != 1000 {
+					t.Fatalf("transaction %+v", tx)
+				}
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v", err)
+				}
+			default:
+				// the payment may have been made, it's not a failure
+				if err == nil || errors.Is(err, ErrPaymentFailed) {
+					t.Fatalf("error %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,503 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	lnsocket "github.com/jb55/lnsocket/go"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+type CommandoBackend struct {
+	unsupportedBackend
+
+	Host   string
+	NodeId string
+	Rune   string
+}
+
+func init() {
+	RegisterBackend("commando", func(c BackendConfig) Backend {
+		return &CommandoBackend{
+			Host:   c.Host,
+			NodeId: c.NodeId,
+			Rune:   c.Rune,
+		}
+	})
+}
+
+func (b *CommandoBackend) connect() (*lnsocket.LNSocket, error) {
+	ln := &lnsocket.LNSocket{}
+	ln.GenKey()
+
+	err := ln.ConnectAndInit(b.Host, b.NodeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+func commandoCall(ln *lnsocket.LNSocket, rune string, method string, params interface{}) (gjson.Result, error) {
+	jparams, _ := json.Marshal(params)
+
+	body, err := ln.Rpc(rune, method, string(jparams))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	resErr := gjson.Get(body, "error")
+	if resErr.Type != gjson.Null {
+		if resErr.Type == gjson.JSON {
+			return gjson.Result{}, clnError(resErr.Get("code").Int(), resErr.Get("message").String())
+		} else if resErr.Type == gjson.String {
+			return gjson.Result{}, errors.New(resErr.String())
+		}
+		return gjson.Result{}, fmt.Errorf("Unknown commando error: '%v'", resErr)
+	}
+
+	return gjson.Get(body, "result"), nil
+}
+
+// Core lightning and commando error codes.
+const (
+	CLN_PAY_ROUTE_NOT_FOUND        = 205
+	CLN_PAY_ROUTE_TOO_EXPENSIVE    = 206
+	CLN_PAY_INVOICE_EXPIRED        = 207
+	CLN_PAY_STOPPED_RETRYING       = 210
+	CLN_COMMANDO_ERROR_REMOTE      = 0x4c4f
+	CLN_COMMANDO_ERROR_REMOTE_AUTH = 0x4c50
+)
+
+// clnError wraps the error of a core lightning command so that it maps
+// to a NIP-47 error.
+func clnError(code int64, message string) error {
+	if strings.Contains(strings.ToLower(message), "insufficient") {
+		return fmt.Errorf("%w: %s", ErrInsufficientBalance, message)
+	}
+
+	switch code {
+	case CLN_COMMANDO_ERROR_REMOTE_AUTH:
+		return fmt.Errorf("%w: %s", ErrRestricted, message)
+	case CLN_PAY_ROUTE_NOT_FOUND, CLN_PAY_ROUTE_TOO_EXPENSIVE, CLN_PAY_INVOICE_EXPIRED, CLN_PAY_STOPPED_RETRYING:
+		return fmt.Errorf("%w: %s", ErrPaymentFailed, message)
+	}
+
+	return fmt.Errorf("core lightning error (%d): %s", code, message)
+}
+
+// clnMsat reads an amount in msats, older versions of core lightning
+// return them as strings with a "msat" suffix.
+func clnMsat(amount gjson.Result) uint64 {
+	if amount.Type == gjson.String {
+		msat, _ := strconv.ParseUint(strings.TrimSuffix(amount.String(), "msat"), 10, 64)
+		return msat
+	}
+
+	return amount.Uint()
+}
+
+// call connects, runs a single command and disconnects.
+func (b *CommandoBackend) call(method string, params interface{}) (gjson.Result, error) {
+	ln, err := b.connect()
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer ln.Disconnect()
+
+	return commandoCall(ln, b.Rune, method, params)
+}
+
+// clnInvoiceTransaction converts an invoice from core lightning
+// listinvoices or waitanyinvoice.
+func clnInvoiceTransaction(invoice gjson.Result) (*Transaction, error) {
+	tx, err := invoiceTransaction(invoice.Get("bolt11").String())
+	if err != nil {
+		return nil, err
+	}
+
+	if invoice.Get("status").String() == "paid" {
+		tx.Settled = true
+		tx.Preimage = invoice.Get("payment_preimage").String()
+		tx.SettledAt = uint(invoice.Get("paid_at").Uint())
+		if received := clnMsat(invoice.Get("amount_received_msat")); received > 0 {
+			tx.Amount = received
+		}
+	}
+
+	return tx, nil
+}
+
+// clnPaymentTransaction converts a payment from core lightning pay or
+// listpays.
+func clnPaymentTransaction(pay gjson.Result) *Transaction {
+	amount := clnMsat(pay.Get("amount_msat"))
+	sent := clnMsat(pay.Get("amount_sent_msat"))
+
+	tx := &Transaction{
+		Type:        "outgoing",
+		Invoice:     pay.Get("bolt11").String(),
+		Description: pay.Get("description").String(),
+		PaymentHash: pay.Get("payment_hash").String(),
+		Amount:      amount,
+		CreatedAt:   uint(pay.Get("created_at").Float()),
+		Settled:     pay.Get("status").String() == "complete",
+		Failed:      pay.Get("status").String() == "failed",
+	}
+
+	if sent > amount {
+		tx.FeesPaid = sent - amount
+	}
+
+	if bolt11, err := decodepay.Decodepay(tx.Invoice); err == nil {
+		tx.Description = bolt11.Description
+		tx.DescriptionHash = bolt11.DescriptionHash
+		if bolt11.Expiry > 0 {
+			tx.ExpiresAt = uint(bolt11.CreatedAt + bolt11.Expiry)
+		}
+	}
+
+	if tx.Settled {
+		tx.Preimage = pay.Get("payment_preimage").String()
+		if tx.Preimage == "" {
+			tx.Preimage = pay.Get("preimage").String()
+		}
+		tx.SettledAt = uint(pay.Get("completed_at").Uint())
+		if tx.SettledAt == 0 {
+			tx.SettledAt = tx.CreatedAt
+		}
+	}
+
+	return tx
+}
+
+// clnLookupInvoice reads the invoice from a core lightning listinvoices
+// result.
+func clnLookupInvoice(res gjson.Result) (*Transaction, error) {
+	invoices := res.Get("invoices").Array()
+	if len(invoices) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return clnInvoiceTransaction(invoices[0])
+}
+
+func (b *CommandoBackend) Capabilities() []string {
+	return []string{
+		NIP47_PAY_INVOICE_METHOD,
+		NIP47_GET_BALANCE_METHOD,
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+		NIP47_GET_INFO_METHOD,
+		NIP47_LIST_TRANSACTIONS_METHOD,
+		NIP47_PAY_KEYSEND_METHOD,
+		NIP47_MULTI_PAY_KEYSEND_METHOD,
+	}
+}
+
+func (b *CommandoBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	if params.DescriptionHash != "" && !params.UseDescriptionHash {
+		return nil, fmt.Errorf("description hash without description: %w", ErrNotImplemented)
+	}
+
+	label := params.Label
+	if label == "" {
+		label = "nwc/" + strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	invoiceParams := map[string]interface{}{
+		"amount_msat": params.Amount,
+		"label":       label,
+		"description": params.Description,
+	}
+
+	if params.UseDescriptionHash {
+		invoiceParams["deschashonly"] = true
+	}
+
+	if params.Expiry > 0 {
+		invoiceParams["expiry"] = params.Expiry
+	}
+
+	if params.Preimage != "" {
+		invoiceParams["preimage"] = params.Preimage
+	}
+
+	invoice, err := b.call("invoice", invoiceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoiceTransaction(invoice.Get("bolt11").String())
+}
+
+// LookupInvoice looks for an incoming invoice first, and then for an
+// outgoing payment.
+func (b *CommandoBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	ln, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Disconnect()
+
+	res, err := commandoCall(ln, b.Rune, "listinvoices", map[string]interface{}{
+		"payment_hash": paymentHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := clnLookupInvoice(res)
+	if !errors.Is(err, ErrNotFound) {
+		return tx, err
+	}
+
+	pays, err := commandoCall(ln, b.Rune, "listpays", map[string]interface{}{
+		"payment_hash": paymentHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if found := pays.Get("pays").Array(); len(found) > 0 {
+		return clnPaymentTransaction(found[0]), nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func (b *CommandoBackend) PayInvoice(ctx context.Context, params PayParams) (*Transaction, error) {
+	payParams := map[string]interface{}{
+		"bolt11": params.Invoice,
+	}
+
+	if params.MaxFee > 0 {
+		payParams["maxfee"] = params.MaxFee
+	}
+
+	if params.Amount > 0 {
+		bolt11, err := decodepay.Decodepay(params.Invoice)
+		if err != nil {
+			return nil, err
+		}
+
+		if bolt11.MSatoshi == 0 {
+			payParams["amount_msat"] = params.Amount
+		}
+	}
+
+	pay, err := b.call("pay", payParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if pay.Get("status").String() != "complete" {
+		return nil, fmt.Errorf("%w: payment is %s", ErrPaymentFailed, pay.Get("status").String())
+	}
+
+	tx := clnPaymentTransaction(pay)
+	tx.Invoice = params.Invoice
+
+	return tx, nil
+}
+
+// ChoosesKeysendPreimage is true, keysend of CLN chooses the preimage
+// itself.
+func (b *CommandoBackend) ChoosesKeysendPreimage() bool {
+	return true
+}
+
+// PayKeysend sends a spontaneous payment with keysend, which chooses the
+// preimage itself.
+func (b *CommandoBackend) PayKeysend(ctx context.Context, params KeysendParams) (*Transaction, error) {
+	if params.Preimage != "" {
+		return nil, fmt.Errorf("%w: keysend with a given preimage", ErrNotImplemented)
+	}
+
+	keysendParams := map[string]interface{}{
+		"destination": params.PubKey,
+		"amount_msat": params.Amount,
+	}
+
+	if params.MaxFee > 0 {
+		keysendParams["maxfee"] = params.MaxFee
+	}
+
+	if len(params.TLVRecords) > 0 {
+		tlvs := make(map[string]string)
+		for _, record := range params.TLVRecords {
+			tlvs[strconv.FormatUint(record.Type, 10)] = record.Value
+		}
+		keysendParams["extratlvs"] = tlvs
+	}
+
+	pay, err := b.call("keysend", keysendParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if pay.Get("status").String() != "complete" {
+		return nil, fmt.Errorf("%w: payment is %s", ErrPaymentFailed, pay.Get("status").String())
+	}
+
+	return clnPaymentTransaction(pay), nil
+}
+
+// GetBalance returns our spendable balance of the active channels.
+func (b *CommandoBackend) GetBalance(ctx context.Context) (uint64, error) {
+	funds, err := b.call("listfunds", map[string]interface{}{})
+	if err != nil {
+		return 0, err
+	}
+
+	var balance uint64
+
+	for _, channel := range funds.Get("channels").Array() {
+		if channel.Get("state").String() != "CHANNELD_NORMAL" {
+			continue
+		}
+
+		balance += clnMsat(channel.Get("our_amount_msat"))
+	}
+
+	return balance, nil
+}
+
+func (b *CommandoBackend) GetInfo(ctx context.Context) (*NodeInfo, error) {
+	info, err := b.call("getinfo", map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	network := info.Get("network").String()
+	if network == "bitcoin" {
+		network = "mainnet"
+	}
+
+	return &NodeInfo{
+		Alias:       info.Get("alias").String(),
+		Color:       info.Get("color").String(),
+		PubKey:      info.Get("id").String(),
+		Network:     network,
+		BlockHeight: uint(info.Get("blockheight").Uint()),
+	}, nil
+}
+
+// ListTransactions merges the invoices and payments, core lightning has
+// no paging of these so the newest are kept.
+func (b *CommandoBackend) ListTransactions(ctx context.Context, params Nip47ListTransactionsParams) ([]Transaction, error) {
+	ln, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Disconnect()
+
+	var incoming []Transaction
+	var outgoing []Transaction
+
+	if params.Type == "" || params.Type == "incoming" {
+		invoices, err := commandoCall(ln, b.Rune, "listinvoices", map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, invoice := range invoices.Get("invoices").Array() {
+			// invoices without a bolt11 are bolt12 offers
+			if !invoice.Get("bolt11").Exists() {
+				continue
+			}
+
+			tx, err := clnInvoiceTransaction(invoice)
+			if err != nil {
+				return nil, err
+			}
+
+			incoming = append(incoming, *tx)
+		}
+	}
+
+	if params.Type == "" || params.Type == "outgoing" {
+		pays, err := commandoCall(ln, b.Rune, "listpays", map[string]interface{}{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pay := range pays.Get("pays").Array() {
+			outgoing = append(outgoing, *clnPaymentTransaction(pay))
+		}
+	}
+
+	txs := newestTransactions(incoming, params.Limit)
+	txs = append(txs, newestTransactions(outgoing, params.Limit)...)
+
+	return txs, nil
+}
+
+// SubscribeSettlements waits for paid invoices with waitanyinvoice,
+// starting after the most recently paid invoice.
+func (b *CommandoBackend) SubscribeSettlements(ctx context.Context, settled chan<- Settlement) error {
+	ln, err := b.connect()
+	if err != nil {
+		return err
+	}
+	defer ln.Disconnect()
+
+	// unblock reads when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Disconnect()
+		case <-done:
+		}
+	}()
+
+	invoices, err := commandoCall(ln, b.Rune, "listinvoices", map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+
+	var lastPayIndex int64
+	for _, index := range invoices.Get("invoices.#.pay_index").Array() {
+		if index.Int() > lastPayIndex {
+			lastPayIndex = index.Int()
+		}
+	}
+
+	for ctx.Err() == nil {
+		invoice, err := commandoCall(ln, b.Rune, "waitanyinvoice", map[string]interface{}{
+			"lastpay_index": lastPayIndex,
+			"timeout":       60,
+		})
+		if err != nil {
+			if strings.Contains(err.Error(), "Timed out") {
+				continue
+			}
+			return err
+		}
+
+		lastPayIndex = invoice.Get("pay_index").Int()
+
+		if invoice.Get("status").String() != "paid" {
+			continue
+		}
+
+		err = sendSettlement(ctx, settled, Settlement{
+			PaymentHash: invoice.Get("payment_hash").String(),
+			Preimage:    invoice.Get("payment_preimage").String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
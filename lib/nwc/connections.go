@@ -0,0 +1,347 @@
+package nwc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"gorm.io/gorm"
+)
+
+// name of the connection imported from the nwcsecret of the config
+const CONFIG_CONNECTION_NAME = "config"
+
+// how often the active connections of each user are reloaded, so that
+// connections created or revoked with the cli are picked up
+var ConnectionRefreshInterval = 30 * time.Second
+
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// Connection is a wallet connection of an app to a user's wallet, each
+// with its own secret, relays and policy.
+type Connection struct {
+	ID            uint
+	User          string
+	Name          string
+	PubKey        string
+	Secret        string
+	Relays        string // space separated
+	Methods       string // space separated, all when empty
+	MaxAmount     uint64 // msats
+	MaxFee        uint64 // msats
+	Budget        uint64 // msats
+	BudgetRenewal string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	ExpiresAt     *time.Time
+	LastUsedAt    *time.Time
+	RevokedAt     *time.Time
+}
+
+// NewConnection creates a connection with a new secret.
+func NewConnection(user string, name string, relays []string, policy Policy, expiresAt *time.Time) (*Connection, error) {
+	secret := nostr.GeneratePrivateKey()
+
+	pubkey, err := nostr.GetPublicKey(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Connection{
+		User:          user,
+		Name:          name,
+		PubKey:        pubkey,
+		Secret:        secret,
+		Relays:        strings.Join(relays, " "),
+		Methods:       strings.Join(policy.Methods, " "),
+		MaxAmount:     policy.MaxAmount,
+		MaxFee:        policy.MaxFee,
+		Budget:        policy.Budget,
+		BudgetRenewal: policy.BudgetRenewal,
+		ExpiresAt:     expiresAt,
+	}, nil
+}
+
+func (c *Connection) Policy() Policy {
+	return Policy{
+		Methods:       strings.Fields(c.Methods),
+		MaxAmount:     c.MaxAmount,
+		MaxFee:        c.MaxFee,
+		Budget:        c.Budget,
+		BudgetRenewal: c.BudgetRenewal,
+	}
+}
+
+// Active checks that the connection is neither revoked nor expired.
+func (c *Connection) Active(now time.Time) bool {
+	if c.RevokedAt != nil {
+		return false
+	}
+
+	return c.ExpiresAt == nil || now.Before(*c.ExpiresAt)
+}
+
+func (c *Connection) Status(now time.Time) string {
+	switch {
+	case c.RevokedAt != nil:
+		return "revoked"
+	case !c.Active(now):
+		return "expired"
+	}
+
+	return "active"
+}
+
+// ConnectURI returns the connection string for the app, including the
+// budget and methods of the connection when it has them. The max_amount
+// of the budget is in sats, as apps ask for it and the cli takes it.
+func (c *Connection) ConnectURI(walletPubKey string) string {
+	params := url.Values{}
+
+	for _, relay := range strings.Fields(c.Relays) {
+		params.Add("relay", relay)
+	}
+
+	params.Add("secret", c.Secret)
+
+	if c.Methods != "" {
+		params.Add("request_methods", c.Methods)
+	}
+
+	if c.Budget > 0 {
+		params.Add("max_amount", fmt.Sprintf("%d", c.Budget/1000))
+
+		renewal := c.BudgetRenewal
+		if renewal == "" {
+			renewal = BUDGET_RENEWAL_NEVER
+		}
+		params.Add("budget_renewal", renewal)
+	}
+
+	return "nostr+walletconnect://" + walletPubKey + "?" + params.Encode()
+}
+
+func CreateConnection(db *gorm.DB, c *Connection) error {
+	var count int64
+
+	err := db.Table("connections").Where("user = ?", c.User).Where("name = ?", c.Name).Count(&count).Error
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("connection already exists: %s", c.Name)
+	}
+
+	return db.Table("connections").Create(c).Error
+}
+
+// ImportConfigConnection adds the connection of the nwcsecret in the
+// config, so that it can be revoked like any other. Once added its relays
+// and policy are updated from the config on every start, revoking it is
+// kept.
+func ImportConfigConnection(db *gorm.DB, user *NWCUser) error {
+	if user.NWCSecret == "" {
+		return nil
+	}
+
+	policy := user.Policy
+
+	var existing Connection
+
+	result := db.Table("connections").Where("pub_key = ?", user.NWCPubKey).Limit(1).Find(&existing)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected > 0 {
+		if existing.User != user.Name || existing.Name != CONFIG_CONNECTION_NAME {
+			// the secret is also used by a connection made with the cli
+			return nil
+		}
+
+		return db.Table("connections").Where("id = ?", existing.ID).Updates(map[string]interface{}{
+			"relays":         strings.Join(user.Relays, " "),
+			"methods":        strings.Join(policy.Methods, " "),
+			"max_amount":     policy.MaxAmount,
+			"max_fee":        policy.MaxFee,
+			"budget":         policy.Budget,
+			"budget_renewal": policy.BudgetRenewal,
+		}).Error
+	}
+
+	return db.Table("connections").Create(&Connection{
+		User:          user.Name,
+		Name:          CONFIG_CONNECTION_NAME,
+		PubKey:        user.NWCPubKey,
+		Secret:        user.NWCSecret,
+		Relays:        strings.Join(user.Relays, " "),
+		Methods:       strings.Join(policy.Methods, " "),
+		MaxAmount:     policy.MaxAmount,
+		MaxFee:        policy.MaxFee,
+		Budget:        policy.Budget,
+		BudgetRenewal: policy.BudgetRenewal,
+	}).Error
+}
+
+// ListConnections returns the connections of the user, or of all users
+// without one, including revoked and expired connections.
+func ListConnections(db *gorm.DB, user string) ([]Connection, error) {
+	var connections []Connection
+
+	query := db.Table("connections")
+	if user != "" {
+		query = query.Where("user = ?", user)
+	}
+
+	err := query.Order("user").Order("id").Find(&connections).Error
+
+	return connections, err
+}
+
+// ActiveConnections returns the connections of the user that are not
+// revoked or expired.
+func ActiveConnections(db *gorm.DB, user string) ([]Connection, error) {
+	var connections []Connection
+
+	err := db.Table("connections").
+		Where("user = ?", user).
+		Where("revoked_at IS NULL").
+		Order("id").
+		Find(&connections).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := connections[:0]
+
+	for _, c := range connections {
+		if c.Active(now) {
+			active = append(active, c)
+		}
+	}
+
+	return active, nil
+}
+
+// ActivePubKeys returns the sorted pubkeys of the user's active
+// connections.
+func ActivePubKeys(db *gorm.DB, user string) ([]string, error) {
+	connections, err := ActiveConnections(db, user)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkeys := make([]string, len(connections))
+	for i, c := range connections {
+		pubkeys[i] = c.PubKey
+	}
+
+	sort.Strings(pubkeys)
+
+	return pubkeys, nil
+}
+
+// ActiveRelays returns the sorted relays of the user and of the user's
+// active connections.
+func ActiveRelays(db *gorm.DB, user *NWCUser) ([]string, error) {
+	connections, err := ActiveConnections(db, user.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var relays []string
+
+	add := func(relay string) {
+		if !seen[relay] {
+			seen[relay] = true
+			relays = append(relays, relay)
+		}
+	}
+
+	for _, relay := range user.Relays {
+		add(relay)
+	}
+
+	for _, c := range connections {
+		for _, relay := range strings.Fields(c.Relays) {
+			add(relay)
+		}
+	}
+
+	sort.Strings(relays)
+
+	return relays, nil
+}
+
+func GetConnection(db *gorm.DB, user string, name string) (*Connection, error) {
+	var c Connection
+
+	result := db.Table("connections").Where("user = ?", user).Where("name = ?", name).Limit(1).Find(&c)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
+	}
+
+	return &c, nil
+}
+
+// GetActiveConnection returns the user's connection of the pubkey, if it
+// is active.
+func GetActiveConnection(db *gorm.DB, user string, pubkey string) (*Connection, error) {
+	var c Connection
+
+	result := db.Table("connections").Where("user = ?", user).Where("pub_key = ?", pubkey).Limit(1).Find(&c)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 || !c.Active(time.Now()) {
+		return nil, fmt.Errorf("%w: %s", ErrConnectionNotFound, pubkey)
+	}
+
+	return &c, nil
+}
+
+func RevokeConnection(db *gorm.DB, user string, name string) error {
+	result := db.Table("connections").
+		Where("user = ?", user).
+		Where("name = ?", name).
+		Where("revoked_at IS NULL").
+		Update("revoked_at", time.Now())
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrConnectionNotFound, name)
+	}
+
+	return nil
+}
+
+func touchConnection(db *gorm.DB, c *Connection) error {
+	return db.Table("connections").Where("id = ?", c.ID).Update("last_used_at", time.Now()).Error
+}
+
+// WithConnection returns the user as seen by the connection, with its
+// pubkey, secret and policy.
+func (user *NWCUser) WithConnection(c *Connection) *NWCUser {
+	cu := *user
+	cu.NWCPubKey = c.PubKey
+	cu.NWCSecret = c.Secret
+	cu.Policy = c.Policy()
+
+	return &cu
+}
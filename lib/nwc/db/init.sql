@@ -1,5 +1,22 @@
 CREATE TABLE IF NOT EXISTS "request_events" (`id` integer,`nostr_id` text UNIQUE,`user` text,`pub_key` text,`raw` text,`status` text,`created_at` datetime,`updated_at` datetime, `expires_at` datetime,PRIMARY KEY (`id`));
 CREATE UNIQUE INDEX IF NOT EXISTS `idx_request_events_nostr_id` ON `request_events`(`nostr_id`);
-CREATE TABLE IF NOT EXISTS "response_events" (`id` integer,`nostr_id` text UNIQUE,`request_nostr_id` text,`user` text,`pub_key` text,`raw` text,`status` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`id`));
+CREATE TABLE IF NOT EXISTS "response_events" (`id` integer,`nostr_id` text UNIQUE,`request_nostr_id` text,`item_id` text DEFAULT '',`user` text,`pub_key` text,`raw` text,`status` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`id`));
 CREATE UNIQUE INDEX IF NOT EXISTS `idx_response_events_nostr_id` ON `response_events`(`nostr_id`);
-CREATE UNIQUE INDEX IF NOT EXISTS `idx_response_events_request_nostr_id` ON `response_events`(`request_nostr_id`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_response_events_request_item` ON `response_events`(`request_nostr_id`,`item_id`);
+CREATE TABLE IF NOT EXISTS "notification_events" (`id` integer,`nostr_id` text UNIQUE,`user` text,`pub_key` text,`connection_pub_key` text,`payment_hash` text,`type` text,`encryption` text,`raw` text,`status` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`id`));
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_notification_events_nostr_id` ON `notification_events`(`nostr_id`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_notification_events_connection_payment` ON `notification_events`(`user`,`connection_pub_key`,`payment_hash`,`type`,`encryption`);
+CREATE INDEX IF NOT EXISTS `idx_notification_events_status` ON `notification_events`(`status`);
+CREATE TABLE IF NOT EXISTS "payments" (`id` integer,`user` text,`pub_key` text,`request_nostr_id` text,`item_id` text DEFAULT '',`payment_hash` text,`amount` integer,`fees` integer,`preimage` text,`status` text,`created_at` datetime,`updated_at` datetime,PRIMARY KEY (`id`));
+CREATE INDEX IF NOT EXISTS `idx_payments_pub_key_created_at` ON `payments`(`pub_key`,`created_at`);
+CREATE TABLE IF NOT EXISTS "connections" (`id` integer,`user` text,`name` text,`pub_key` text UNIQUE,`secret` text,`relays` text,`methods` text,`max_amount` integer,`max_fee` integer,`budget` integer,`budget_renewal` text,`created_at` datetime,`updated_at` datetime,`expires_at` datetime,`last_used_at` datetime,`revoked_at` datetime,PRIMARY KEY (`id`));
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_connections_pub_key` ON `connections`(`pub_key`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_connections_user_name` ON `connections`(`user`,`name`);
+CREATE INDEX IF NOT EXISTS `idx_payments_user_payment_hash` ON `payments`(`user`,`payment_hash`);
+CREATE INDEX IF NOT EXISTS `idx_payments_request_nostr_id` ON `payments`(`request_nostr_id`);
+CREATE INDEX IF NOT EXISTS `idx_request_events_user_status` ON `request_events`(`user`,`status`);
+CREATE INDEX IF NOT EXISTS `idx_response_events_user_status` ON `response_events`(`user`,`status`);
+CREATE INDEX IF NOT EXISTS `idx_notification_events_user_status` ON `notification_events`(`user`,`status`);
+CREATE TABLE IF NOT EXISTS "transactions" (`id` integer,`user` text,`type` text,`invoice` text,`description` text,`description_hash` text,`preimage` text,`payment_hash` text,`amount` integer,`fees_paid` integer,`created_at` integer,`expires_at` integer,`settled_at` integer,`settled` numeric,`updated_at` datetime,PRIMARY KEY (`id`));
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_transactions_user_payment_hash_type` ON `transactions`(`user`,`payment_hash`,`type`);
+CREATE INDEX IF NOT EXISTS `idx_transactions_user_created_at` ON `transactions`(`user`,`created_at`);
@@ -0,0 +1,61 @@
+package nwc
+
+import (
+	"context"
+
+	"github.com/fiatjaf/eclair-go"
+	"github.com/fiatjaf/makeinvoice"
+)
+
+type EclairBackend struct {
+	unsupportedBackend
+
+	Host     string
+	Password string
+}
+
+func init() {
+	RegisterBackend("eclair", func(c BackendConfig) Backend {
+		return &EclairBackend{
+			Host:     c.Host,
+			Password: c.Key,
+		}
+	})
+}
+
+func (b *EclairBackend) Capabilities() []string {
+	return []string{
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+	}
+}
+
+func (b *EclairBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	return makeInvoiceWith(makeinvoice.EclairParams{
+		Host:     b.Host,
+		Password: b.Password,
+	}, params)
+}
+
+func (b *EclairBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	client := eclair.Client{Host: b.Host, Password: b.Password}
+
+	info, err := client.Call("getreceivedinfo", eclair.Params{"paymentHash": paymentHash})
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := invoiceTransaction(info.Get("paymentRequest.serialized").String())
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Get("status.type").String() == "received" {
+		tx.Settled = true
+		tx.Preimage = info.Get("paymentPreimage").String()
+		tx.Amount = info.Get("status.amount").Uint()
+		tx.SettledAt = uint(info.Get("status.receivedAt.unix").Uint())
+	}
+
+	return tx, nil
+}
@@ -0,0 +1,113 @@
+package nwc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+const (
+	NIP47_ENCRYPTION_NIP04    = "nip04"
+	NIP47_ENCRYPTION_NIP44_V2 = "nip44_v2"
+
+	// supported schemes, in order of preference
+	NIP47_ENCRYPTION_SCHEMES = "nip44_v2 nip04"
+)
+
+// Cipher encrypts and decrypts the content of events between the wallet
+// service and a connection.
+type Cipher interface {
+	Scheme() string
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+}
+
+type nip04Cipher struct {
+	sharedSecret []byte
+}
+
+func (c *nip04Cipher) Scheme() string {
+	return NIP47_ENCRYPTION_NIP04
+}
+
+func (c *nip04Cipher) Encrypt(plaintext string) (string, error) {
+	return nip04.Encrypt(plaintext, c.sharedSecret)
+}
+
+func (c *nip04Cipher) Decrypt(ciphertext string) (string, error) {
+	return nip04.Decrypt(ciphertext, c.sharedSecret)
+}
+
+type nip44Cipher struct {
+	conversationKey [32]byte
+}
+
+func (c *nip44Cipher) Scheme() string {
+	return NIP47_ENCRYPTION_NIP44_V2
+}
+
+func (c *nip44Cipher) Encrypt(plaintext string) (string, error) {
+	return nip44Encrypt(plaintext, c.conversationKey)
+}
+
+func (c *nip44Cipher) Decrypt(ciphertext string) (string, error) {
+	return nip44Decrypt(ciphertext, c.conversationKey)
+}
+
+// NewCipher returns the cipher for the scheme between the connection
+// public key and the wallet service private key.
+func NewCipher(scheme string, pubkey string, privkey string) (Cipher, error) {
+	switch scheme {
+	case NIP47_ENCRYPTION_NIP04:
+		ss, err := nip04.ComputeSharedSecret(pubkey, privkey)
+		if err != nil {
+			return nil, err
+		}
+		return &nip04Cipher{sharedSecret: ss}, nil
+	case NIP47_ENCRYPTION_NIP44_V2:
+		key, err := nip44ConversationKey(pubkey, privkey)
+		if err != nil {
+			return nil, err
+		}
+		return &nip44Cipher{conversationKey: key}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported encryption: %s", scheme)
+}
+
+// EventEncryption returns the scheme requested with the encryption tag
+// of the event, events without the tag use nip04.
+func EventEncryption(event *nostr.Event) string {
+	tag := event.Tags.GetFirst([]string{"encryption"})
+	if tag == nil {
+		return NIP47_ENCRYPTION_NIP04
+	}
+
+	return strings.TrimSpace(tag.Value())
+}
+
+// SupportedEncryption checks whether the scheme is one of
+// NIP47_ENCRYPTION_SCHEMES.
+func SupportedEncryption(scheme string) bool {
+	for _, s := range strings.Fields(NIP47_ENCRYPTION_SCHEMES) {
+		if s == scheme {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EventCipher returns the cipher for an event from a connection, falling
+// back to nip04 for unsupported schemes so that the error can still be
+// sent back.
+func EventCipher(p *NWCParams, event *nostr.Event) (Cipher, error) {
+	scheme := EventEncryption(event)
+	if !SupportedEncryption(scheme) {
+		scheme = NIP47_ENCRYPTION_NIP04
+	}
+
+	return NewCipher(scheme, event.PubKey, p.PrivateKey)
+}
@@ -0,0 +1,162 @@
+package nwc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// number of requests of a user that are executed at once
+var ExecuterWorkers = 8
+
+// executer runs the requests of a user on a bounded number of workers.
+// Requests of the same connection are executed one after the other, so
+// that its payments are made, and its budget used, in the order they
+// were requested.
+type executer struct {
+	db *gorm.DB
+	p *NWCParams
+	user NWCUser
+	responses chan<- ResponseEvent
+
+	pending []RequestEvent // in the order received
+	queued map[string]bool // by nostr id, pending or executing
+	executing map[string]bool // by nostr id
+	busy map[string]bool // by connection pubkey
+	done chan RequestEvent
+
+	wg sync.WaitGroup
+}
+
+// enqueue adds the request to the pending requests, unless it's pending
+// or executing already.
+func (e *executer) enqueue(request RequestEvent) {
+	if e.queued[request.NostrId] {
+		return
+	}
+
+	e.queued[request.NostrId] = true
+	e.pending = append(e.pending, request)
+}
+
+// loadBacklog enqueues the requests that have been received but not
+// executed, e.g. before a restart or by RecoverRequests.
+func (e *executer) loadBacklog() {
+	var requests []RequestEvent
+
+	err := e.db.Table("request_events").
+		Where("user = ?", e.user.Name).
+		Where("status = ?", REQUEST_EVENT_STATUS_RECEIVED).
+		Order("id").
+		Find(&requests).Error
+
+	if err != nil {
+		e.p.Logger.Warn().Err(err).Str("user", e.user.Name).Msg("unable to load request backlog")
+		return
+	}
+
+	for _, request := range requests {
+		e.enqueue(request)
+	}
+}
+
+// schedule starts the pending requests of connections that are not
+// busy, while there are workers available.
+func (e *executer) schedule(ctx context.Context) {
+	var remaining []RequestEvent
+
+	for _, request := range e.pending {
+		if len(e.executing) >= ExecuterWorkers || e.busy[request.PubKey] {
+			remaining = append(remaining, request)
+			continue
+		}
+
+		e.start(ctx, request)
+	}
+
+	e.pending = remaining
+}
+
+func (e *executer) start(ctx context.Context, request RequestEvent) {
+	e.executing[request.NostrId] = true
+	e.busy[request.PubKey] = true
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		user := e.user
+
+		response, err := ExecuteRequest(ctx, e.db, e.p, &user, &request)
+
+		if err != nil {
+			e.p.Logger.Warn().Err(err).Str("request_nostr_id", request.NostrId).Msg("unable to execute request")
+		} else if response != nil {
+			select {
+			case e.responses <- *response:
+			case <-ctx.Done():
+				// published with the backlog after a restart
+			}
+		}
+
+		select {
+		case e.done <- request:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (e *executer) finish(request RequestEvent) {
+	delete(e.executing, request.NostrId)
+	delete(e.queued, request.NostrId)
+	delete(e.busy, request.PubKey)
+}
+
+// recover resolves running requests that are not executing, and
+// enqueues those that are executed again.
+func (e *executer) recover(ctx context.Context) {
+	RecoverRequests(ctx, e.db, e.p, e.user, e.responses, e.executing)
+	e.loadBacklog()
+}
+
+// StartExecuter executes the requests of the user as they are received,
+// and the backlog of requests received before a restart. Once the
+// context is canceled no more requests are started, and it returns once
+// the executing requests are done.
+func StartExecuter(ctx context.Context, db *gorm.DB, p *NWCParams, user NWCUser, requests <-chan RequestEvent, responses chan<- ResponseEvent) {
+	e := &executer{
+		db: db,
+		p: p,
+		user: user,
+		responses: responses,
+		queued: make(map[string]bool),
+		executing: make(map[string]bool),
+		busy: make(map[string]bool),
+		done: make(chan RequestEvent),
+	}
+
+	ticker := time.NewTicker(RecoveryInterval)
+	defer ticker.Stop()
+
+	e.recover(ctx)
+
+	for {
+		e.schedule(ctx)
+
+		select {
+		case <-ctx.Done():
+			e.wg.Wait()
+			p.Logger.Info().Str("user", user.Name).Int("pending", len(e.pending)).Msg("executer stopped")
+			return
+		case request := <-requests:
+			e.enqueue(request)
+		case request := <-e.done:
+			e.finish(request)
+		case <-ticker.C:
+			// payments that were still in flight
+			e.recover(ctx)
+		}
+	}
+}
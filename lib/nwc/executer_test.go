@@ -0,0 +1,66 @@
+package nwc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// BenchmarkExecuter executes a backlog of payments of a few connections,
+// as after a restart.
+func BenchmarkExecuter(b *testing.B) {
+	const queued = 1000
+	const connections = 10
+
+	invoices := make([]string, queued)
+	for i := range invoices {
+		invoices[i], _ = newTestInvoice(b, 1000, "")
+	}
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+
+		db := newTestDB(b)
+		user := NWCUser{Name: "jane", Backend: newFakeBackend()}
+		p := newTestParams(b, db, user)
+
+		conns := make([]*Connection, connections)
+		for i := range conns {
+			c, err := NewConnection("jane", fmt.Sprintf("app%d", i), nil, Policy{}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if err := CreateConnection(db, c); err != nil {
+				b.Fatal(err)
+			}
+
+			conns[i] = c
+		}
+
+		for i, invoice := range invoices {
+			evt := newTestRequest(b, p, conns[i%connections], NIP47_PAY_INVOICE_METHOD, Nip47PayParams{Invoice: invoice}, time.Now())
+			receiveTestRequest(b, db, p, &user, evt)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		responses := make(chan ResponseEvent, queued)
+		stopped := make(chan struct{})
+
+		b.StartTimer()
+
+		go func() {
+			defer close(stopped)
+			StartExecuter(ctx, db, p, user, make(chan RequestEvent), responses)
+		}()
+
+		for i := 0; i < queued; i++ {
+			<-responses
+		}
+
+		cancel()
+		<-stopped
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/braydonf/go-nwc
+
+go 1.22
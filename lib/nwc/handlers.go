@@ -0,0 +1,505 @@
+package nwc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// backendError maps an error from a backend to a NIP-47 error.
+func backendError(p *NWCParams, method string, err error, message string) *Nip47Error {
+	p.Logger.Warn().Err(err).Str("method", method).Msg("backend error")
+
+	switch {
+	case errors.Is(err, ErrNotImplemented):
+		return &Nip47Error{
+			Code: NIP47_ERROR_NOT_IMPLEMENTED,
+			Message: "Not implemented.",
+		}
+	case errors.Is(err, ErrNotFound):
+		return &Nip47Error{
+			Code: NIP47_ERROR_NOT_FOUND,
+			Message: message,
+		}
+	case errors.Is(err, ErrInsufficientBalance):
+		return &Nip47Error{
+			Code: NIP47_ERROR_INSUFFICIENT_BALANCE,
+			Message: "insufficient balance",
+		}
+	case errors.Is(err, ErrPaymentFailed):
+		return &Nip47Error{
+			Code: NIP47_ERROR_PAYMENT_FAILED,
+			Message: err.Error(),
+		}
+	case errors.Is(err, ErrQuotaExceeded):
+		return &Nip47Error{
+			Code: NIP47_ERROR_QUOTA_EXCEEDED,
+			Message: err.Error(),
+		}
+	case errors.Is(err, ErrRestricted):
+		return &Nip47Error{
+			Code: NIP47_ERROR_RESTRICTED,
+			Message: "not allowed by the backend",
+		}
+	}
+
+	return &Nip47Error{
+		Code: NIP47_ERROR_INTERNAL,
+		Message: message,
+	}
+}
+
+func decodeParams(nip47req Nip47Request, params interface{}) *Nip47Error {
+	if len(nip47req.Params) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(nip47req.Params, params); err != nil {
+		return &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "could not decode params",
+		}
+	}
+
+	return nil
+}
+
+// paymentDone updates the ledger with the outcome of a payment, payments
+// that may still complete keep their budget reserved and are reported as
+// in flight.
+func paymentDone(p *NWCParams, payment *Payment, tx *Transaction, err error) (inFlight bool) {
+	var lerr error
+
+	switch {
+	case err == nil:
+		lerr = p.ledger.Settle(payment, tx)
+	case errors.Is(err, ErrPaymentFailed),
+		errors.Is(err, ErrInsufficientBalance),
+		errors.Is(err, ErrNotImplemented),
+		errors.Is(err, ErrRestricted):
+		lerr = p.ledger.Fail(payment)
+	default:
+		p.Logger.Warn().Err(err).Str("payment_hash", payment.PaymentHash).Msg("payment outcome unknown, keeping budget reserved")
+		inFlight = true
+	}
+
+	if lerr != nil {
+		p.Logger.Warn().Err(lerr).Str("payment_hash", payment.PaymentHash).Msg("unable to update payment ledger")
+	}
+
+	return inFlight
+}
+
+// reservePayment journals the payment before the backend is asked to
+// pay. Without a payment to make, it returns the response instead, with
+// the preimage of a hash that has already been paid.
+func reservePayment(p *NWCParams, user *NWCUser, method string, payment *Payment) (*Payment, *Nip47Response, *Nip47Error) {
+	existing, err := p.ledger.Reserve(user, payment)
+
+	if errors.Is(err, ErrDuplicatePayment) && existing.Status == PAYMENT_STATUS_SETTLED {
+		// already paid, respond as before instead of paying again
+		p.Logger.Info().Str("payment_hash", existing.PaymentHash).Msg("already paid")
+
+		return nil, &Nip47Response{
+			ResultType: method,
+			Result: Nip47PayInvoiceResult{
+				Preimage: existing.Preimage,
+			},
+		}, nil
+	} else if errors.Is(err, ErrDuplicatePayment) {
+		return nil, nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "The payment hash is already being paid",
+		}
+	} else if err != nil {
+		return nil, nil, backendError(p, method, err, "could not reserve budget")
+	}
+
+	return payment, nil, nil
+}
+
+func HandlePayInvoice(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request, requestNostrId string) (*Nip47Response, *Nip47Error) {
+	var params Nip47PayParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return nil, nip47err
+	}
+
+	return payInvoice(ctx, p, user, nip47req.Method, requestNostrId, "", params)
+}
+
+// payInvoice pays the invoice of a pay_invoice request, or of an item of
+// a multi_pay_invoice request.
+func payInvoice(ctx context.Context, p *NWCParams, user *NWCUser, method string, requestNostrId string, itemId string, params Nip47PayParams) (*Nip47Response, *Nip47Error) {
+	backend := user.Backend
+
+	bolt11, err := decodepay.Decodepay(strings.ToLower(params.Invoice))
+	if err != nil {
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "could not decode invoice",
+		}
+	}
+
+	amount := uint64(bolt11.MSatoshi)
+	if amount == 0 {
+		amount = params.Amount
+	}
+
+	if amount == 0 {
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "amount is required for invoices without an amount",
+		}
+	}
+
+	payment, nip47resp, nip47err := reservePayment(p, user, method, &Payment{
+		RequestNostrId: requestNostrId,
+		ItemId: itemId,
+		PaymentHash: bolt11.PaymentHash,
+		Amount: amount,
+	})
+
+	if payment == nil {
+		return nip47resp, nip47err
+	}
+
+	tx, err := backend.PayInvoice(ctx, PayParams{
+		Invoice: params.Invoice,
+		Amount: params.Amount,
+		MaxFee: user.Policy.MaxFee,
+	})
+
+	if paymentDone(p, payment, tx, err) {
+		// the request is left running and answered by RecoverRequests
+		// once the outcome is known
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, backendError(p, method, err, "could not pay")
+	}
+
+	p.notifier.Notify(user, NIP47_NOTIFICATION_PAYMENT_SENT, tx)
+
+	return &Nip47Response{
+		ResultType: method,
+		Result: Nip47PayInvoiceResult{
+			Preimage: tx.Preimage,
+		},
+	}, nil
+}
+
+func HandlePayKeysend(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request, requestNostrId string) (*Nip47Response, *Nip47Error) {
+	var params Nip47PayKeysendParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return nil, nip47err
+	}
+
+	return payKeysend(ctx, p, user, nip47req.Method, requestNostrId, "", params)
+}
+
+// payKeysend makes a keysend payment of a pay_keysend request, or of an
+// item of a multi_pay_keysend request.
+func payKeysend(ctx context.Context, p *NWCParams, user *NWCUser, method string, requestNostrId string, itemId string, params Nip47PayKeysendParams) (*Nip47Response, *Nip47Error) {
+	if params.PubKey == "" || params.Amount == 0 {
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "pubkey and amount are required",
+		}
+	}
+
+	// the preimage is chosen before the payment is reserved, so that an
+	// interrupted payment can be looked up by its hash. Backends that
+	// choose it themselves are reserved without a hash, it's filled in
+	// once paid.
+	var preimage, hash []byte
+
+	if chooser, ok := user.Backend.(keysendPreimageChooser); params.Preimage != "" || !ok || !chooser.ChoosesKeysendPreimage() {
+		var err error
+
+		preimage, hash, err = keysendPreimage(params.Preimage)
+		if err != nil {
+			return nil, &Nip47Error{
+				Code: NIP47_ERROR_OTHER,
+				Message: "invalid preimage",
+			}
+		}
+	}
+
+	payment, nip47resp, nip47err := reservePayment(p, user, method, &Payment{
+		RequestNostrId: requestNostrId,
+		ItemId: itemId,
+		PaymentHash: hex.EncodeToString(hash),
+		Amount: params.Amount,
+	})
+
+	if payment == nil {
+		return nip47resp, nip47err
+	}
+
+	tx, err := user.Backend.PayKeysend(ctx, KeysendParams{
+		PubKey: params.PubKey,
+		Amount: params.Amount,
+		Preimage: hex.EncodeToString(preimage),
+		TLVRecords: params.TLVRecords,
+		MaxFee: user.Policy.MaxFee,
+	})
+
+	if paymentDone(p, payment, tx, err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, backendError(p, method, err, "could not pay")
+	}
+
+	p.notifier.Notify(user, NIP47_NOTIFICATION_PAYMENT_SENT, tx)
+
+	return &Nip47Response{
+		ResultType: method,
+		Result: Nip47PayInvoiceResult{
+			Preimage: tx.Preimage,
+		},
+	}, nil
+}
+
+func HandleGetBalance(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+	backend := user.Backend
+
+	msats, err := backend.GetBalance(ctx)
+
+	if err != nil {
+		return nil, backendError(p, nip47req.Method, err, "could not get balance")
+	}
+
+	return &Nip47Response{
+		ResultType: NIP47_GET_BALANCE_METHOD,
+		Result: Nip47GetBalanceResult{
+			Balance: msats,
+		},
+	}, nil
+}
+
+func HandleMakeInvoice(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+	backend := user.Backend
+
+	var params Nip47InvoiceParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return nil, nip47err
+	}
+
+	tx, err := backend.MakeInvoice(ctx, InvoiceParams{
+		Amount: params.Amount,
+		Description: params.Description,
+		DescriptionHash: params.DescriptionHash,
+		Expiry: params.Expiry,
+	})
+
+	if err != nil {
+		return nil, backendError(p, nip47req.Method, err, "could not create invoice")
+	}
+
+	if tx.Type == "" {
+		tx.Type = "incoming"
+	}
+
+	if err := p.transactions.Record(user.Name, tx); err != nil {
+		p.Logger.Warn().Err(err).Str("payment_hash", tx.PaymentHash).Msg("unable to record invoice")
+	}
+
+	// watch the invoice so that backends without settlement
+	// subscriptions also send payment notifications
+	if p.Settler != nil {
+		expiresAt := time.Unix(int64(tx.ExpiresAt), 0)
+		if tx.ExpiresAt == 0 {
+			expiresAt = time.Unix(int64(tx.CreatedAt), 0).Add(time.Hour)
+		}
+
+		p.Settler.Watch(Watch{
+			User: user.Name,
+			Backend: backend,
+			PaymentHash: tx.PaymentHash,
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	return &Nip47Response{
+		ResultType: NIP47_MAKE_INVOICE_METHOD,
+		Result: tx.Nip47Result(),
+	}, nil
+}
+
+func HandleLookupInvoice(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+	backend := user.Backend
+
+	var params Nip47LookupInvoiceParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return nil, nip47err
+	}
+
+	paymentHash := params.PaymentHash
+
+	if paymentHash == "" {
+		paymentRequest, err := decodepay.Decodepay(strings.ToLower(params.Invoice))
+		if err != nil {
+			return nil, &Nip47Error{
+				Code: NIP47_ERROR_OTHER,
+				Message: "could not decode invoice",
+			}
+		}
+		paymentHash = paymentRequest.PaymentHash
+	}
+
+	tx, err := backend.LookupInvoice(ctx, paymentHash)
+
+	if err != nil {
+		return nil, backendError(p, nip47req.Method, err, "could not find invoice")
+	}
+
+	return &Nip47Response{
+		ResultType: NIP47_LOOKUP_INVOICE_METHOD,
+		Result: tx.Nip47Result(),
+	}, nil
+}
+
+// HandleListTransactions lists the recorded transactions of the user,
+// so that the filters, ordering and paging are the same for every
+// backend.
+func HandleListTransactions(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+	var params Nip47ListTransactionsParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return nil, nip47err
+	}
+
+	if params.Type != "" && params.Type != "incoming" && params.Type != "outgoing" {
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "type must be incoming or outgoing",
+		}
+	}
+
+	result, err := p.transactions.List(user.Name, params)
+
+	if err != nil {
+		p.Logger.Warn().Err(err).Str("user", user.Name).Msg("unable to list transactions")
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_INTERNAL,
+			Message: "could not list transactions",
+		}
+	}
+
+	txs := []Nip47InvoiceResult{}
+
+	for _, tx := range result {
+		txs = append(txs, tx.Nip47Result())
+	}
+
+	return &Nip47Response{
+		ResultType: NIP47_LIST_TRANSACTIONS_METHOD,
+		Result: Nip47ListTransactionsResult{
+			Transactions: txs,
+		},
+	}, nil
+}
+
+func HandleGetInfo(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+	backend := user.Backend
+
+	info, err := backend.GetInfo(ctx)
+
+	if err != nil {
+		return nil, backendError(p, nip47req.Method, err, "could not get information")
+	}
+
+	return &Nip47Response{
+		ResultType: NIP47_GET_INFO_METHOD,
+		Result: Nip47GetInfoResult{
+			Alias: info.Alias,
+			Color: info.Color,
+			PubKey: info.PubKey,
+			Network: info.Network, // mainnet, testnet, signet, or regtest
+			BlockHeight: info.BlockHeight,
+			BlockHash: info.BlockHash,
+			Methods: user.Policy.AllowedMethods(append(backend.Capabilities(), NIP47_GET_BUDGET_METHOD)),
+		},
+	}, nil
+}
+
+// HandleGetBudget returns the budget of the connection, or an empty
+// result without a budget.
+func HandleGetBudget(ctx context.Context, p *NWCParams, user *NWCUser, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+	policy := &user.Policy
+
+	result := Nip47GetBudgetResult{}
+
+	if policy.Budget > 0 {
+		start, renewsAt := policy.BudgetPeriod(time.Now())
+
+		used, err := p.ledger.UsedBudget(user.NWCPubKey, start)
+		if err != nil {
+			return nil, backendError(p, nip47req.Method, err, "could not get budget")
+		}
+
+		result.UsedBudget = used
+		result.TotalBudget = policy.Budget
+		result.RenewalPeriod = policy.BudgetRenewal
+
+		if !renewsAt.IsZero() {
+			result.RenewsAt = uint(renewsAt.Unix())
+		} else {
+			result.RenewalPeriod = BUDGET_RENEWAL_NEVER
+		}
+	}
+
+	return &Nip47Response{
+		ResultType: NIP47_GET_BUDGET_METHOD,
+		Result: result,
+	}, nil
+}
+
+// Capabilities returns the methods supported by the backends of all
+// users, for the info event.
+func Capabilities(users []NWCUser) []string {
+	var methods []string
+	first := true
+
+	for _, user := range users {
+		// also users without relays of their own, their connections
+		// may have relays
+		if user.Backend == nil {
+			continue
+		}
+
+		supported := user.Backend.Capabilities()
+
+		if first {
+			methods = append(methods, supported...)
+			first = false
+			continue
+		}
+
+		var common []string
+		for _, method := range methods {
+			for _, s := range supported {
+				if s == method {
+					common = append(common, method)
+					break
+				}
+			}
+		}
+		methods = common
+	}
+
+	// budgets are kept by the wallet service for every backend
+	return append(methods, NIP47_GET_BUDGET_METHOD)
+}
@@ -0,0 +1,213 @@
+package nwc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	PAYMENT_STATUS_PENDING = "pending"
+	PAYMENT_STATUS_SETTLED = "settled"
+	PAYMENT_STATUS_FAILED  = "failed"
+)
+
+var (
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	ErrDuplicatePayment = errors.New("duplicate payment")
+)
+
+// Payment is an outgoing payment made by a wallet connection, used to
+// account for its budget. It's saved before the backend is asked to pay,
+// as a journal to recover payments interrupted by a restart.
+type Payment struct {
+	ID             uint
+	User           string
+	PubKey         string // of the connection
+	RequestNostrId string
+	ItemId         string // d tag of multi request items
+	PaymentHash    string // empty until paid for keysend with a preimage chosen by the backend
+	Amount         uint64 // msats
+	Fees           uint64 // msats, reserved max fee while pending
+	Preimage       string
+	Status         string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Ledger keeps the outgoing payments of wallet connections.
+type Ledger struct {
+	db *gorm.DB
+
+	// payments of multi requests are reserved concurrently
+	mu sync.Mutex
+}
+
+func NewLedger(db *gorm.DB) *Ledger {
+	return &Ledger{db: db}
+}
+
+// UsedBudget returns the sum of amounts and fees of pending and settled
+// payments of the connection since start.
+func (l *Ledger) UsedBudget(pubkey string, start time.Time) (uint64, error) {
+	return usedBudget(l.db, pubkey, start)
+}
+
+func usedBudget(db *gorm.DB, pubkey string, start time.Time) (uint64, error) {
+	var used uint64
+
+	err := db.Table("payments").
+		Select("COALESCE(SUM(amount + fees), 0)").
+		Where("pub_key = ?", pubkey).
+		Where("status IN ?", []string{PAYMENT_STATUS_PENDING, PAYMENT_STATUS_SETTLED}).
+		Where("created_at >= ?", start.Local()). // as saved by gorm
+		Scan(&used).Error
+
+	return used, err
+}
+
+// findPayment returns the pending or settled payment of the user's
+// payment hash, or nil without one.
+func findPayment(db *gorm.DB, user string, paymentHash string) (*Payment, error) {
+	var payment Payment
+
+	result := db.Table("payments").
+		Where("user = ?", user).
+		Where("payment_hash = ?", paymentHash).
+		Where("status IN ?", []string{PAYMENT_STATUS_PENDING, PAYMENT_STATUS_SETTLED}).
+		Order("id DESC").
+		Limit(1).
+		Find(&payment)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	return &payment, nil
+}
+
+// FindByRequest returns the payment made for the request, or item of a
+// multi request, or nil when the backend has not been asked to pay.
+func (l *Ledger) FindByRequest(requestNostrId string, itemId string) (*Payment, error) {
+	var payment Payment
+
+	result := l.db.Table("payments").
+		Where("request_nostr_id = ?", requestNostrId).
+		Where("item_id = ?", itemId).
+		Order("id DESC").
+		Limit(1).
+		Find(&payment)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+
+	return &payment, nil
+}
+
+// Reserve checks the payment against the policy of the connection and
+// records it as pending, so that it counts towards the budget while it
+// is in flight. A payment hash that is already pending or settled is not
+// paid again, the existing payment is returned with ErrDuplicatePayment.
+func (l *Ledger) Reserve(user *NWCUser, payment *Payment) (*Payment, error) {
+	policy := &user.Policy
+	amount := payment.Amount
+
+	if policy.MaxAmount > 0 && amount > policy.MaxAmount {
+		return nil, fmt.Errorf("%w: amount of %d msats is above the maximum of %d msats", ErrQuotaExceeded, amount, policy.MaxAmount)
+	}
+
+	payment.User = user.Name
+	payment.PubKey = user.NWCPubKey
+	payment.Fees = policy.MaxFee
+	payment.Status = PAYMENT_STATUS_PENDING
+
+	var existing *Payment
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+
+		if payment.PaymentHash != "" {
+			existing, err = findPayment(tx, user.Name, payment.PaymentHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		if existing != nil {
+			return fmt.Errorf("%w: %s is %s", ErrDuplicatePayment, payment.PaymentHash, existing.Status)
+		}
+
+		if policy.Budget > 0 {
+			start, _ := policy.BudgetPeriod(time.Now())
+
+			used, err := usedBudget(tx, user.NWCPubKey, start)
+			if err != nil {
+				return err
+			}
+
+			if used+amount+policy.MaxFee > policy.Budget {
+				return fmt.Errorf("%w: budget of %d msats has %d msats left", ErrQuotaExceeded, policy.Budget, policy.Budget-min(used, policy.Budget))
+			}
+		}
+
+		return tx.Table("payments").Create(payment).Error
+	})
+
+	if errors.Is(err, ErrDuplicatePayment) {
+		return existing, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// Settle records the amount, fees and preimage of the payment.
+func (l *Ledger) Settle(payment *Payment, tx *Transaction) error {
+	updates := map[string]interface{}{
+		"status":   PAYMENT_STATUS_SETTLED,
+		"fees":     tx.FeesPaid,
+		"preimage": tx.Preimage,
+	}
+
+	if tx.Amount > 0 {
+		updates["amount"] = tx.Amount
+	}
+
+	if payment.PaymentHash == "" {
+		updates["payment_hash"] = tx.PaymentHash
+	}
+
+	sent := *tx
+	sent.Type = "outgoing"
+	sent.Settled = true
+
+	if sent.PaymentHash == "" {
+		sent.PaymentHash = payment.PaymentHash
+	}
+
+	if sent.Amount == 0 {
+		sent.Amount = payment.Amount
+	}
+
+	return l.db.Transaction(func(db *gorm.DB) error {
+		if err := db.Table("payments").Where("id = ?", payment.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		// listed by list_transactions
+		return recordTransaction(db, payment.User, &sent)
+	})
+}
+
+// Fail releases the reserved budget of a payment that was not made.
+func (l *Ledger) Fail(payment *Payment) error {
+	return l.db.Table("payments").Where("id = ?", payment.ID).Update("status", PAYMENT_STATUS_FAILED).Error
+}
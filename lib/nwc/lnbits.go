@@ -0,0 +1,373 @@
+package nwc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+// number of payments requested at once when listing transactions
+var lnbitsPageSize uint = 100
+
+type LNbitsBackend struct {
+	unsupportedBackend
+
+	Host string
+	Key  string // invoice key
+
+	// admin key, required for paying invoices
+	AdminKey string
+}
+
+func init() {
+	RegisterBackend("lnbits", func(c BackendConfig) Backend {
+		return &LNbitsBackend{
+			Host:     c.Host,
+			Key:      c.Key,
+			AdminKey: c.AdminKey,
+		}
+	})
+}
+
+func (b *LNbitsBackend) get(ctx context.Context, path string) (gjson.Result, error) {
+	return b.request(ctx, "GET", path, b.Key, nil)
+}
+
+func (b *LNbitsBackend) request(ctx context.Context, method string, path string, key string, payload interface{}) (gjson.Result, error) {
+	var reader io.Reader
+	if payload != nil {
+		jbody, _ := json.Marshal(payload)
+		reader = bytes.NewReader(jbody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, b.Host+path, reader)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	req.Header.Set("X-Api-Key", key)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := backendClient(b.Host, Timeout).Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := readBody(res, "lnbits")
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	return gjson.ParseBytes(body), nil
+}
+
+// lnbitsTime reads a payment time, which is a unix timestamp on older
+// versions of lnbits and a date on newer ones.
+func lnbitsTime(value gjson.Result) uint {
+	if value.Type == gjson.Number {
+		return uint(value.Uint())
+	}
+
+	if t, err := time.Parse(time.RFC3339, value.String()); err == nil {
+		return uint(t.Unix())
+	}
+
+	if t, err := time.Parse("2006-01-02T15:04:05.999999", value.String()); err == nil {
+		return uint(t.Unix())
+	}
+
+	return 0
+}
+
+// lnbitsTransaction converts a payment, outgoing payments have negative
+// amounts and fees.
+func lnbitsTransaction(payment gjson.Result) *Transaction {
+	amount := payment.Get("amount").Int()
+	fee := payment.Get("fee").Int()
+
+	tx := &Transaction{
+		Type:        "incoming",
+		Invoice:     payment.Get("bolt11").String(),
+		Description: payment.Get("memo").String(),
+		PaymentHash: payment.Get("payment_hash").String(),
+		CreatedAt:   lnbitsTime(payment.Get("time")),
+		Settled:     !payment.Get("pending").Bool(),
+	}
+
+	if status := payment.Get("status"); status.Exists() {
+		tx.Settled = status.String() == "success"
+		tx.Failed = status.String() == "failed"
+	}
+
+	if amount < 0 {
+		tx.Type = "outgoing"
+		amount = -amount
+	}
+
+	if fee < 0 {
+		fee = -fee
+	}
+
+	tx.Amount = uint64(amount)
+	tx.FeesPaid = uint64(fee)
+
+	if bolt11, err := decodepay.Decodepay(tx.Invoice); err == nil {
+		tx.DescriptionHash = bolt11.DescriptionHash
+		if bolt11.Expiry > 0 {
+			tx.ExpiresAt = uint(bolt11.CreatedAt + bolt11.Expiry)
+		}
+	}
+
+	if tx.Settled {
+		tx.Preimage = payment.Get("preimage").String()
+		tx.SettledAt = tx.CreatedAt
+		if updated := lnbitsTime(payment.Get("updated_at")); updated > 0 {
+			tx.SettledAt = updated
+		}
+	}
+
+	return tx
+}
+
+func (b *LNbitsBackend) Capabilities() []string {
+	methods := []string{
+		NIP47_GET_BALANCE_METHOD,
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+		NIP47_LIST_TRANSACTIONS_METHOD,
+	}
+
+	if b.AdminKey != "" {
+		methods = append(methods, NIP47_PAY_INVOICE_METHOD)
+	}
+
+	return methods
+}
+
+func (b *LNbitsBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	if params.Preimage != "" {
+		return nil, fmt.Errorf("invoice with preimage: %w", ErrNotImplemented)
+	}
+
+	body := map[string]interface{}{
+		"out":    false,
+		"amount": params.Amount / 1000, // sats
+		"memo":   params.Description,
+	}
+
+	if params.UseDescriptionHash {
+		body["unhashed_description"] = hex.EncodeToString([]byte(params.Description))
+	} else if params.DescriptionHash != "" {
+		body["description_hash"] = params.DescriptionHash
+	}
+
+	if params.Expiry > 0 {
+		body["expiry"] = params.Expiry
+	}
+
+	invoice, err := b.request(ctx, "POST", "/api/v1/payments", b.Key, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoiceTransaction(invoice.Get("payment_request").String())
+}
+
+func (b *LNbitsBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	payment, err := b.get(ctx, "/api/v1/payments/"+paymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := lnbitsTransaction(payment.Get("details"))
+
+	if payment.Get("paid").Bool() {
+		tx.Settled = true
+		tx.Preimage = payment.Get("preimage").String()
+		if tx.SettledAt == 0 {
+			tx.SettledAt = tx.CreatedAt
+		}
+	}
+
+	return tx, nil
+}
+
+func (b *LNbitsBackend) PayInvoice(ctx context.Context, params PayParams) (*Transaction, error) {
+	if b.AdminKey == "" {
+		return nil, fmt.Errorf("lnbits admin key is not configured: %w", ErrRestricted)
+	}
+
+	bolt11, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	if bolt11.MSatoshi == 0 {
+		return nil, fmt.Errorf("invoice without an amount: %w", ErrNotImplemented)
+	}
+
+	_, err = b.request(ctx, "POST", "/api/v1/payments", b.AdminKey, map[string]interface{}{
+		"out":    true,
+		"bolt11": params.Invoice,
+	})
+	if err != nil {
+		return nil, lnbitsPaymentError(err)
+	}
+
+	return b.LookupInvoice(ctx, bolt11.PaymentHash)
+}
+
+// lnbitsPaymentError maps the errors lnbits rejects a payment with to
+// ErrPaymentFailed. Anything else, such as a timeout, leaves the payment
+// unknown as it may still be made.
+func lnbitsPaymentError(err error) error {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+
+	if strings.Contains(strings.ToLower(httpErr.Body), "insufficient balance") {
+		return fmt.Errorf("%w: %s", ErrInsufficientBalance, err)
+	}
+
+	switch httpErr.StatusCode {
+	case 400, 402, 403, 520:
+		// rejected invoices, and payments that failed to route
+		return fmt.Errorf("%w: %s", ErrPaymentFailed, err)
+	}
+
+	return err
+}
+
+func (b *LNbitsBackend) GetBalance(ctx context.Context) (uint64, error) {
+	wallet, err := b.get(ctx, "/api/v1/wallet")
+	if err != nil {
+		return 0, err
+	}
+
+	return wallet.Get("balance").Uint(), nil
+}
+
+// ListTransactions pages through the payments of the wallet, newest
+// first, until it has found limit transactions matching the filters.
+func (b *LNbitsBackend) ListTransactions(ctx context.Context, params Nip47ListTransactionsParams) ([]Transaction, error) {
+	var txs []Transaction
+	var offset uint
+
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.FormatUint(uint64(lnbitsPageSize), 10))
+		query.Set("offset", strconv.FormatUint(uint64(offset), 10))
+		query.Set("sortby", "time")
+		query.Set("direction", "desc")
+
+		payments, err := b.get(ctx, "/api/v1/payments?"+query.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		page := payments.Array()
+
+		for _, payment := range page {
+			tx := lnbitsTransaction(payment)
+
+			if params.Until > 0 && tx.CreatedAt > params.Until {
+				continue
+			}
+
+			// sorted by time, so there is nothing older to find
+			if params.From > 0 && tx.CreatedAt < params.From {
+				return txs, nil
+			}
+
+			if (params.Type != "" && tx.Type != params.Type) || (!params.Unpaid && !tx.Settled) {
+				continue
+			}
+
+			txs = append(txs, *tx)
+
+			if params.Limit > 0 && uint(len(txs)) >= params.Limit {
+				return txs, nil
+			}
+		}
+
+		if uint(len(page)) < lnbitsPageSize {
+			return txs, nil
+		}
+
+		offset += lnbitsPageSize
+	}
+}
+
+// SubscribeSettlements reads payment-received server-sent events for
+// the wallet.
+func (b *LNbitsBackend) SubscribeSettlements(ctx context.Context, settled chan<- Settlement) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.Host+"/api/v1/payments/sse", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Api-Key", b.Key)
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := backendClient(b.Host, 0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		_, err := readBody(res, "lnbits")
+		return err
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var event string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if event != "payment-received" {
+				continue
+			}
+
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+
+			err := sendSettlement(ctx, settled, Settlement{
+				PaymentHash: gjson.Get(data, "payment_hash").String(),
+				Preimage:    gjson.Get(data, "preimage").String(),
+			})
+			if err != nil {
+				return err
+			}
+		case line == "":
+			event = ""
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("lnbits event stream closed")
+}
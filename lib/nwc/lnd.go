@@ -0,0 +1,540 @@
+package nwc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+// how long lnd will try to find a route for a payment, in seconds
+var lndPaymentTimeout = 60
+
+// lndFeeLimit is the routing fee limit for a payment, 1% with a minimum
+// of 10 sats.
+func lndFeeLimit(amount uint64) uint64 {
+	limit := amount / 100
+	if limit < 10000 {
+		limit = 10000
+	}
+	return limit
+}
+
+type LNDBackend struct {
+	unsupportedBackend
+
+	Host     string
+	Macaroon string
+}
+
+func init() {
+	RegisterBackend("lnd", func(c BackendConfig) Backend {
+		return &LNDBackend{
+			Host:     c.Host,
+			Macaroon: c.Key,
+		}
+	})
+}
+
+// macaroon returns the macaroon as hex, lnd requires it so if it is on
+// base64 we adjust that.
+func (b *LNDBackend) macaroon() string {
+	if m, err := base64.StdEncoding.DecodeString(b.Macaroon); err == nil {
+		return hex.EncodeToString(m)
+	}
+	return b.Macaroon
+}
+
+func (b *LNDBackend) get(ctx context.Context, path string) (gjson.Result, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.Host+path, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", b.macaroon())
+
+	res, err := backendClient(b.Host, Timeout).Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := readBody(res, "lnd")
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	return gjson.ParseBytes(body), nil
+}
+
+func (b *LNDBackend) post(ctx context.Context, path string, body interface{}) (gjson.Result, error) {
+	jbody, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.Host+path, bytes.NewReader(jbody))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", b.macaroon())
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := backendClient(b.Host, Timeout).Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := readBody(res, "lnd")
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	return gjson.ParseBytes(resBody), nil
+}
+
+// b64hex converts the base64 byte fields of the lnd rest api to hex.
+func b64hex(value string) string {
+	b, _ := base64.StdEncoding.DecodeString(value)
+	return hex.EncodeToString(b)
+}
+
+func lndInvoiceTransaction(invoice gjson.Result) *Transaction {
+	tx := &Transaction{
+		Type:            "incoming",
+		Invoice:         invoice.Get("payment_request").String(),
+		Description:     invoice.Get("memo").String(),
+		DescriptionHash: b64hex(invoice.Get("description_hash").String()),
+		PaymentHash:     b64hex(invoice.Get("r_hash").String()),
+		Amount:          invoice.Get("value_msat").Uint(),
+		CreatedAt:       uint(invoice.Get("creation_date").Uint()),
+		Settled:         invoice.Get("state").String() == "SETTLED",
+	}
+
+	if expiry := invoice.Get("expiry").Uint(); expiry > 0 {
+		tx.ExpiresAt = tx.CreatedAt + uint(expiry)
+	}
+
+	if tx.Settled {
+		tx.Preimage = b64hex(invoice.Get("r_preimage").String())
+		tx.SettledAt = uint(invoice.Get("settle_date").Uint())
+		if paid := invoice.Get("amt_paid_msat").Uint(); paid > 0 {
+			tx.Amount = paid
+		}
+	}
+
+	return tx
+}
+
+// lndPaymentTransaction converts a payment from /v1/payments or
+// /v2/router/send, which unlike invoices has hex encoded hashes.
+func lndPaymentTransaction(payment gjson.Result) *Transaction {
+	tx := &Transaction{
+		Type:        "outgoing",
+		Invoice:     payment.Get("payment_request").String(),
+		PaymentHash: payment.Get("payment_hash").String(),
+		Amount:      payment.Get("value_msat").Uint(),
+		FeesPaid:    payment.Get("fee_msat").Uint(),
+		CreatedAt:   uint(payment.Get("creation_time_ns").Uint() / 1e9),
+		Settled:     payment.Get("status").String() == "SUCCEEDED",
+		Failed:      payment.Get("status").String() == "FAILED",
+	}
+
+	if bolt11, err := decodepay.Decodepay(tx.Invoice); err == nil {
+		tx.Description = bolt11.Description
+		tx.DescriptionHash = bolt11.DescriptionHash
+		if bolt11.Expiry > 0 {
+			tx.ExpiresAt = uint(bolt11.CreatedAt + bolt11.Expiry)
+		}
+	}
+
+	if tx.Settled {
+		tx.Preimage = payment.Get("payment_preimage").String()
+		tx.SettledAt = tx.CreatedAt
+		for _, htlc := range payment.Get("htlcs").Array() {
+			if htlc.Get("status").String() == "SUCCEEDED" {
+				tx.SettledAt = uint(htlc.Get("resolve_time_ns").Uint() / 1e9)
+			}
+		}
+	}
+
+	return tx
+}
+
+func (b *LNDBackend) Capabilities() []string {
+	return []string{
+		NIP47_PAY_INVOICE_METHOD,
+		NIP47_GET_BALANCE_METHOD,
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+		NIP47_GET_INFO_METHOD,
+		NIP47_LIST_TRANSACTIONS_METHOD,
+		NIP47_PAY_KEYSEND_METHOD,
+		NIP47_MULTI_PAY_KEYSEND_METHOD,
+	}
+}
+
+func (b *LNDBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	body := map[string]interface{}{
+		"value_msat": params.Amount,
+		"private":    true,
+	}
+
+	if params.UseDescriptionHash {
+		descriptionHash := sha256.Sum256([]byte(params.Description))
+		body["description_hash"] = descriptionHash[:]
+	} else if params.DescriptionHash != "" {
+		descriptionHash, err := hex.DecodeString(params.DescriptionHash)
+		if err != nil {
+			return nil, err
+		}
+		body["description_hash"] = descriptionHash
+	} else {
+		body["memo"] = params.Description
+	}
+
+	if params.Expiry > 0 {
+		body["expiry"] = params.Expiry
+	}
+
+	if params.Preimage != "" {
+		preimage, err := hex.DecodeString(params.Preimage)
+		if err != nil {
+			return nil, err
+		}
+		body["r_preimage"] = preimage
+	}
+
+	invoice, err := b.post(ctx, "/v1/invoices", body)
+	if err != nil {
+		return nil, err
+	}
+
+	return invoiceTransaction(invoice.Get("payment_request").String())
+}
+
+// LookupInvoice looks for an incoming invoice first, and then for an
+// outgoing payment.
+func (b *LNDBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	invoice, err := b.get(ctx, "/v1/invoice/"+paymentHash)
+	if err == nil {
+		return lndInvoiceTransaction(invoice), nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	return b.lookupPayment(ctx, paymentHash)
+}
+
+// lookupPayment looks up the outgoing payment by its hash with
+// /v2/router/track, which streams the current state of the payment
+// first. It's ErrNotFound only when lnd has no payment of the hash.
+func (b *LNDBackend) lookupPayment(ctx context.Context, paymentHash string) (*Transaction, error) {
+	hash, err := hex.DecodeString(paymentHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment hash: %w", err)
+	}
+
+	path := "/v2/router/track/" + base64.URLEncoding.EncodeToString(hash)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", b.Host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", b.macaroon())
+
+	res, err := backendClient(b.Host, Timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		_, err := readBody(res, "lnd")
+		return nil, lndTrackError(err)
+	}
+
+	var msg json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	result := gjson.GetBytes(msg, "result")
+	if !result.Exists() {
+		return nil, lndTrackError(fmt.Errorf("lnd track payment error: %s", gjson.GetBytes(msg, "error.message").String()))
+	}
+
+	return lndPaymentTransaction(result), nil
+}
+
+// lndTrackError is ErrNotFound for payments lnd has never seen.
+func lndTrackError(err error) error {
+	if err != nil && strings.Contains(err.Error(), "payment isn't initiated") {
+		return fmt.Errorf("%w: %s", ErrNotFound, err)
+	}
+
+	return err
+}
+
+func (b *LNDBackend) PayInvoice(ctx context.Context, params PayParams) (*Transaction, error) {
+	bolt11, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	amount := uint64(bolt11.MSatoshi)
+	if amount == 0 {
+		amount = params.Amount
+	}
+
+	body := map[string]interface{}{
+		"payment_request": params.Invoice,
+		"timeout_seconds": lndPaymentTimeout,
+		"fee_limit_msat":  lndFeeLimit(amount),
+	}
+
+	if params.MaxFee > 0 {
+		body["fee_limit_msat"] = params.MaxFee
+	}
+
+	if bolt11.MSatoshi == 0 {
+		body["amt_msat"] = params.Amount
+	}
+
+	return b.sendPayment(ctx, body)
+}
+
+// PayKeysend sends a spontaneous payment with the preimage in the keysend
+// record, a random preimage is used unless one is given.
+func (b *LNDBackend) PayKeysend(ctx context.Context, params KeysendParams) (*Transaction, error) {
+	dest, err := hex.DecodeString(params.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pubkey: %w", err)
+	}
+
+	preimage, paymentHash, err := keysendPreimage(params.Preimage)
+	if err != nil {
+		return nil, err
+	}
+
+	records := map[string]string{
+		strconv.FormatUint(KEYSEND_RECORD_TYPE, 10): base64.StdEncoding.EncodeToString(preimage),
+	}
+
+	for _, record := range params.TLVRecords {
+		value, err := hex.DecodeString(record.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tlv record value: %w", err)
+		}
+		records[strconv.FormatUint(record.Type, 10)] = base64.StdEncoding.EncodeToString(value)
+	}
+
+	body := map[string]interface{}{
+		"dest":                base64.StdEncoding.EncodeToString(dest),
+		"amt_msat":            params.Amount,
+		"payment_hash":        base64.StdEncoding.EncodeToString(paymentHash),
+		"dest_custom_records": records,
+		"timeout_seconds":     lndPaymentTimeout,
+		"fee_limit_msat":      lndFeeLimit(params.Amount),
+	}
+
+	if params.MaxFee > 0 {
+		body["fee_limit_msat"] = params.MaxFee
+	}
+
+	return b.sendPayment(ctx, body)
+}
+
+// sendPayment sends the payment with /v2/router/send and reads the
+// updates until it has either succeeded or failed.
+func (b *LNDBackend) sendPayment(ctx context.Context, body map[string]interface{}) (*Transaction, error) {
+	jbody, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", b.Host+"/v2/router/send", bytes.NewReader(jbody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", b.macaroon())
+
+	res, err := backendClient(b.Host, 0).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		_, err := readBody(res, "lnd")
+		return nil, err
+	}
+
+	dec := json.NewDecoder(res.Body)
+
+	for {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+
+		result := gjson.GetBytes(msg, "result")
+		if !result.Exists() {
+			return nil, fmt.Errorf("lnd payment error: %s", gjson.GetBytes(msg, "error.message").String())
+		}
+
+		switch result.Get("status").String() {
+		case "SUCCEEDED":
+			return lndPaymentTransaction(result), nil
+		case "FAILED":
+			reason := result.Get("failure_reason").String()
+			if reason == "FAILURE_REASON_INSUFFICIENT_BALANCE" {
+				return nil, ErrInsufficientBalance
+			}
+			return nil, fmt.Errorf("%w: %s", ErrPaymentFailed, reason)
+		}
+	}
+}
+
+// GetBalance returns the spendable balance of the channels.
+func (b *LNDBackend) GetBalance(ctx context.Context) (uint64, error) {
+	balance, err := b.get(ctx, "/v1/balance/channels")
+	if err != nil {
+		return 0, err
+	}
+
+	return balance.Get("local_balance.msat").Uint(), nil
+}
+
+func (b *LNDBackend) GetInfo(ctx context.Context) (*NodeInfo, error) {
+	info, err := b.get(ctx, "/v1/getinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	return &NodeInfo{
+		Alias:       info.Get("alias").String(),
+		Color:       info.Get("color").String(),
+		PubKey:      info.Get("identity_pubkey").String(),
+		Network:     info.Get("chains.0.network").String(),
+		BlockHeight: uint(info.Get("block_height").Uint()),
+		BlockHash:   info.Get("block_hash").String(),
+	}, nil
+}
+
+// ListTransactions merges the newest invoices and payments.
+func (b *LNDBackend) ListTransactions(ctx context.Context, params Nip47ListTransactionsParams) ([]Transaction, error) {
+	var txs []Transaction
+
+	query := url.Values{}
+	query.Set("reversed", "true")
+
+	if params.From > 0 {
+		query.Set("creation_date_start", strconv.FormatUint(uint64(params.From), 10))
+	}
+
+	if params.Until > 0 {
+		query.Set("creation_date_end", strconv.FormatUint(uint64(params.Until), 10))
+	}
+
+	if params.Type == "" || params.Type == "incoming" {
+		invoiceQuery := url.Values{}
+		for k, v := range query {
+			invoiceQuery[k] = v
+		}
+
+		if params.Limit > 0 {
+			invoiceQuery.Set("num_max_invoices", strconv.FormatUint(uint64(params.Limit), 10))
+		}
+
+		invoices, err := b.get(ctx, "/v1/invoices?"+invoiceQuery.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, invoice := range invoices.Get("invoices").Array() {
+			txs = append(txs, *lndInvoiceTransaction(invoice))
+		}
+	}
+
+	if params.Type == "" || params.Type == "outgoing" {
+		paymentQuery := url.Values{}
+		for k, v := range query {
+			paymentQuery[k] = v
+		}
+
+		paymentQuery.Set("include_incomplete", strconv.FormatBool(params.Unpaid))
+
+		if params.Limit > 0 {
+			paymentQuery.Set("max_payments", strconv.FormatUint(uint64(params.Limit), 10))
+		}
+
+		payments, err := b.get(ctx, "/v1/payments?"+paymentQuery.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, payment := range payments.Get("payments").Array() {
+			txs = append(txs, *lndPaymentTransaction(payment))
+		}
+	}
+
+	return txs, nil
+}
+
+// SubscribeSettlements streams invoice updates from
+// /v1/invoices/subscribe.
+func (b *LNDBackend) SubscribeSettlements(ctx context.Context, settled chan<- Settlement) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", b.Host+"/v1/invoices/subscribe", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Grpc-Metadata-macaroon", b.macaroon())
+
+	res, err := backendClient(b.Host, 0).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		_, err := readBody(res, "lnd")
+		return err
+	}
+
+	dec := json.NewDecoder(res.Body)
+
+	for {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+
+		result := gjson.GetBytes(msg, "result")
+		if !result.Exists() {
+			return fmt.Errorf("lnd subscription error: %s", gjson.GetBytes(msg, "error.message").String())
+		}
+
+		if result.Get("state").String() != "SETTLED" {
+			continue
+		}
+
+		err := sendSettlement(ctx, settled, Settlement{
+			PaymentHash: b64hex(result.Get("r_hash").String()),
+			Preimage:    b64hex(result.Get("r_preimage").String()),
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package nwc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+const testMacaroon = "0201036c6e64"
+
+// newTestLND returns a backend of a server with the handler, which checks
+// the macaroon of every call.
+func newTestLND(t *testing.T, handler http.HandlerFunc) *LNDBackend {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Grpc-Metadata-macaroon") != testMacaroon {
+			w.WriteHeader(401)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	// the macaroon may be configured as base64
+	macaroon, _ := hex.DecodeString(testMacaroon)
+
+	return &LNDBackend{
+		Host:     srv.URL,
+		Macaroon: base64.StdEncoding.EncodeToString(macaroon),
+	}
+}
+
+// writeStream writes the messages as lnd streams them, a json object per
+// line.
+func writeStream(w http.ResponseWriter, messages ...interface{}) {
+	for _, msg := range messages {
+		json.NewEncoder(w).Encode(msg)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func b64(value string) string {
+	b, _ := hex.DecodeString(value)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestLNDMakeInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "")
+
+	tests := []struct {
+		name   string
+		params InvoiceParams
+		check  func(body gjson.Result) error
+	}{
+		{
+			name:   "memo",
+			params: InvoiceParams{Amount: 21000, Description: "coffee", Expiry: 600},
+			check: func(body gjson.Result) error {
+				if body.Get("memo").String() != "coffee" || body.Get("expiry").Uint() != 600 {
+					return fmt.Errorf("body %s", body.Raw)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "description hash",
+			params: InvoiceParams{Amount: 21000, Description: "[]", UseDescriptionHash: true},
+			check: func(body gjson.Result) error {
+				hash := sha256.Sum256([]byte("[]"))
+				if body.Get("description_hash").String() != base64.StdEncoding.EncodeToString(hash[:]) || body.Get("memo").Exists() {
+					return fmt.Errorf("body %s", body.Raw)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "preimage",
+			params: InvoiceParams{Amount: 21000, Preimage: "0101010101010101010101010101010101010101010101010101010101010101"},
+			check: func(body gjson.Result) error {
+				if body.Get("r_preimage").String() != b64("0101010101010101010101010101010101010101010101010101010101010101") {
+					return fmt.Errorf("body %s", body.Raw)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var checkErr error
+
+			b := newTestLND(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/v1/invoices" {
+					w.WriteHeader(404)
+					return
+				}
+
+				body, _ := io.ReadAll(r.Body)
+				parsed := gjson.ParseBytes(body)
+
+				if parsed.Get("value_msat").Uint() != 21000 {
+					checkErr = fmt.Errorf("value_msat %s", parsed.Get("value_msat").Raw)
+				} else {
+					checkErr = test.check(parsed)
+				}
+
+				json.NewEncoder(w).Encode(map[string]string{"payment_request": invoice})
+			})
+
+			tx, err := b.MakeInvoice(context.Background(), test.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if checkErr != nil {
+				t.Fatal(checkErr)
+			}
+
+			if tx.PaymentHash != paymentHash || tx.Amount != 21000 || tx.Type != "incoming" {
+				t.Fatalf("transaction %+v", tx)
+			}
+		})
+	}
+}
+
+func TestLNDLookupInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+	preimage := "0202020202020202020202020202020202020202020202020202020202020202"
+	trackPath := "/v2/router/track/" + base64.URLEncoding.EncodeToString(mustHex(paymentHash))
+
+	settledInvoice := map[string]interface{}{
+		"payment_request": invoice,
+		"memo":            "coffee",
+		"r_hash":          b64(paymentHash),
+		"r_preimage":      b64(preimage),
+		"value_msat":      "21000",
+		"amt_paid_msat":   "21000",
+		"creation_date":   "1700000000",
+		"settle_date":     "1700000010",
+		"expiry":          "3600",
+		"state":           "SETTLED",
+	}
+
+	payment := map[string]interface{}{
+		"payment_request":  invoice,
+		"payment_hash":     paymentHash,
+		"payment_preimage": preimage,
+		"value_msat":       "21000",
+		"fee_msat":         "10",
+		"creation_time_ns": "1700000000000000000",
+		"status":           "SUCCEEDED",
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		check   func(tx *Transaction, err error) error
+	}{
+		{
+			name: "settled invoice",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/invoice/"+paymentHash {
+					w.WriteHeader(404)
+					return
+				}
+				json.NewEncoder(w).Encode(settledInvoice)
+			},
+			check: func(tx *Transaction, err error) error {
+				if err != nil {
+					return err
+				}
+				if tx.Type != "incoming" || !tx.Settled || tx.Preimage != preimage || tx.PaymentHash != paymentHash || tx.SettledAt != 1700000010 || tx.ExpiresAt != 1700003600 {
+					return fmt.Errorf("transaction %+v", tx)
+				}
+				return nil
+			},
+		},
+		{
+			name: "payment",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != trackPath {
+					w.WriteHeader(404)
+					return
+				}
+				writeStream(w, map[string]interface{}{"result": payment})
+			},
+			check: func(tx *Transaction, err error) error {
+				if err != nil {
+					return err
+				}
+				if tx.Type != "outgoing" || !tx.Settled || tx.Preimage != preimage || tx.FeesPaid != 10 || tx.Description != "coffee" {
+					return fmt.Errorf("transaction %+v", tx)
+				}
+				return nil
+			},
+		},
+		{
+			name: "payment not initiated",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != trackPath {
+					w.WriteHeader(404)
+					return
+				}
+				writeStream(w, map[string]interface{}{"error": map[string]interface{}{"code": 5, "message": "payment isn't initiated"}})
+			},
+			check: func(tx *Transaction, err error) error {
+				if !errors.Is(err, ErrNotFound) {
+					return fmt.Errorf("error %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "lnd unavailable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != trackPath {
+					w.WriteHeader(404)
+					return
+				}
+				w.WriteHeader(503)
+			},
+			check: func(tx *Transaction, err error) error {
+				// the payment may have been made, it's not a failure
+				if err == nil || errors.Is(err, ErrNotFound) {
+					return fmt.Errorf("error %v", err)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestLND(t, test.handler)
+
+			tx, err := b.LookupInvoice(context.Background(), paymentHash)
+			if err := test.check(tx, err); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLNDPayInvoice(t *testing.T) {
+	invoice, paymentHash := newTestInvoice(t, 21000, "coffee")
+	preimage := "0303030303030303030303030303030303030303030303030303030303030303"
+
+	update := func(status string, reason string) map[string]interface{} {
+		return map[string]interface{}{"result": map[string]interface{}{
+			"payment_request":  invoice,
+			"payment_hash":     paymentHash,
+			"payment_preimage": preimage,
+			"value_msat":       "21000",
+			"fee_msat":         "5",
+			"creation_time_ns": "1700000000000000000",
+			"status":           status,
+			"failure_reason":   reason,
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		updates []interface{}
+		err     error
+	}{
+		{"succeeded", []interface{}{update("IN_FLIGHT", ""), update("SUCCEEDED", "")}, nil},
+		{"failed", []interface{}{update("IN_FLIGHT", ""), update("FAILED", "FAILURE_REASON_NO_ROUTE")}, ErrPaymentFailed},
+		{"insufficient balance", []interface{}{update("FAILED", "FAILURE_REASON_INSUFFICIENT_BALANCE")}, ErrInsufficientBalance},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var feeLimit uint64
+
+			b := newTestLND(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" || r.URL.Path != "/v2/router/send" {
+					w.WriteHeader(404)
+					return
+				}
+
+				body, _ := io.ReadAll(r.Body)
+				feeLimit = gjson.GetBytes(body, "fee_limit_msat").Uint()
+
+				writeStream(w, test.updates...)
+			})
+
+			tx, err := b.PayInvoice(context.Background(), PayParams{Invoice: invoice, MaxFee: 2000})
+
+			if feeLimit != 2000 {
+				t.Fatalf("fee limit %d", feeLimit)
+			}
+
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tx.Settled || tx.Preimage != preimage || tx.FeesPaid != 5 {
+				t.Fatalf("transaction %+v", tx)
+			}
+		})
+	}
+}
+
+func TestLNDPayKeysend(t *testing.T) {
+	preimage := "0404040404040404040404040404040404040404040404040404040404040404"
+	hash := sha256.Sum256(mustHex(preimage))
+	pubkey := "02" + hex.EncodeToString(hash[:])
+
+	var body gjson.Result
+
+	b := newTestLND(t, func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		body = gjson.ParseBytes(raw)
+
+		writeStream(w, map[string]interface{}{"result": map[string]interface{}{
+			"payment_hash":     hex.EncodeToString(hash[:]),
+			"payment_preimage": preimage,
+			"value_msat":       "1000",
+			"status":           "SUCCEEDED",
+		}})
+	})
+
+	tx, err := b.PayKeysend(context.Background(), KeysendParams{
+		PubKey:     pubkey,
+		Amount:     1000,
+		Preimage:   preimage,
+		TLVRecords: []TLVRecord{{Type: 696969, Value: "017b"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Get("payment_hash").String() != base64.StdEncoding.EncodeToString(hash[:]) {
+		t.Fatalf("payment hash %s", body.Get("payment_hash").String())
+	}
+
+	records := body.Get("dest_custom_records")
+
+	if records.Get(strconv.FormatUint(KEYSEND_RECORD_TYPE, 10)).String() != b64(preimage) || records.Get("696969").String() != b64("017b") {
+		t.Fatalf("records %s", records.Raw)
+	}
+
+	if body.Get("dest").String() != b64(pubkey) {
+		t.Fatalf("dest %s", body.Get("dest").String())
+	}
+
+	if tx.Preimage != preimage || tx.PaymentHash != hex.EncodeToString(hash[:]) {
+		t.Fatalf("transaction %+v", tx)
+	}
+}
+
+func TestLNDGetBalance(t *testing.T) {
+	b := newTestLND(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/balance/channels" {
+			w.WriteHeader(404)
+			return
+		}
+		fmt.Fprint(w, `{"local_balance":{"sat":"21","msat":"21000"}}`)
+	})
+
+	balance, err := b.GetBalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance != 21000 {
+		t.Fatalf("balance %d", balance)
+	}
+}
+
+func TestLNDSubscribeSettlements(t *testing.T) {
+	_, paymentHash := newTestInvoice(t, 21000, "")
+	preimage := "0505050505050505050505050505050505050505050505050505050505050505"
+
+	b := newTestLND(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/invoices/subscribe" {
+			w.WriteHeader(404)
+			return
+		}
+
+		writeStream(w,
+			map[string]interface{}{"result": map[string]interface{}{"r_hash": b64(paymentHash), "state": "OPEN"}},
+			map[string]interface{}{"result": map[string]interface{}{"r_hash": b64(paymentHash), "r_preimage": b64(preimage), "state": "SETTLED"}},
+		)
+
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	settled := make(chan Settlement)
+	errs := make(chan error, 1)
+
+	go func() {
+		errs <- b.SubscribeSettlements(ctx, settled)
+	}()
+
+	select {
+	case settlement := <-settled:
+		if settlement.PaymentHash != paymentHash || settlement.Preimage != preimage {
+			t.Fatalf("settlement %+v", settlement)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-ctx.Done():
+		t.Fatal("no settlement")
+	}
+
+	cancel()
+
+	if err := <-errs; err == nil {
+		t.Fatal("subscription returned without error")
+	}
+}
+
+func mustHex(value string) []byte {
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
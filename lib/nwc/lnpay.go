@@ -0,0 +1,85 @@
+package nwc
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/fiatjaf/makeinvoice"
+	"github.com/tidwall/gjson"
+)
+
+var LNPayURL = "https://api.lnpay.co/v1"
+
+type LNPayBackend struct {
+	unsupportedBackend
+
+	Pak  string
+	Waki string
+}
+
+func init() {
+	RegisterBackend("lnpay", func(c BackendConfig) Backend {
+		return &LNPayBackend{
+			Pak:  c.Pak,
+			Waki: c.Waki,
+		}
+	})
+}
+
+func (b *LNPayBackend) Capabilities() []string {
+	return []string{
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+	}
+}
+
+func (b *LNPayBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	return makeInvoiceWith(makeinvoice.LNPayParams{
+		PublicAccessKey:  b.Pak,
+		WalletInvoiceKey: b.Waki,
+	}, params)
+}
+
+// LookupInvoice searches the wallet transactions, lnpay has no lookup
+// by payment hash.
+func (b *LNPayBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", LNPayURL+"/wallet/"+b.Waki+"/transactions", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Api-Key", b.Pak)
+
+	res, err := backendClient(LNPayURL, Timeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := readBody(res, "lnpay")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, wtx := range gjson.ParseBytes(body).Array() {
+		lntx := wtx.Get("lnTx")
+		if lntx.Get("r_hash_decoded").String() != paymentHash {
+			continue
+		}
+
+		tx, err := invoiceTransaction(lntx.Get("payment_request").String())
+		if err != nil {
+			return nil, err
+		}
+
+		if lntx.Get("settled").Int() == 1 {
+			tx.Settled = true
+			tx.Preimage = lntx.Get("payment_preimage").String()
+			tx.SettledAt = uint(lntx.Get("settled_at").Uint())
+		}
+
+		return tx, nil
+	}
+
+	return nil, ErrNotFound
+}
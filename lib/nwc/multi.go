@@ -0,0 +1,257 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"gorm.io/gorm"
+)
+
+// multiItem is a payment of a multi request, answered with a response of
+// its own that is tagged with the d identifier of the item.
+type multiItem struct {
+	ID  string
+	Pay func(ctx context.Context) (*Nip47Response, *Nip47Error)
+}
+
+// maximum number of payments of a multi request made at once
+const MultiPayConcurrency = 5
+
+func invoiceItemId(params Nip47PayParams) string {
+	if params.ID != "" {
+		return params.ID
+	}
+
+	bolt11, err := decodepay.Decodepay(strings.ToLower(params.Invoice))
+	if err != nil {
+		// answered with an error by payInvoice
+		return params.Invoice
+	}
+
+	return bolt11.PaymentHash
+}
+
+func keysendItemId(params Nip47PayKeysendParams) string {
+	if params.ID != "" {
+		return params.ID
+	}
+
+	return params.PubKey
+}
+
+// multiItemIds returns the d identifiers of the items of a multi request,
+// and false for other requests.
+func multiItemIds(nip47req Nip47Request) ([]string, bool) {
+	var ids []string
+
+	switch nip47req.Method {
+	case NIP47_MULTI_PAY_INVOICE_METHOD:
+		var params Nip47MultiPayInvoiceParams
+		json.Unmarshal(nip47req.Params, &params)
+
+		for _, invoice := range params.Invoices {
+			ids = append(ids, invoiceItemId(invoice))
+		}
+	case NIP47_MULTI_PAY_KEYSEND_METHOD:
+		var params Nip47MultiPayKeysendParams
+		json.Unmarshal(nip47req.Params, &params)
+
+		for _, keysend := range params.Keysends {
+			ids = append(ids, keysendItemId(keysend))
+		}
+	default:
+		return nil, false
+	}
+
+	return ids, true
+}
+
+// CommitNip47ItemResponse saves the response of an item of a multi
+// request, the request is done once every item has a response.
+func CommitNip47ItemResponse(db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent, cipher Cipher, itemId string, nip47Resp *Nip47Response, nip47Err *Nip47Error) (*ResponseEvent, error) {
+	nostrResp, err := createNip47Response(p, request, cipher, nostr.Tags{[]string{"d", itemId}}, nip47Resp, nip47Err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	re := &ResponseEvent{
+		NostrId: nostrResp.ID,
+		Raw: nostrResp.String(),
+		RequestNostrId: request.NostrId,
+		ItemId: itemId,
+		PubKey: nostrResp.PubKey,
+		User: user.Name,
+		Status: RESPONSE_EVENT_STATUS_CREATED,
+	}
+
+	if err := db.Table("response_events").Create(re).Error; err != nil {
+		p.Logger.Warn().Err(err).Str("item_id", itemId).Msg("unable to save response")
+		return nil, err
+	}
+
+	return re, nil
+}
+
+func CompleteRequest(db *gorm.DB, requestNostrId string) error {
+	return db.Table("request_events").Where("nostr_id = ?", requestNostrId).Update("status", REQUEST_EVENT_STATUS_DONE).Error
+}
+
+// respondedItems returns the items of the request that have a response.
+func respondedItems(db *gorm.DB, requestNostrId string) (map[string]bool, error) {
+	var itemIds []string
+
+	err := db.Table("response_events").Where("request_nostr_id = ?", requestNostrId).Pluck("item_id", &itemIds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	responded := make(map[string]bool)
+	for _, itemId := range itemIds {
+		responded[itemId] = true
+	}
+
+	return responded, nil
+}
+
+// executeMulti makes the payments of a multi request, up to
+// MultiPayConcurrency at once, skipping items that have a response. The
+// request is done once every item has a response, payments that are
+// still in flight are answered by RecoverRequests.
+func executeMulti(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent, cipher Cipher, items []multiItem) (*ResponseEvent, error) {
+	seen := make(map[string]bool)
+
+	for _, item := range items {
+		if item.ID == "" || seen[item.ID] {
+			return CommitNip47Response(db, p, user, request, cipher, nil, &Nip47Error{
+				Code: NIP47_ERROR_OTHER,
+				Message: fmt.Sprintf("every item needs a unique id: %q", item.ID),
+			})
+		}
+		seen[item.ID] = true
+	}
+
+	if len(items) == 0 {
+		return CommitNip47Response(db, p, user, request, cipher, nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "no items to pay",
+		})
+	}
+
+	responded, err := respondedItems(db, request.NostrId)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var last *ResponseEvent
+	var lastErr error
+	inFlight := false
+
+	var wg sync.WaitGroup
+
+	// Create a buffered channel to control the number of active payments
+	goroutines := make(chan struct{}, MultiPayConcurrency)
+
+	for _, item := range items {
+		if responded[item.ID] {
+			continue
+		}
+
+		wg.Add(1)
+		goroutines <- struct{}{}
+		go func(item multiItem) {
+			defer func() {
+				<-goroutines
+				wg.Done()
+			}()
+
+			nip47Resp, nip47Err := item.Pay(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if nip47Resp == nil && nip47Err == nil {
+				inFlight = true
+				return
+			}
+
+			re, err := CommitNip47ItemResponse(db, p, user, request, cipher, item.ID, nip47Resp, nip47Err)
+			if err != nil {
+				// left running, the item is answered by RecoverRequests
+				inFlight = true
+				lastErr = err
+				return
+			}
+
+			last = re
+		}(item)
+	}
+
+	wg.Wait()
+
+	if !inFlight {
+		if err := CompleteRequest(db, request.NostrId); err != nil {
+			return nil, err
+		}
+	}
+
+	if last == nil {
+		return nil, lastErr
+	}
+
+	return last, nil
+}
+
+func HandleMultiPayInvoice(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent, cipher Cipher, nip47req Nip47Request) (*ResponseEvent, error) {
+	var params Nip47MultiPayInvoiceParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return CommitNip47Response(db, p, user, request, cipher, nil, nip47err)
+	}
+
+	items := make([]multiItem, len(params.Invoices))
+
+	for i, invoice := range params.Invoices {
+		itemId := invoiceItemId(invoice)
+		invoice := invoice
+
+		items[i] = multiItem{
+			ID: itemId,
+			Pay: func(ctx context.Context) (*Nip47Response, *Nip47Error) {
+				return payInvoice(ctx, p, user, nip47req.Method, request.NostrId, itemId, invoice)
+			},
+		}
+	}
+
+	return executeMulti(ctx, db, p, user, request, cipher, items)
+}
+
+func HandleMultiPayKeysend(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent, cipher Cipher, nip47req Nip47Request) (*ResponseEvent, error) {
+	var params Nip47MultiPayKeysendParams
+
+	if nip47err := decodeParams(nip47req, &params); nip47err != nil {
+		return CommitNip47Response(db, p, user, request, cipher, nil, nip47err)
+	}
+
+	items := make([]multiItem, len(params.Keysends))
+
+	for i, keysend := range params.Keysends {
+		itemId := keysendItemId(keysend)
+		keysend := keysend
+
+		items[i] = multiItem{
+			ID: itemId,
+			Pay: func(ctx context.Context) (*Nip47Response, *Nip47Error) {
+				return payKeysend(ctx, p, user, nip47req.Method, request.NostrId, itemId, keysend)
+			},
+		}
+	}
+
+	return executeMulti(ctx, db, p, user, request, cipher, items)
+}
@@ -0,0 +1,189 @@
+package nwc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NIP-44 version 2 encryption, go-nostr v0.30 only has nip04.
+
+const nip44Version = 2
+
+const (
+	nip44MinPlaintext = 1
+	nip44MaxPlaintext = 65535
+)
+
+var ErrNip44Payload = errors.New("invalid nip44 payload")
+
+// nip44ConversationKey returns the key shared by the pubkey and the
+// private key, both hex.
+func nip44ConversationKey(pubkey string, privkey string) ([32]byte, error) {
+	var key [32]byte
+
+	shared, err := nip04.ComputeSharedSecret(pubkey, privkey)
+	if err != nil {
+		return key, err
+	}
+
+	copy(key[:], hkdf.Extract(sha256.New, shared, []byte("nip44-v2")))
+
+	return key, nil
+}
+
+// nip44MessageKeys returns the chacha20 key and nonce, and the hmac key
+// of the message with the nonce.
+func nip44MessageKeys(conversationKey [32]byte, nonce []byte) ([]byte, []byte, []byte, error) {
+	keys := make([]byte, 76)
+
+	r := hkdf.Expand(sha256.New, conversationKey[:], nonce)
+	if _, err := io.ReadFull(r, keys); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+// nip44PaddedLen returns the length of the plaintext once padded, which
+// hides its exact length.
+func nip44PaddedLen(length int) int {
+	if length <= 32 {
+		return 32
+	}
+
+	nextPower := 1 << bits.Len(uint(length-1))
+
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+
+	return chunk * ((length-1)/chunk + 1)
+}
+
+func nip44Pad(plaintext string) ([]byte, error) {
+	length := len(plaintext)
+	if length < nip44MinPlaintext || length > nip44MaxPlaintext {
+		return nil, errors.New("invalid plaintext length")
+	}
+
+	padded := make([]byte, 2+nip44PaddedLen(length))
+	binary.BigEndian.PutUint16(padded, uint16(length))
+	copy(padded[2:], plaintext)
+
+	return padded, nil
+}
+
+func nip44Unpad(padded []byte) (string, error) {
+	length := int(binary.BigEndian.Uint16(padded))
+
+	if length < nip44MinPlaintext || len(padded) != 2+nip44PaddedLen(length) {
+		return "", errors.New("invalid padding")
+	}
+
+	return string(padded[2 : 2+length]), nil
+}
+
+func nip44Mac(key []byte, nonce []byte, ciphertext []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+	return mac.Sum(nil)
+}
+
+// nip44Encrypt encrypts the plaintext with the conversation key and a
+// random nonce.
+func nip44Encrypt(plaintext string, conversationKey [32]byte) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return nip44EncryptWithNonce(plaintext, conversationKey, nonce)
+}
+
+func nip44EncryptWithNonce(plaintext string, conversationKey [32]byte, nonce []byte) (string, error) {
+	if len(nonce) != 32 {
+		return "", errors.New("nonce must be 32 bytes")
+	}
+
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded, err := nip44Pad(plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := make([]byte, len(padded))
+	cipher.XORKeyStream(ciphertext, padded)
+
+	payload := make([]byte, 0, 1+32+len(ciphertext)+32)
+	payload = append(payload, nip44Version)
+	payload = append(payload, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = append(payload, nip44Mac(hmacKey, nonce, ciphertext)...)
+
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// nip44Decrypt decrypts the payload with the conversation key, checking
+// its mac.
+func nip44Decrypt(payload string, conversationKey [32]byte) (string, error) {
+	if len(payload) == 0 || payload[0] == '#' {
+		return "", ErrNip44Payload
+	}
+
+	if len(payload) < 132 || len(payload) > 87472 {
+		return "", ErrNip44Payload
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrNip44Payload
+	}
+
+	if len(data) < 99 || len(data) > 65603 || data[0] != nip44Version {
+		return "", ErrNip44Payload
+	}
+
+	nonce := data[1:33]
+	ciphertext := data[33 : len(data)-32]
+	mac := data[len(data)-32:]
+
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	if !hmac.Equal(mac, nip44Mac(hmacKey, nonce, ciphertext)) {
+		return "", errors.New("invalid nip44 mac")
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded := make([]byte, len(ciphertext))
+	cipher.XORKeyStream(padded, ciphertext)
+
+	return nip44Unpad(padded)
+}
@@ -0,0 +1,151 @@
+package nwc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// vectors of the NIP-44 specification
+var nip44Vectors = []struct {
+	sec1            string
+	sec2            string
+	conversationKey string
+	nonce           string
+	plaintext       string
+	payload         string
+}{
+	{
+		sec1:            "0000000000000000000000000000000000000000000000000000000000000001",
+		sec2:            "0000000000000000000000000000000000000000000000000000000000000002",
+		conversationKey: "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d",
+		nonce:           "0000000000000000000000000000000000000000000000000000000000000001",
+		plaintext:       "a",
+		payload:         "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb",
+	},
+	{
+		sec1:            "0000000000000000000000000000000000000000000000000000000000000002",
+		sec2:            "0000000000000000000000000000000000000000000000000000000000000001",
+		conversationKey: "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d",
+		nonce:           "f00000000000000000000000000000f00000000000000000000000000000000f",
+		plaintext:       "🍕🫃",
+		payload:         "AvAAAAAAAAAAAAAAAAAAAPAAAAAAAAAAAAAAAAAAAAAPSKSK6is9ngkX2+cSq85Th16oRTISAOfhStnixqZziKMDvB0QQzgFZdjLTPicCJaV8nDITO+QfaQ61+KbWQIOO2Yj",
+	},
+	{
+		sec1:            "5c0c523f52a5b6fad39ed2403092df8cebc36318b39383bca6c00808626fab3a",
+		sec2:            "4b22aa260e4acb7021e32f38a6cdf4b673c6a277755bfce287e370c924dc936d",
+		conversationKey: "3e2b52a63be47d34fe0a80e34e73d436d6963bc8f39827f327057a9986c20a45",
+		nonce:           "b635236c42db20f021bb8d1cdff5ca75dd1a0cc72ea742ad750f33010b24f73b",
+		plaintext:       "表ポあA鷗ŒéＢ逍Üßªąñ丂㐀𠀀",
+		payload:         "ArY1I2xC2yDwIbuNHN/1ynXdGgzHLqdCrXUPMwELJPc7s7JqlCMJBAIIjfkpHReBPXeoMCyuClwgbT419jUWU1PwaNl4FEQYKCDKVJz+97Mp3K+Q2YGa77B6gpxB/lr1QgoqpDf7wDVrDmOqGoiPjWDqy8KzLueKDcm9BVP8xeTJIxs=",
+	},
+}
+
+func TestNip44Vectors(t *testing.T) {
+	for i, v := range nip44Vectors {
+		pub2, err := nostr.GetPublicKey(v.sec2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := nip44ConversationKey(pub2, v.sec1)
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+
+		if hex.EncodeToString(key[:]) != v.conversationKey {
+			t.Fatalf("vector %d: conversation key %x", i, key)
+		}
+
+		nonce, _ := hex.DecodeString(v.nonce)
+
+		payload, err := nip44EncryptWithNonce(v.plaintext, key, nonce)
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+
+		if payload != v.payload {
+			t.Fatalf("vector %d: payload %s", i, payload)
+		}
+
+		plaintext, err := nip44Decrypt(v.payload, key)
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+
+		if plaintext != v.plaintext {
+			t.Fatalf("vector %d: plaintext %s", i, plaintext)
+		}
+	}
+}
+
+func TestNip44Long(t *testing.T) {
+	key, _ := hex.DecodeString("8fc262099ce0d0bb9b89bac05bb9e04f9bc0090acc181fef6840ccee470371ed")
+	nonce, _ := hex.DecodeString("326bcb2c943cd6bb717588c9e5a7e738edf6ed14ec5f5344caa6ef56f0b9cff7")
+
+	var conversationKey [32]byte
+	copy(conversationKey[:], key)
+
+	payload, err := nip44EncryptWithNonce(strings.Repeat("x", 65535), conversationKey, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := sha256.Sum256([]byte(payload))
+	if hex.EncodeToString(hash[:]) != "90714492225faba06310bff2f249ebdc2a5e609d65a629f1c87f2d4ffc55330a" {
+		t.Fatalf("payload hash %x", hash)
+	}
+}
+
+func TestNip44DecryptTampered(t *testing.T) {
+	v := nip44Vectors[0]
+
+	key, _ := hex.DecodeString(v.conversationKey)
+
+	var conversationKey [32]byte
+	copy(conversationKey[:], key)
+
+	tampered := v.payload[:len(v.payload)-5] + "AAAA="
+
+	if _, err := nip44Decrypt(tampered, conversationKey); err == nil {
+		t.Fatal("tampered payload was decrypted")
+	}
+
+	if _, err := nip44Decrypt("#"+v.payload[1:], conversationKey); err == nil {
+		t.Fatal("unsupported version was decrypted")
+	}
+}
+
+func TestNip44Cipher(t *testing.T) {
+	sec1 := nostr.GeneratePrivateKey()
+	sec2 := nostr.GeneratePrivateKey()
+	pub1, _ := nostr.GetPublicKey(sec1)
+	pub2, _ := nostr.GetPublicKey(sec2)
+
+	c1, err := NewCipher(NIP47_ENCRYPTION_NIP44_V2, pub2, sec1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewCipher(NIP47_ENCRYPTION_NIP44_V2, pub1, sec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := c1.Encrypt(`{"method":"get_info"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := c2.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext != `{"method":"get_info"}` {
+		t.Fatalf("plaintext %s", plaintext)
+	}
+}
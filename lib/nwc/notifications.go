@@ -0,0 +1,275 @@
+package nwc
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"gorm.io/gorm"
+)
+
+// how often notifications that failed to publish are retried
+var NotificationRetryInterval = time.Minute
+
+type Nip47Notification struct {
+	NotificationType string `json:"notification_type"`
+	Notification interface{} `json:"notification"`
+}
+
+type NotificationEvent struct {
+	ID          uint
+	NostrId     string `validate:"required"`
+	PubKey      string
+	User        string
+	ConnectionPubKey string
+	PaymentHash string
+	Type        string
+	Encryption  string
+	Raw         string
+	Status      string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Notifier creates notification events for wallet connections and hands
+// them to the publisher of each user.
+type Notifier struct {
+	db *gorm.DB
+	p *NWCParams
+	channels map[string]chan NotificationEvent // by user
+}
+
+func NewNotifier(db *gorm.DB, p *NWCParams) *Notifier {
+	return &Notifier{
+		db: db,
+		p: p,
+		channels: make(map[string]chan NotificationEvent),
+	}
+}
+
+// Channel returns the channel of new notification events for the user,
+// all channels are created before starting the publishers.
+func (n *Notifier) Channel(user string) chan NotificationEvent {
+	ch, ok := n.channels[user]
+	if !ok {
+		ch = make(chan NotificationEvent, 10)
+		n.channels[user] = ch
+	}
+
+	return ch
+}
+
+// CreateNostrNotification creates a notification event, of kind 23197
+// for nip44 and 23196 for nip04.
+func CreateNostrNotification(p *NWCParams, user *NWCUser, encryption string, notificationType string, tx *Transaction) (*nostr.Event, error) {
+	cipher, err := NewCipher(encryption, user.NWCPubKey, p.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadBytes, err := json.Marshal(Nip47Notification{
+		NotificationType: notificationType,
+		Notification: tx.Nip47Result(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.Logger.Trace().Str("content", string(payloadBytes)).Msg("creating nostr notification")
+
+	msg, err := cipher.Encrypt(string(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	kind := NIP47_NOTIFICATION_KIND
+	if encryption == NIP47_ENCRYPTION_NIP44_V2 {
+		kind = NIP47_NOTIFICATION_NIP44_KIND
+	}
+
+	ev := &nostr.Event{
+		PubKey:    p.PublicKey,
+		CreatedAt: nostr.Now(),
+		Kind:      kind,
+		Tags:      nostr.Tags{[]string{"p", user.NWCPubKey}},
+		Content:   msg,
+	}
+
+	if err := ev.Sign(p.PrivateKey); err != nil {
+		return nil, err
+	}
+
+	return ev, nil
+}
+
+// Notify saves a notification of the transaction for every active
+// connection of the user and queues it for publishing, once per payment
+// hash and type. It's published with every supported encryption, as the
+// connection may not support the newest.
+func (n *Notifier) Notify(user *NWCUser, notificationType string, tx *Transaction) {
+	if n == nil {
+		return
+	}
+
+	connections, err := ActiveConnections(n.db, user.Name)
+	if err != nil {
+		n.p.Logger.Warn().Err(err).Str("user", user.Name).Msg("unable to get connections for notification")
+		return
+	}
+
+	for i := range connections {
+		for _, encryption := range strings.Fields(NIP47_ENCRYPTION_SCHEMES) {
+			n.notify(user.WithConnection(&connections[i]), encryption, notificationType, tx)
+		}
+	}
+}
+
+func (n *Notifier) notify(user *NWCUser, encryption string, notificationType string, tx *Transaction) {
+	p := n.p
+
+	existing := NotificationEvent{}
+
+	result := n.db.Table("notification_events").
+		Where("user = ?", user.Name).
+		Where("connection_pub_key = ?", user.NWCPubKey).
+		Where("payment_hash = ?", tx.PaymentHash).
+		Where("type = ?", notificationType).
+		Where("encryption = ?", encryption).
+		Find(&existing)
+
+	if result.RowsAffected != 0 {
+		p.Logger.Debug().Str("payment_hash", tx.PaymentHash).Str("type", notificationType).Msg("notification already created")
+		return
+	}
+
+	event, err := CreateNostrNotification(p, user, encryption, notificationType, tx)
+	if err != nil {
+		p.Logger.Warn().Err(err).Msg("unable to create nostr notification")
+		return
+	}
+
+	ne := NotificationEvent{
+		NostrId: event.ID,
+		PubKey: event.PubKey,
+		User: user.Name,
+		ConnectionPubKey: user.NWCPubKey,
+		PaymentHash: tx.PaymentHash,
+		Type: notificationType,
+		Encryption: encryption,
+		Raw: event.String(),
+		Status: NOTIFICATION_EVENT_STATUS_CREATED,
+	}
+
+	if err := n.db.Table("notification_events").Create(&ne).Error; err != nil {
+		p.Logger.Warn().Err(err).Str("payment_hash", tx.PaymentHash).Msg("unable to save notification")
+		return
+	}
+
+	p.Logger.Info().Str("user", user.Name).Str("type", notificationType).Str("payment_hash", tx.PaymentHash).Msg("created notification")
+
+	ch, ok := n.channels[user.Name]
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- ne:
+	default:
+		// the publisher is busy and will pick it up from the backlog
+	}
+}
+
+// NotifySettlement records and notifies about an incoming payment
+// reported by the settler.
+func (n *Notifier) NotifySettlement(ctx context.Context, name string, settlement Settlement) {
+	user := n.p.GetUser(name)
+	if user == nil || user.Backend == nil {
+		return
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	tx, err := user.Backend.LookupInvoice(lctx, settlement.PaymentHash)
+	if err != nil {
+		n.p.Logger.Warn().Err(err).Str("payment_hash", settlement.PaymentHash).Msg("unable to look up paid invoice for notification")
+		return
+	}
+
+	if tx.Type != "incoming" {
+		return
+	}
+
+	if tx.Preimage == "" {
+		tx.Preimage = settlement.Preimage
+	}
+
+	if !tx.Settled {
+		tx.Settled = true
+		tx.SettledAt = uint(time.Now().Unix())
+	}
+
+	if err := n.p.transactions.Record(user.Name, tx); err != nil {
+		n.p.Logger.Warn().Err(err).Str("payment_hash", tx.PaymentHash).Msg("unable to record settlement")
+	}
+
+	n.Notify(user, NIP47_NOTIFICATION_PAYMENT_RECEIVED, tx)
+}
+
+func PublishNotificationEvent(ctx context.Context, p *NWCParams, db *gorm.DB, relays *Relays, urls []string, ne *NotificationEvent) error {
+	var event = nostr.Event{}
+
+	err := json.Unmarshal([]byte(ne.Raw), &event)
+	if err != nil {
+		return err
+	}
+
+	// it may have been published with the backlog since
+	result := db.Table("notification_events").
+		Where("id = ?", ne.ID).
+		Where("status <> ?", NOTIFICATION_EVENT_STATUS_DONE).
+		Update("status", NOTIFICATION_EVENT_STATUS_SENDING)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+
+	err = relays.Publish(ctx, urls, event)
+
+	if err != nil {
+		// retried with the backlog
+		db.Table("notification_events").Where("id = ?", ne.ID).Update("status", NOTIFICATION_EVENT_STATUS_CREATED)
+		return err
+	}
+
+	return db.Table("notification_events").Where("id = ?", ne.ID).Update("status", NOTIFICATION_EVENT_STATUS_DONE).Error
+}
+
+// PublishNotificationBacklog publishes every notification that has not
+// been published, including those interrupted while sending.
+func PublishNotificationBacklog(ctx context.Context, db *gorm.DB, p *NWCParams, relays *Relays, urls []string, user NWCUser) {
+	var notifications []NotificationEvent
+
+	result := db.Table("notification_events").
+		Where("user = ?", user.Name).
+		Where("status IN ?", []string{NOTIFICATION_EVENT_STATUS_CREATED, NOTIFICATION_EVENT_STATUS_SENDING}).
+		Order("id").
+		Find(&notifications)
+
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	for _, notification := range notifications {
+		p.Logger.Info().Str("notification_nostr_id", notification.NostrId).Msg("notification backlog")
+
+		err := PublishNotificationEvent(ctx, p, db, relays, urls, &notification)
+
+		if err != nil {
+			p.Logger.Warn().Err(err).Msg("unable to publish notification")
+			return
+		}
+	}
+}
@@ -2,13 +2,17 @@ package nwc
 
 import (
 	"fmt"
+	"errors"
 	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	_ "embed"
 	"time"
 	"encoding/json"
 
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip04"
 	"github.com/rs/zerolog"
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
@@ -18,6 +22,8 @@ const (
 	NIP47_INFO_KIND                  = 13194
 	NIP47_REQUEST_KIND               = 23194
 	NIP47_RESPONSE_KIND              = 23195
+	NIP47_NOTIFICATION_KIND          = 23196 // nip04
+	NIP47_NOTIFICATION_NIP44_KIND    = 23197
 
 	NIP47_PAY_INVOICE_METHOD         = "pay_invoice"
 	NIP47_GET_BALANCE_METHOD         = "get_balance"
@@ -29,6 +35,7 @@ const (
 	NIP47_MULTI_PAY_INVOICE_METHOD   = "multi_pay_invoice"
 	NIP47_MULTI_PAY_KEYSEND_METHOD   = "multi_pay_keysend"
 	NIP47_SIGN_MESSAGE_METHOD        = "sign_message"
+	NIP47_GET_BUDGET_METHOD          = "get_budget"
 
 	NIP47_ERROR_RATE_LIMITED         = "RATE_LIMITED"
 	NIP47_ERROR_NOT_IMPLEMENTED      = "NOT_IMPLEMENTED"
@@ -38,10 +45,13 @@ const (
 	NIP47_ERROR_RESTRICTED           = "RESTRICTED"
 	NIP47_ERROR_UNAUTHORIZED         = "UNAUTHORIZED"
 	NIP47_ERROR_INTERNAL             = "INTERNAL"
+	NIP47_ERROR_PAYMENT_FAILED       = "PAYMENT_FAILED"
+	NIP47_ERROR_UNSUPPORTED_ENCRYPTION = "UNSUPPORTED_ENCRYPTION"
 	NIP47_ERROR_OTHER                = "OTHER"
 
-	NIP47_CAPABILITIES               = "pay_invoice get_balance make_invoice lookup_invoice get_info list_transactions"
-	NIP47_NOTIFICATION_TYPES         = "payment_received" // payment_received, balance_updated, payment_sent, channel_opened, channel_closed
+	NIP47_NOTIFICATION_PAYMENT_RECEIVED = "payment_received"
+	NIP47_NOTIFICATION_PAYMENT_SENT     = "payment_sent"
+	NIP47_NOTIFICATION_TYPES            = "payment_received payment_sent"
 )
 
 const (
@@ -51,8 +61,15 @@ const (
 	RESPONSE_EVENT_STATUS_CREATED = "created"
 	RESPONSE_EVENT_STATUS_SENDING = "sending"
 	RESPONSE_EVENT_STATUS_DONE = "done"
+	NOTIFICATION_EVENT_STATUS_CREATED = "created"
+	NOTIFICATION_EVENT_STATUS_SENDING = "sending"
+	NOTIFICATION_EVENT_STATUS_DONE = "done"
 )
 
+// how long after it was created a request is executed, when not set in
+// the params
+const DefaultMaxRequestAge = 10 * time.Minute
+
 //go:embed db/init.sql
 var db_init_sql string
 
@@ -62,7 +79,25 @@ type Nip47Request struct {
 }
 
 type Nip47PayParams struct {
+	ID string `json:"id,omitempty"` // of multi_pay_invoice items
 	Invoice string `json:"invoice"`
+	Amount uint64 `json:"amount,omitempty"`
+}
+
+type Nip47MultiPayInvoiceParams struct {
+	Invoices []Nip47PayParams `json:"invoices"`
+}
+
+type Nip47PayKeysendParams struct {
+	ID string `json:"id,omitempty"` // of multi_pay_keysend items
+	Amount uint64 `json:"amount"`
+	PubKey string `json:"pubkey"`
+	Preimage string `json:"preimage,omitempty"`
+	TLVRecords []TLVRecord `json:"tlv_records,omitempty"`
+}
+
+type Nip47MultiPayKeysendParams struct {
+	Keysends []Nip47PayKeysendParams `json:"keysends"`
 }
 
 type Nip47LookupInvoiceParams struct {
@@ -123,6 +158,13 @@ type Nip47InvoiceResult struct {
 	SettledAt uint `json:"settled_at,omitempty"`
 }
 
+type Nip47GetBudgetResult struct {
+	UsedBudget uint64 `json:"used_budget,omitempty"`
+	TotalBudget uint64 `json:"total_budget,omitempty"`
+	RenewsAt uint `json:"renews_at,omitempty"`
+	RenewalPeriod string `json:"renewal_period,omitempty"`
+}
+
 type Nip47GetInfoResult struct {
 	Alias string `json:"alias,omitempty"`
 	Color string `json:"color,omitempty"`
@@ -149,6 +191,7 @@ type ResponseEvent struct {
 	ID              uint
 	NostrId         string `validate:"required"`
 	RequestNostrId  string `validate:"required"`
+	ItemId          string // d tag of multi request items
 	PubKey          string
 	User            string
 	Raw             string
@@ -157,14 +200,15 @@ type ResponseEvent struct {
 	UpdatedAt       time.Time
 }
 
+// NWCUser is a user with a wallet, the secret, pubkey and policy are of
+// the connection in the config, or of the connection of a request.
 type NWCUser struct {
 	Name string
 	NWCSecret string
 	NWCPubKey string
-	Relay string
-	Kind string
-	Key string
-	Host string
+	Relays []string
+	Backend Backend
+	Policy Policy
 }
 
 type NWCParams struct {
@@ -173,24 +217,114 @@ type NWCParams struct {
 	Users []NWCUser
 	Logger *zerolog.Logger
 	DBPath string
+
+	// MaxRequestAge is how far the created_at of a request may be from
+	// the current time for it to be executed, DefaultMaxRequestAge when
+	// zero.
+	MaxRequestAge time.Duration
+
+	// AuthRelays are the relays that are authenticated with (NIP-42)
+	// right after connecting, other relays are authenticated with once
+	// they require it.
+	AuthRelays []string
+
+	// Settler is used for payment notifications, optional.
+	Settler *Settler
+
+	notifier *Notifier
+	ledger *Ledger
+	transactions *Transactions
 }
 
-func (r *RequestEvent) GetNip47Request(p *NWCParams, user *NWCUser) (*Nip47Request, error) {
-	ss, err := nip04.ComputeSharedSecret(user.NWCPubKey, p.PrivateKey)
+func (p *NWCParams) maxRequestAge() time.Duration {
+	if p.MaxRequestAge > 0 {
+		return p.MaxRequestAge
+	}
+
+	return DefaultMaxRequestAge
+}
+
+// EventExpiration returns the time of the expiration tag of the event, or
+// the zero time without one.
+func EventExpiration(event *nostr.Event) time.Time {
+	tag := event.Tags.GetFirst([]string{"expiration"})
+	if tag == nil {
+		return time.Time{}
+	}
 
+	seconds, err := strconv.ParseInt(tag.Value(), 10, 64)
 	if err != nil {
-		return nil, err
+		return time.Time{}
+	}
+
+	return time.Unix(seconds, 0)
+}
+
+// CheckRequestAge rejects requests that have expired, or were created
+// too long before or after now, so that requests are not executed long
+// after the app has given up on them, e.g. after downtime.
+func CheckRequestAge(p *NWCParams, event *nostr.Event, expiresAt time.Time, now time.Time) *Nip47Error {
+	if !expiresAt.IsZero() && !now.Before(expiresAt) {
+		return &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "The request has expired",
+		}
+	}
+
+	age := now.Sub(event.CreatedAt.Time())
+	window := p.maxRequestAge()
+
+	if age > window || age < -window {
+		return &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: fmt.Sprintf("The request was created too long ago or in the future, allowed is %s", window),
+		}
+	}
+
+	return nil
+}
+
+func (p *NWCParams) GetUser(name string) *NWCUser {
+	for i := range p.Users {
+		if p.Users[i].Name == name {
+			return &p.Users[i]
+		}
 	}
 
+	return nil
+}
+
+func (r *RequestEvent) GetEvent() (*nostr.Event, error) {
 	var evt = nostr.Event{}
 
-	err = json.Unmarshal([]byte(r.Raw), &evt)
+	err := json.Unmarshal([]byte(r.Raw), &evt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &evt, nil
+}
+
+// GetCipher returns the cipher of the scheme used by the request.
+func (r *RequestEvent) GetCipher(p *NWCParams) (Cipher, error) {
+	evt, err := r.GetEvent()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return EventCipher(p, evt)
+}
+
+func (r *RequestEvent) GetNip47Request(p *NWCParams, cipher Cipher) (*Nip47Request, error) {
+	evt, err := r.GetEvent()
 
 	if err != nil {
 		return nil, err
 	}
 
-	payload, err := nip04.Decrypt(evt.Content, ss)
+	payload, err := cipher.Decrypt(evt.Content)
 
 	if err != nil {
 		return nil, err
@@ -207,10 +341,82 @@ func (r *RequestEvent) GetNip47Request(p *NWCParams, user *NWCUser) (*Nip47Reque
 	return request, nil
 }
 
-func InitDB(db *gorm.DB, p *NWCParams) {
+// MigrateDB updates tables created by earlier versions, before the
+// tables and indexes of init.sql are created.
+func MigrateDB(db *gorm.DB) error {
+	m := db.Migrator()
+
+	if m.HasTable("notification_events") && !m.HasColumn("notification_events", "encryption") {
+		err := db.Exec("ALTER TABLE `notification_events` ADD COLUMN `encryption` text DEFAULT '" + NIP47_ENCRYPTION_NIP04 + "'").Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Exec("DROP INDEX IF EXISTS `idx_notification_events_payment`").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.HasTable("notification_events") && !m.HasColumn("notification_events", "connection_pub_key") {
+		err := db.Exec("ALTER TABLE `notification_events` ADD COLUMN `connection_pub_key` text").Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Exec("DROP INDEX IF EXISTS `idx_notification_events_payment_encryption`").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.HasTable("payments") && !m.HasColumn("payments", "preimage") {
+		err := db.Exec("ALTER TABLE `payments` ADD COLUMN `preimage` text").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.HasTable("payments") && !m.HasColumn("payments", "item_id") {
+		err := db.Exec("ALTER TABLE `payments` ADD COLUMN `item_id` text DEFAULT ''").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.HasTable("response_events") && !m.HasColumn("response_events", "item_id") {
+		err := db.Exec("ALTER TABLE `response_events` ADD COLUMN `item_id` text DEFAULT ''").Error
+		if err != nil {
+			return err
+		}
+
+		err = db.Exec("DROP INDEX IF EXISTS `idx_response_events_request_nostr_id`").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OpenDB opens the database, creating and migrating the tables, it's
+// shared by the server and the cli.
+func OpenDB(path string) (*gorm.DB, error) {
+	// requests are executed concurrently
+	db, err := gorm.Open(sqlite.Open(path+"?_pragma=busy_timeout(5000)"), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := MigrateDB(db); err != nil {
+		return nil, fmt.Errorf("could not migrate db: %w", err)
+	}
+
 	if err := db.Exec(db_init_sql).Error; err != nil {
-		p.Logger.Fatal().Err(err).Msg("could not init db")
+		return nil, fmt.Errorf("could not init db: %w", err)
 	}
+
+	return db, nil
 }
 
 func CommitResponseEvent(db *gorm.DB, p *NWCParams, user *NWCUser, response *nostr.Event, requestNostrId string) (*ResponseEvent, error) {
@@ -225,12 +431,15 @@ func CommitResponseEvent(db *gorm.DB, p *NWCParams, user *NWCUser, response *nos
 
 	p.Logger.Trace().Str("event", response.String()).Msg("saving response event")
 
-	tx := db.Begin()
-	tx.Table("response_events").Create(re)
-	tx.Table("request_events").Where("nostr_id = ?", requestNostrId).Update("status", REQUEST_EVENT_STATUS_DONE)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Table("response_events").Create(re).Error; err != nil {
+			return err
+		}
+
+		return tx.Table("request_events").Where("nostr_id = ?", requestNostrId).Update("status", REQUEST_EVENT_STATUS_DONE).Error
+	})
 
-	if err := tx.Commit().Error; err != nil {
-		tx.Rollback()
+	if err != nil {
 		p.Logger.Warn().Err(err).Msg("unable to save response")
 		return nil, err
 	}
@@ -238,7 +447,7 @@ func CommitResponseEvent(db *gorm.DB, p *NWCParams, user *NWCUser, response *nos
 	return re, nil
 }
 
-func CreateNostrResponse(p *NWCParams, refPubKey string, refID string, content interface{}, tags nostr.Tags, ss []byte) (result *nostr.Event, err error) {
+func CreateNostrResponse(p *NWCParams, refPubKey string, refID string, content interface{}, tags nostr.Tags, cipher Cipher) (result *nostr.Event, err error) {
 	payloadBytes, err := json.Marshal(content)
 	if err != nil {
 		return nil, err
@@ -246,7 +455,7 @@ func CreateNostrResponse(p *NWCParams, refPubKey string, refID string, content i
 
 	p.Logger.Trace().Str("content", string(payloadBytes)).Msg("creating nostr response")
 
-	msg, err := nip04.Encrypt(string(payloadBytes), ss)
+	msg, err := cipher.Encrypt(string(payloadBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -277,83 +486,140 @@ func notImplemented() (*Nip47Response, *Nip47Error) {
 }
 
 func ExecuteRequest(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent) (*ResponseEvent, error) {
-	var backend Backend
+	if user.Backend == nil {
+		return nil, fmt.Errorf("no backend for user: %s", user.Name)
+	}
+
+	// running requests are resolved by RecoverRequests
+	if request.Status != REQUEST_EVENT_STATUS_RECEIVED {
+		p.Logger.Warn().Str("status", request.Status).Msg("must have 'received' status, ignoring")
+		return nil, nil
+	}
+
+	cipher, err := request.GetCipher(p)
 
-	switch user.Kind {
-	case "phoenix":
-		backend = &PhoenixBackend{
-			Host: user.Host,
-			Key: user.Key,
+	if err != nil {
+		// without a cipher there can't be a response, the request is
+		// done so that it's not loaded with the backlog again
+		p.Logger.Warn().Err(err).Str("request_nostr_id", request.NostrId).Msg("unable to respond to request")
+
+		if err := db.Table("request_events").Where("id = ?", request.ID).Update("status", REQUEST_EVENT_STATUS_DONE).Error; err != nil {
+			return nil, err
 		}
-	default:
-		return nil, fmt.Errorf("unsupported backend: %s", user.Kind)
+
+		return nil, nil
 	}
 
-	ss, err := nip04.ComputeSharedSecret(user.NWCPubKey, p.PrivateKey)
+	nip47Request, err := request.GetNip47Request(p, cipher)
 
 	if err != nil {
-		return nil, err
+		p.Logger.Warn().Err(err).Str("request_nostr_id", request.NostrId).Msg("unable to decrypt or decode request")
+
+		return CommitNip47Response(db, p, user, request, cipher, nil, &Nip47Error{
+			Code: NIP47_ERROR_OTHER,
+			Message: "Unable to decrypt or decode the request",
+		})
 	}
 
-	nip47Request, err := request.GetNip47Request(p, user)
+	err = db.Table("request_events").Where("id = ?", request.ID).Update("status", REQUEST_EVENT_STATUS_RUNNING).Error
 
 	if err != nil {
 		return nil, err
 	}
 
-	if request.Status == REQUEST_EVENT_STATUS_RUNNING {
-		// TODO handle this exception
+	var nip47Resp *Nip47Response
+	var nip47Err *Nip47Error
+
+	// the connection may have been revoked since the request was received
+	connection, err := GetActiveConnection(db, user.Name, request.PubKey)
+
+	if err != nil && !errors.Is(err, ErrConnectionNotFound) {
+		return nil, err
 	}
 
-	if request.Status != REQUEST_EVENT_STATUS_RECEIVED {
-		p.Logger.Warn().Str("status", request.Status).Msg("must have 'received' status, ignoring")
-		return nil, nil
+	if connection != nil {
+		user = user.WithConnection(connection)
 	}
 
-	err = db.Table("request_events").Where("id = ?", request.ID).Update("status", REQUEST_EVENT_STATUS_RUNNING).Error
+	evt, err := request.GetEvent()
 
 	if err != nil {
 		return nil, err
 	}
 
-	var nip47Resp *Nip47Response
-	var nip47Err *Nip47Error
+	if connection == nil {
+		nip47Err = &Nip47Error{
+			Code: NIP47_ERROR_UNAUTHORIZED,
+			Message: "The connection has been revoked or has expired",
+		}
+	} else if nip47Err = CheckRequestAge(p, evt, request.ExpiresAt, time.Now()); nip47Err != nil {
+		p.Logger.Warn().Str("request_nostr_id", request.NostrId).Msg("not executing stale request")
+	} else if !user.Policy.Allows(nip47Request.Method) {
+		nip47Err = &Nip47Error{
+			Code: NIP47_ERROR_RESTRICTED,
+			Message: "This connection is not allowed to use this method",
+		}
+	} else {
+		switch nip47Request.Method {
+		case NIP47_PAY_INVOICE_METHOD:
+			nip47Resp, nip47Err = HandlePayInvoice(ctx, p, user, *nip47Request, request.NostrId)
+		case NIP47_GET_BALANCE_METHOD:
+			nip47Resp, nip47Err = HandleGetBalance(ctx, p, user, *nip47Request)
+		case NIP47_MAKE_INVOICE_METHOD:
+			nip47Resp, nip47Err = HandleMakeInvoice(ctx, p, user, *nip47Request)
+		case NIP47_LOOKUP_INVOICE_METHOD:
+			nip47Resp, nip47Err = HandleLookupInvoice(ctx, p, user, *nip47Request)
+		case NIP47_LIST_TRANSACTIONS_METHOD:
+			nip47Resp, nip47Err = HandleListTransactions(ctx, p, user, *nip47Request)
+		case NIP47_GET_INFO_METHOD:
+			nip47Resp, nip47Err = HandleGetInfo(ctx, p, user, *nip47Request)
+		case NIP47_GET_BUDGET_METHOD:
+			nip47Resp, nip47Err = HandleGetBudget(ctx, p, user, *nip47Request)
+		case NIP47_PAY_KEYSEND_METHOD:
+			nip47Resp, nip47Err = HandlePayKeysend(ctx, p, user, *nip47Request, request.NostrId)
+		case NIP47_MULTI_PAY_INVOICE_METHOD:
+			// answered with a response per item
+			return HandleMultiPayInvoice(ctx, db, p, user, request, cipher, *nip47Request)
+		case NIP47_MULTI_PAY_KEYSEND_METHOD:
+			// answered with a response per item
+			return HandleMultiPayKeysend(ctx, db, p, user, request, cipher, *nip47Request)
+		default:
+			nip47Resp, nip47Err = notImplemented()
+		}
+	}
+
+	if nip47Resp == nil && nip47Err == nil {
+		p.Logger.Info().Str("request_nostr_id", request.NostrId).Msg("request left running")
+		return nil, nil
+	}
 
-	switch nip47Request.Method {
-	case NIP47_PAY_INVOICE_METHOD:
-		nip47Resp, nip47Err = backend.HandlePayInvoice(ctx, *nip47Request)
-	case NIP47_MULTI_PAY_INVOICE_METHOD:
-		nip47Resp, nip47Err = notImplemented()
-	case NIP47_MULTI_PAY_KEYSEND_METHOD:
-		nip47Resp, nip47Err = notImplemented()
-	case NIP47_PAY_KEYSEND_METHOD:
-		nip47Resp, nip47Err = notImplemented()
-	case NIP47_GET_BALANCE_METHOD:
-		nip47Resp, nip47Err = backend.HandleGetBalance(ctx, *nip47Request)
-	case NIP47_MAKE_INVOICE_METHOD:
-		nip47Resp, nip47Err = backend.HandleMakeInvoice(ctx, *nip47Request)
-	case NIP47_LOOKUP_INVOICE_METHOD:
-		nip47Resp, nip47Err = backend.HandleLookupInvoice(ctx, *nip47Request)
-	case NIP47_LIST_TRANSACTIONS_METHOD:
-		nip47Resp, nip47Err = backend.HandleListTransactions(ctx, *nip47Request)
-	case NIP47_GET_INFO_METHOD:
-		nip47Resp, nip47Err = backend.HandleGetInfo(ctx, *nip47Request)
-	case NIP47_SIGN_MESSAGE_METHOD:
-		nip47Resp, nip47Err = notImplemented()
-	default:
-		nip47Resp, nip47Err = backend.HandleUnknownMethod(ctx, *nip47Request)
+	return CommitNip47Response(db, p, user, request, cipher, nip47Resp, nip47Err)
+}
+
+// CommitNip47Response creates the response event of the request with
+// either the result or the error, and saves it for publishing.
+func CommitNip47Response(db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent, cipher Cipher, nip47Resp *Nip47Response, nip47Err *Nip47Error) (*ResponseEvent, error) {
+	nostrResp, err := createNip47Response(p, request, cipher, nil, nip47Resp, nip47Err)
+
+	if err != nil {
+		return nil, err
 	}
 
+	return CommitResponseEvent(db, p, user, nostrResp, request.NostrId)
+}
+
+func createNip47Response(p *NWCParams, request *RequestEvent, cipher Cipher, tags nostr.Tags, nip47Resp *Nip47Response, nip47Err *Nip47Error) (*nostr.Event, error) {
 	var nostrResp *nostr.Event
+	var err error
 
 	if nip47Err != nil {
-		p.Logger.Warn().Str("method", nip47Request.Method).Str("code", nip47Err.Code).Str("message", nip47Err.Message).Msg("created nip47 error")
+		p.Logger.Warn().Str("request_nostr_id", request.NostrId).Str("code", nip47Err.Code).Str("message", nip47Err.Message).Msg("created nip47 error")
 		nostrResp, err = CreateNostrResponse(p, request.PubKey, request.NostrId, Nip47Response{
 			Error: nip47Err,
-		}, nil, ss)
+		}, tags, cipher)
 	} else {
 		p.Logger.Info().Str("result_type", nip47Resp.ResultType).Msg("created nip47 response")
-		nostrResp, err = CreateNostrResponse(p, request.PubKey, request.NostrId, nip47Resp, nil, ss)
+		nostrResp, err = CreateNostrResponse(p, request.PubKey, request.NostrId, nip47Resp, tags, cipher)
 	}
 
 	if err != nil {
@@ -361,7 +627,7 @@ func ExecuteRequest(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUse
 		return nil, err
 	}
 
-	return CommitResponseEvent(db, p, user, nostrResp, request.NostrId)
+	return nostrResp, nil
 }
 
 func HandleEvent(db *gorm.DB, p *NWCParams, user *NWCUser, event *nostr.Event) (*RequestEvent, *Nip47Error) {
@@ -376,12 +642,39 @@ func HandleEvent(db *gorm.DB, p *NWCParams, user *NWCUser, event *nostr.Event) (
 		return nil, nil
 	}
 
-	if user.NWCPubKey != event.PubKey {
-		p.Logger.Warn().Str("pubkey", user.NWCPubKey).Msg("ignoring event, does not match pubkey")
+	connection, err := GetActiveConnection(db, user.Name, event.PubKey)
+
+	if errors.Is(err, ErrConnectionNotFound) {
+		p.Logger.Warn().Str("pubkey", event.PubKey).Msg("ignoring event, no active connection for pubkey")
 		return nil, &Nip47Error{
 			Code: NIP47_ERROR_UNAUTHORIZED,
 			Message: "The public key is not authorized",
 		}
+	} else if err != nil {
+		p.Logger.Warn().Err(err).Str("pubkey", event.PubKey).Msg("could not get connection")
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_INTERNAL,
+			Message: "Internal error",
+		}
+	}
+
+	if err := touchConnection(db, connection); err != nil {
+		p.Logger.Warn().Err(err).Str("connection", connection.Name).Msg("could not update connection")
+	}
+
+	if encryption := EventEncryption(event); !SupportedEncryption(encryption) {
+		p.Logger.Warn().Str("encryption", encryption).Msg("ignoring event, unsupported encryption")
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_UNSUPPORTED_ENCRYPTION,
+			Message: "Unsupported encryption, supported are: "+NIP47_ENCRYPTION_SCHEMES,
+		}
+	}
+
+	expiresAt := EventExpiration(event)
+
+	if nip47err := CheckRequestAge(p, event, expiresAt, time.Now()); nip47err != nil {
+		p.Logger.Warn().Str("event_id", event.ID).Str("message", nip47err.Message).Msg("ignoring event, stale request")
+		return nil, nip47err
 	}
 
 	revent := RequestEvent {
@@ -390,6 +683,7 @@ func HandleEvent(db *gorm.DB, p *NWCParams, user *NWCUser, event *nostr.Event) (
 		User: user.Name,
 		Raw: event.String(),
 		Status: REQUEST_EVENT_STATUS_RECEIVED,
+		ExpiresAt: expiresAt,
 	}
 
 	if err := db.Table("request_events").Create(&revent).Error; err != nil {
@@ -417,11 +711,10 @@ func GetNip47Info(ctx context.Context, p *NWCParams, relay *nostr.Relay) (*nostr
 	}}
 
 	sub, err := relay.Subscribe(sctx, filters)
-	defer sub.Unsub()
-
 	if err != nil {
 		return nil, err
 	}
+	defer sub.Unsub()
 
 	var event nostr.Event
 
@@ -432,7 +725,9 @@ func GetNip47Info(ctx context.Context, p *NWCParams, relay *nostr.Relay) (*nostr
 	return &event, nil
 }
 
-func PublishResponseEvent(ctx context.Context, p *NWCParams, db *gorm.DB, relay *nostr.Relay, resp *ResponseEvent) error {
+// PublishResponseEvent publishes the response to the relays, it's done
+// once any relay accepts it and is retried with the backlog otherwise.
+func PublishResponseEvent(ctx context.Context, p *NWCParams, db *gorm.DB, relays *Relays, urls []string, resp *ResponseEvent) error {
 	if resp.Status != RESPONSE_EVENT_STATUS_CREATED {
 		p.Logger.Warn().Str("status", resp.Status).Msg("must have 'created' status, ignoring")
 		return nil
@@ -445,39 +740,20 @@ func PublishResponseEvent(ctx context.Context, p *NWCParams, db *gorm.DB, relay
 		return err
 	}
 
-	err = db.Table("response_events").Where("id = ?", resp.ID).Update("status", RESPONSE_EVENT_STATUS_SENDING).Error
-	if err != nil {
-		return err
-	}
-
-	if !relay.IsConnected() {
-		interval := 3 * time.Second
-
-		for {
-			p.Logger.Warn().Str("relay_url", relay.URL).Msg("relay is disconnected, attempting to reconnect")
-
-			r := nostr.NewRelay(context.Background(), relay.URL)
-
-			p.Logger.Info().Str("relay_url", relay.URL).Msg("connecting...")
-
-			err := r.Connect(ctx)
-
-			if err != nil {
-				p.Logger.Warn().Err(err).Int("interval", int(interval)).Msg("unable to connect")
-			} else {
-				p.Logger.Info().Str("relay_url", relay.URL).Msg("connected")
-				*relay = *r
-				break
-			}
+	// it may have been published with the backlog since
+	result := db.Table("response_events").
+		Where("id = ?", resp.ID).
+		Where("status = ?", RESPONSE_EVENT_STATUS_CREATED).
+		Update("status", RESPONSE_EVENT_STATUS_SENDING)
 
-			time.Sleep(interval)
-			interval = interval * 17 / 10
-		}
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
 	}
 
-	err = relay.Publish(ctx, event)
+	err = relays.Publish(ctx, urls, event)
 
 	if err != nil {
+		db.Table("response_events").Where("id = ?", resp.ID).Update("status", RESPONSE_EVENT_STATUS_CREATED)
 		return err
 	}
 
@@ -489,118 +765,181 @@ func PublishResponseEvent(ctx context.Context, p *NWCParams, db *gorm.DB, relay
 	return nil
 }
 
-func PublishNip47Info(ctx context.Context, p *NWCParams, relay *nostr.Relay) {
+// InfoIsCurrent checks whether the published info event has the current
+// capabilities, notification types and encryption schemes.
+func InfoIsCurrent(p *NWCParams, info *nostr.Event) bool {
+	if info.Content != strings.Join(Capabilities(p.Users), " ") {
+		return false
+	}
+
+	notifications := info.Tags.GetFirst([]string{"notifications"})
+	if notifications == nil || notifications.Value() != NIP47_NOTIFICATION_TYPES {
+		return false
+	}
+
+	encryption := info.Tags.GetFirst([]string{"encryption"})
+
+	return encryption != nil && encryption.Value() == NIP47_ENCRYPTION_SCHEMES
+}
+
+func PublishNip47Info(ctx context.Context, p *NWCParams, relay *nostr.Relay) error {
 	ev := &nostr.Event{}
 	ev.Kind = NIP47_INFO_KIND
-	ev.Content = NIP47_CAPABILITIES
+	ev.Content = strings.Join(Capabilities(p.Users), " ")
 	ev.CreatedAt = nostr.Now()
 	ev.PubKey = p.PublicKey
-	ev.Tags = nostr.Tags{[]string{"notifications", NIP47_NOTIFICATION_TYPES}}
+	ev.Tags = nostr.Tags{
+		[]string{"notifications", NIP47_NOTIFICATION_TYPES},
+		[]string{"encryption", NIP47_ENCRYPTION_SCHEMES},
+	}
 	err := ev.Sign(p.PrivateKey)
 
 	if err != nil {
-		p.Logger.Fatal().Err(err).Msg("could not sign")
-		return
+		return err
 	}
 
-	err = relay.Publish(ctx, *ev)
+	err = PublishWithAuth(ctx, relay, p.PrivateKey, *ev)
 
 	if err != nil {
-		p.Logger.Fatal().Err(err).Msg("nostr publish error")
-		return
+		return err
 	}
 
-	p.Logger.Info().Str("event_id", ev.ID).Msg("published info event")
+	p.Logger.Info().Str("relay_url", relay.URL).Str("event_id", ev.ID).Msg("published info event")
+
+	return nil
 }
 
-func StartListener(ctx context.Context, db *gorm.DB, p *NWCParams, user NWCUser, pool *nostr.SimplePool, requests chan<- RequestEvent, responses chan<- ResponseEvent) {
+// StartListener subscribes to requests from the active connections of
+// the user on all of their relays, and subscribes again once connections
+// are created, revoked or expire. The pool reconnects to relays that go
+// down, and authenticates with relays that close the subscription until
+// it does.
+func StartListener(ctx context.Context, db *gorm.DB, p *NWCParams, user NWCUser, relays *Relays, requests chan<- RequestEvent, responses chan<- ResponseEvent) {
 	p.Logger.Info().Str("user", user.Name).Msg("start event worker")
 
-	filters := []nostr.Filter{{
-		Kinds:   []int{NIP47_REQUEST_KIND},
-		Authors: []string{user.NWCPubKey},
-		Limit:   1000,
-	}}
-
-	events := pool.SubMany(ctx, []string{user.Relay}, filters)
-
-	var incoming nostr.IncomingEvent
+	ticker := time.NewTicker(ConnectionRefreshInterval)
+	defer ticker.Stop()
 
 	for {
+		pubkeys, err := ActivePubKeys(db, user.Name)
+		if err != nil {
+			p.Logger.Warn().Err(err).Str("user", user.Name).Msg("unable to get connections")
+		}
 
-		p.Logger.Info().Str("user", user.Name).Msg("waiting for events")
-
-		incoming = <- events
-
-		evt := incoming.Event
+		urls, err := ActiveRelays(db, &user)
+		if err != nil {
+			p.Logger.Warn().Err(err).Str("user", user.Name).Msg("unable to get relays")
+		}
 
-		if evt == nil {
-			break
+		if len(pubkeys) == 0 || len(urls) == 0 {
+			// an empty filter would match every author
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				continue
+			}
 		}
 
-		revent, nip47err := HandleEvent(db, p, &user, evt)
+		p.Logger.Info().Str("user", user.Name).Strs("pubkeys", pubkeys).Strs("relays", urls).Msg("filtering for requests from pubkeys")
 
-		if revent != nil && nip47err == nil {
+		// older requests would only be rejected as stale
+		since := nostr.Timestamp(time.Now().Add(-p.maxRequestAge()).Unix())
 
-			requests <- *revent
+		filters := []nostr.Filter{{
+			Kinds:   []int{NIP47_REQUEST_KIND},
+			Authors: pubkeys,
+			Since:   &since,
+			Limit:   1000,
+		}}
 
-		} else if (nip47err != nil) {
-			ss, err := nip04.ComputeSharedSecret(evt.PubKey, p.PrivateKey)
+		for _, url := range urls {
+			if RequiresAuth(p.AuthRelays, url) {
+				// some relays ignore requests until authenticated
+				// instead of closing them
+				relays.Relay(ctx, url)
+			}
+		}
 
-			if ss != nil {
-				response, err := CreateNostrResponse(p, evt.PubKey, evt.ID, Nip47Response{
-					Error: nip47err,
-				}, nil, ss)
+		sctx, cancel := context.WithCancel(ctx)
 
-				if response != nil {
-					rsp, _ := CommitResponseEvent(db, p, &user, response, evt.ID)
-					if rsp != nil {
-						responses <- *rsp
-					}
-				} else if err != nil {
-					p.Logger.Warn().Err(err).Msg("unable to create nostr response")
+		events := relays.pool.SubMany(sctx, urls, filters)
 
+	listen:
+		for {
+			p.Logger.Info().Str("user", user.Name).Msg("waiting for events")
+
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case <-ticker.C:
+				current, err := ActivePubKeys(db, user.Name)
+				if err == nil && !slices.Equal(current, pubkeys) {
+					p.Logger.Info().Str("user", user.Name).Msg("connections changed")
+					break listen
 				}
-			} else if err != nil {
-				p.Logger.Warn().Err(err).Msg("unable to compute shared secret")
+
+				currentUrls, err := ActiveRelays(db, &user)
+				if err == nil && !slices.Equal(currentUrls, urls) {
+					p.Logger.Info().Str("user", user.Name).Msg("relays changed")
+					break listen
+				}
+			case incoming, ok := <-events:
+				if !ok || incoming.Event == nil {
+					break listen
+				}
+
+				handleRequestEvent(ctx, db, p, &user, incoming.Event, requests, responses)
 			}
 		}
 
-		p.Logger.Info().Str("user", user.Name).Str("event_id", evt.ID).Msg("finished event")
+		cancel()
 	}
 }
 
-func ExecuteRequestBacklog(ctx context.Context, db *gorm.DB, p *NWCParams, user NWCUser, responses chan<- ResponseEvent) {
-	var requests []RequestEvent
+// handleRequestEvent saves the request for the executer, or responds
+// with an error right away.
+func handleRequestEvent(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, evt *nostr.Event, requests chan<- RequestEvent, responses chan<- ResponseEvent) {
+	revent, nip47err := HandleEvent(db, p, user, evt)
 
-	result := db.Table("request_events").Where("user = ?", user.Name).Where("status = ?", REQUEST_EVENT_STATUS_RECEIVED).Find(&requests)
+	if revent != nil && nip47err == nil {
 
-	if result.RowsAffected == 0 {
-		return
-	}
+		select {
+		case requests <- *revent:
+		case <-ctx.Done():
+			// executed with the backlog after a restart
+		}
 
-	for _, request := range requests {
-		p.Logger.Info().Str("request_nostr_id", request.NostrId).Msg("request backlog")
+	} else if (nip47err != nil) {
+		cipher, err := EventCipher(p, evt)
 
-		response, err := ExecuteRequest(ctx, db, p, &user, &request)
+		if cipher != nil {
+			response, err := CreateNostrResponse(p, evt.PubKey, evt.ID, Nip47Response{
+				Error: nip47err,
+			}, nil, cipher)
 
-		if err != nil {
-			p.Logger.Warn().Err(err).Msg("unable to execute backlog")
-		} else {
-			responses <- *response
+			if response != nil {
+				rsp, _ := CommitResponseEvent(db, p, user, response, evt.ID)
+				if rsp != nil {
+					select {
+					case responses <- *rsp:
+					case <-ctx.Done():
+					}
+				}
+			} else if err != nil {
+				p.Logger.Warn().Err(err).Msg("unable to create nostr response")
+
+			}
+		} else if err != nil {
+			p.Logger.Warn().Err(err).Msg("unable to create cipher")
 		}
 	}
-}
-
-func StartExecuter(ctx context.Context, db *gorm.DB, p *NWCParams, user NWCUser, requests <-chan RequestEvent, responses chan<- ResponseEvent) {
-	for {
-		ExecuteRequestBacklog(ctx, db, p, user, responses)
 
-		_ = <-requests
-	}
+	p.Logger.Info().Str("user", user.Name).Str("event_id", evt.ID).Msg("finished event")
 }
 
-func PublishResponseBacklog(ctx context.Context, db *gorm.DB, p *NWCParams, relay *nostr.Relay, user NWCUser) {
+func PublishResponseBacklog(ctx context.Context, db *gorm.DB, p *NWCParams, relays *Relays, urls []string, user NWCUser) {
 	var responses []ResponseEvent
 
 	result := db.Table("response_events").Where("user = ?", user.Name).Where("status = ?", RESPONSE_EVENT_STATUS_CREATED).Find(&responses)
@@ -612,7 +951,7 @@ func PublishResponseBacklog(ctx context.Context, db *gorm.DB, p *NWCParams, rela
 	for _, response := range responses {
 		p.Logger.Info().Str("response_nostr_id", response.NostrId).Msg("response backlog")
 
-		err := PublishResponseEvent(ctx, p, db, relay, &response)
+		err := PublishResponseEvent(ctx, p, db, relays, urls, &response)
 
 		if err != nil {
 			p.Logger.Warn().Err(err).Msg("unable to publish backlog")
@@ -620,19 +959,61 @@ func PublishResponseBacklog(ctx context.Context, db *gorm.DB, p *NWCParams, rela
 	}
 }
 
-func StartPublisher(ctx context.Context, db *gorm.DB, p *NWCParams, relay *nostr.Relay, user NWCUser, responses <-chan ResponseEvent) {
+// StartPublisher publishes responses and notifications to the relays of
+// the user as they are created. Those that no relay accepted are retried
+// with the backlog on the next tick, along with the info event of relays
+// that were down.
+func StartPublisher(ctx context.Context, db *gorm.DB, p *NWCParams, relays *Relays, user NWCUser, responses <-chan ResponseEvent, notifications <-chan NotificationEvent) {
+	ticker := time.NewTicker(NotificationRetryInterval)
+	defer ticker.Stop()
 
-	for {
-		PublishResponseBacklog(ctx, db, p, relay, user)
+	activeRelays := func() []string {
+		urls, err := ActiveRelays(db, &user)
+		if err != nil {
+			p.Logger.Warn().Err(err).Str("user", user.Name).Msg("unable to get relays")
+		}
 
-		_ = <-responses
+		return urls
+	}
+
+	publishBacklog := func() {
+		urls := activeRelays()
+
+		if len(urls) > 0 {
+			relays.PublishInfo(ctx, urls)
+			PublishResponseBacklog(ctx, db, p, relays, urls, user)
+			PublishNotificationBacklog(ctx, db, p, relays, urls, user)
+		}
+	}
+
+	publishBacklog()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case response := <-responses:
+			err := PublishResponseEvent(ctx, p, db, relays, activeRelays(), &response)
+			if err != nil {
+				p.Logger.Warn().Err(err).Str("response_nostr_id", response.NostrId).Msg("unable to publish response")
+			}
+		case notification := <-notifications:
+			err := PublishNotificationEvent(ctx, p, db, relays, activeRelays(), &notification)
+			if err != nil {
+				p.Logger.Warn().Err(err).Str("notification_nostr_id", notification.NostrId).Msg("unable to publish notification")
+			}
+		case <-ticker.C:
+			publishBacklog()
+		}
 	}
 }
 
+// Start runs the workers of the users until the context is done, it
+// returns once the requests being executed are finished.
 func Start(ctx context.Context, p *NWCParams) {
 	p.Logger.Info().Str("dbpath", p.DBPath).Msg("using database file")
 
-	db, err := gorm.Open(sqlite.Open(p.DBPath), &gorm.Config{})
+	db, err := OpenDB(p.DBPath)
 
 	//defer db.Close()
 
@@ -640,48 +1021,69 @@ func Start(ctx context.Context, p *NWCParams) {
 		p.Logger.Fatal().Err(err).Msg("error loading database")
 	}
 
-	InitDB(db, p)
+	p.notifier = NewNotifier(db, p)
+	p.ledger = NewLedger(db)
+	p.transactions = NewTransactions(db)
 
-	pool := nostr.NewSimplePool(ctx)
-
-	for _, user := range p.Users {
+	for i := range p.Users {
+		if err := ImportConfigConnection(db, &p.Users[i]); err != nil {
+			p.Logger.Fatal().Err(err).Str("user", p.Users[i].Name).Msg("could not import connection")
+		}
 
-		if user.Relay == "" {
-			continue
+		if p.Users[i].Backend != nil {
+			if err := p.transactions.Import(ctx, &p.Users[i]); err != nil {
+				p.Logger.Warn().Err(err).Str("user", p.Users[i].Name).Msg("could not import transactions")
+			}
 		}
+	}
 
-		responses := make(chan ResponseEvent)
-		requests := make(chan RequestEvent)
+	// users without relays in the config may have connections with
+	// relays made with the cli, the relays are those of the connections
+	for _, user := range p.Users {
+		p.notifier.Channel(user.Name)
+	}
 
-		relay, err := nostr.RelayConnect(ctx, user.Relay)
+	if p.Settler != nil {
+		p.Settler.OnSettled(func(user string, settlement Settlement) {
+			p.notifier.NotifySettlement(ctx, user, settlement)
+		})
+	}
 
-		if err != nil {
-			p.Logger.Fatal().Err(err).Str("relay", user.Relay).Msg("could not connect")
-		}
+	relays := NewRelays(ctx, p)
 
-		info, err := GetNip47Info(ctx, p, relay)
-		if err != nil {
-			p.Logger.Warn().Err(err).Msg("could not get nwc info from relay")
-		}
+	var wg sync.WaitGroup
 
-		if info != nil {
-			if info.Content != NIP47_CAPABILITIES {
-				PublishNip47Info(ctx, p, relay)
-			} else {
-				p.Logger.Info().Str("info", info.ID).Msg("received info from relay")
-			}
-		} else {
-			PublishNip47Info(ctx, p, relay)
+	for _, user := range p.Users {
+		if user.Backend == nil {
+			continue
 		}
 
-		p.Logger.Info().Str("pubkey", user.NWCPubKey).Msg("filtering for requests from pubkey")
+		// buffered for bursts of requests
+		responses := make(chan ResponseEvent, 100)
+		requests := make(chan RequestEvent, 100)
 
-		go StartListener(ctx, db, p, user, pool, requests, responses)
+		wg.Add(3)
 
-		go StartExecuter(ctx, db, p, user, requests, responses)
+		go func(user NWCUser) {
+			defer wg.Done()
+			StartListener(ctx, db, p, user, relays, requests, responses)
+		}(user)
 
-		go StartPublisher(ctx, db, p, relay, user, responses)
+		go func(user NWCUser) {
+			defer wg.Done()
+			StartExecuter(ctx, db, p, user, requests, responses)
+		}(user)
+
+		go func(user NWCUser) {
+			defer wg.Done()
+			StartPublisher(ctx, db, p, relays, user, responses, p.notifier.Channel(user.Name))
+		}(user)
 	}
 
 	<-ctx.Done()
+
+	// executing requests are finished before returning
+	wg.Wait()
+
+	p.Logger.Info().Msg("nwc stopped")
 }
@@ -0,0 +1,150 @@
+package nwc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// newTestDB opens a database of the test's temporary directory.
+func newTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	db, err := OpenDB(filepath.Join(t.TempDir(), "nwc.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return db
+}
+
+// newTestParams returns the params of a server with a new key, with the
+// ledger, transactions and notifier of the database.
+func newTestParams(t testing.TB, db *gorm.DB, users ...NWCUser) *NWCParams {
+	t.Helper()
+
+	logger := zerolog.Nop()
+
+	sk := nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &NWCParams{
+		PrivateKey: sk,
+		PublicKey: pk,
+		Users: users,
+		Logger: &logger,
+	}
+
+	p.notifier = NewNotifier(db, p)
+	p.ledger = NewLedger(db)
+	p.transactions = NewTransactions(db)
+
+	return p
+}
+
+// newTestInvoice returns a signed invoice of the amount and its payment
+// hash, for a random preimage.
+func newTestInvoice(t testing.TB, msat uint64, description string) (string, string) {
+	t.Helper()
+
+	preimage, hash, err := keysendPreimage("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newTestInvoiceWith(t, msat, preimage, description), hex.EncodeToString(hash)
+}
+
+// newTestInvoiceWith returns a signed invoice of the amount for the
+// preimage.
+func newTestInvoiceWith(t testing.TB, msat uint64, preimage []byte, description string) string {
+	t.Helper()
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paymentAddr [32]byte
+	if _, err := rand.Read(paymentAddr[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	options := []func(*zpay32.Invoice){
+		zpay32.Description(description),
+		zpay32.PaymentAddr(paymentAddr),
+		zpay32.Expiry(time.Hour),
+	}
+
+	if msat > 0 {
+		options = append(options, zpay32.Amount(lnwire.MilliSatoshi(msat)))
+	}
+
+	invoice, err := zpay32.NewInvoice(&chaincfg.MainNetParams, sha256.Sum256(preimage), time.Now(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bolt11, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return ecdsa.SignCompact(key, chainhash.HashB(msg), true)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bolt11
+}
+
+func TestCapabilities(t *testing.T) {
+	// the relays of jane are only of her connections
+	users := []NWCUser{
+		{Name: "jane", Backend: newFakeBackend()},
+		{Name: "john", Backend: newFakeBackend(), Relays: []string{"wss://relay.example.com"}},
+		{Name: "joe"},
+	}
+
+	methods := strings.Join(Capabilities(users), " ")
+	if methods != "pay_invoice pay_keysend lookup_invoice get_budget" {
+		t.Fatalf("methods %q", methods)
+	}
+}
+
+func TestConnectURI(t *testing.T) {
+	c := &Connection{Secret: "ab", Relays: "wss://relay.example.com", Budget: 21000, BudgetRenewal: BUDGET_RENEWAL_DAILY}
+
+	u, err := url.Parse(c.ConnectURI("cd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// in sats, as given to the cli
+	if q := u.Query(); q.Get("max_amount") != "21" || q.Get("budget_renewal") != BUDGET_RENEWAL_DAILY || q.Get("relay") != "wss://relay.example.com" {
+		t.Fatalf("query %v", q)
+	}
+}
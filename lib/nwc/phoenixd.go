@@ -2,16 +2,21 @@ package nwc
 
 import (
 	"context"
+	"crypto/sha256"
 	"net/url"
 	"net/http"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"fmt"
 	"strings"
-	"sort"
+	"time"
 
+	"github.com/gorilla/websocket"
 	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
 )
 
 type PhoenixBalanceResult struct {
@@ -26,6 +31,7 @@ type PhoenixPayInvoiceResult struct {
 	PaymentPreimage string `json:"paymentPreimage"`
 	PaymentHash string `json:"paymentHash"`
 	UUID string `json:"uuid"`
+	Reason string `json:"reason"` // of failed payments
 }
 
 type PhoenixLookupInvoiceResult struct {
@@ -70,25 +76,28 @@ type PhoenixGetInfoResult struct {
 	Version string `json:"version"`
 }
 
-type Backend interface {
-	HandlePayInvoice(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-	HandleGetBalance(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-	HandleMakeInvoice(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-	HandleLookupInvoice(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-	HandleListTransactions(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-	HandleGetInfo(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-	HandleUnknownMethod(context.Context, Nip47Request) (*Nip47Response, *Nip47Error)
-}
-
 type PhoenixBackend struct {
 	Host string
 	Key string
 }
 
-func (b *PhoenixBackend) payInvoice(invoice string) (*PhoenixPayInvoiceResult, error) {
+func init() {
+	RegisterBackend("phoenix", func(c BackendConfig) Backend {
+		return &PhoenixBackend{
+			Host: c.Host,
+			Key: c.Key,
+		}
+	})
+}
+
+func (b *PhoenixBackend) payInvoice(invoice string, amount uint64) (*PhoenixPayInvoiceResult, error) {
 	payload := url.Values{}
 	payload.Set("invoice", invoice)
 
+	if amount > 0 {
+		payload.Set("amountSat", fmt.Sprintf("%d", amount/1000))
+	}
+
 	client := &http.Client{}
 	req, err := http.NewRequest(
 		"POST",
@@ -121,7 +130,7 @@ func (b *PhoenixBackend) payInvoice(invoice string) (*PhoenixPayInvoiceResult, e
 		if len(text) > 300 {
 			text = text[:300]
 		}
-		return nil, fmt.Errorf("call to phoenix failed (%d): %s", res.StatusCode, text)
+		return nil, phoenixPaymentError(&HTTPError{Backend: "phoenix", StatusCode: res.StatusCode, Body: text})
 	}
 
 	body, err := io.ReadAll(res.Body)
@@ -137,9 +146,39 @@ func (b *PhoenixBackend) payInvoice(invoice string) (*PhoenixPayInvoiceResult, e
 		return nil, err
 	}
 
+	if result.PaymentPreimage == "" {
+		if result.Reason == "" {
+			return nil, errors.New("phoenix payment without preimage")
+		}
+
+		// phoenixd answers payments that failed with the reason
+		if strings.Contains(result.Reason, "not enough funds") {
+			return nil, fmt.Errorf("%w: %s", ErrInsufficientBalance, result.Reason)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrPaymentFailed, result.Reason)
+	}
+
 	return &result, nil
 }
 
+// phoenixPaymentError maps the errors phoenixd rejects a payment with to
+// ErrPaymentFailed. Anything else, such as a timeout, leaves the payment
+// unknown as it may still be made.
+func phoenixPaymentError(err error) error {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+
+	switch httpErr.StatusCode {
+	case 400, 401, 403:
+		// rejected invoices and amounts, and a rejected key
+		return fmt.Errorf("%w: %s", ErrPaymentFailed, err)
+	}
+
+	return err
+}
+
 func (b *PhoenixBackend) getBalance() (uint64, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest(
@@ -188,21 +227,6 @@ func (b *PhoenixBackend) getBalance() (uint64, error) {
 	return result.BalanceSat, nil
 }
 
-func (b *PhoenixBackend) lookupInvoice(paymentHash string) (*PhoenixLookupInvoiceResult, error) {
-    // Try to find the invoice in incoming payments first
-    result, err := b.lookupIncomingInvoice(paymentHash)
-    if err != nil {
-        if result == nil && err.Error() == "not found" {
-            return b.lookupOutgoingInvoice(paymentHash)
-        }
-        return nil, err
-    } else if result != nil {
-        return result, nil
-    }
-
-    return nil, fmt.Errorf("unexpected error in lookupInvoice")
-}
-
 func (b *PhoenixBackend) lookupIncomingInvoice(paymentHash string) (*PhoenixLookupInvoiceResult, error) {
     url := "http://" + b.Host + "/payments/incoming/" + paymentHash
     req, err := http.NewRequest("GET", url, nil)
@@ -221,7 +245,7 @@ func (b *PhoenixBackend) lookupIncomingInvoice(paymentHash string) (*PhoenixLook
     defer res.Body.Close()
 
     if res.StatusCode == 404 {
-        return nil, fmt.Errorf("not found")
+        return nil, ErrNotFound
     } else if res.StatusCode >= 400 {
         body, _ := io.ReadAll(res.Body)
         return nil, fmt.Errorf("HTTP error %d: %s", res.StatusCode, string(body))
@@ -235,9 +259,12 @@ func (b *PhoenixBackend) lookupIncomingInvoice(paymentHash string) (*PhoenixLook
     return &result, nil
 }
 
+// lookupOutgoingInvoice looks up the latest outgoing payment of the
+// payment hash, it's ErrNotFound only when phoenixd has no payment of
+// the hash.
 func (b *PhoenixBackend) lookupOutgoingInvoice(paymentHash string) (*PhoenixLookupInvoiceResult, error) {
-    client := &http.Client{}
-    req, err := http.NewRequest("GET", "http://"+b.Host+"/payments/outgoing", nil)
+    url := "http://" + b.Host + "/payments/outgoingbyhash/" + paymentHash
+    req, err := http.NewRequest("GET", url, nil)
     if err != nil {
         return nil, err
     }
@@ -245,53 +272,43 @@ func (b *PhoenixBackend) lookupOutgoingInvoice(paymentHash string) (*PhoenixLook
     keyb64 := base64.StdEncoding.EncodeToString([]byte("phoenix-cli:" + b.Key))
     req.Header.Add("Authorization", "Basic " + keyb64)
 
+    client := &http.Client{}
     res, err := client.Do(req)
     if err != nil {
         return nil, err
     }
     defer res.Body.Close()
 
-    if res.StatusCode >= 300 {
+    if res.StatusCode == 404 {
+        return nil, ErrNotFound
+    } else if res.StatusCode >= 400 {
         body, _ := io.ReadAll(res.Body)
-        text := string(body)
-        if len(text) > 300 {
-            text = text[:300]
-        }
-        return nil, fmt.Errorf("call to phoenix failed (%d): %s", res.StatusCode, text)
-    }
-
-    body, err := io.ReadAll(res.Body)
-    if err != nil {
-        return nil, err
+        return nil, fmt.Errorf("HTTP error %d: %s", res.StatusCode, string(body))
     }
 
-    var payments []PhoenixLookupInvoiceResult
-    err = json.Unmarshal(body, &payments)
-    if err != nil {
+    var result PhoenixLookupInvoiceResult
+    if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
         return nil, err
     }
 
-    for _, payment := range payments {
-        if payment.PaymentHash == paymentHash {
-            return &payment, nil
-        }
-    }
-
-    // Not found
-    return nil, nil
+    return &result, nil
 }
 
-
-func (b *PhoenixBackend) makeInvoice(params Nip47InvoiceParams) (*PhoenixInvoiceResult, error) {
+func (b *PhoenixBackend) makeInvoice(params InvoiceParams) (*PhoenixInvoiceResult, error) {
 	payload := url.Values{}
 
-	if params.DescriptionHash != "" {
+	if params.UseDescriptionHash {
+		descriptionHash := sha256.Sum256([]byte(params.Description))
+		payload.Set("descriptionHash", hex.EncodeToString(descriptionHash[:]))
+	} else if params.DescriptionHash != "" {
 		payload.Set("descriptionHash", params.DescriptionHash)
 	} else {
 		payload.Set("description", params.Description)
 	}
 
-	// TODO use params.Expiry
+	if params.Expiry > 0 {
+		payload.Add("expirySeconds", fmt.Sprintf("%d", params.Expiry))
+	}
 
 	payload.Add("amountSat", fmt.Sprintf("%d", params.Amount/1000))
 
@@ -525,273 +542,162 @@ func (b *PhoenixBackend) listPayments(params Nip47ListTransactionsParams) (*[]Ph
 
 }
 
-func (b *PhoenixBackend) HandleGetBalance(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
-
-	sats, err := b.getBalance()
-
+// phoenixTransaction converts a phoenixd payment, with times in
+// milliseconds, to a transaction.
+func phoenixTransaction(txType string, tx *PhoenixTransactionResult) (*Transaction, error) {
+	bolt11, err := decodepay.Decodepay(tx.Invoice)
 	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not get balance",
-		}
-	}
-
-	msats := sats * 1000
-
-	response := Nip47Response{
-		ResultType: "get_balance",
-		Result: Nip47GetBalanceResult{
-			Balance: msats,
-		},
+		return nil, err
 	}
 
-	return &response, nil
-}
-
-func (b *PhoenixBackend) HandleLookupInvoice(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
-
-
-	var params Nip47LookupInvoiceParams
-
-	err := json.Unmarshal(nip47req.Params, &params)
-
-	var paymentHash string
-
-	if params.PaymentHash == "" {
-		paymentRequest, err := decodepay.Decodepay(strings.ToLower(params.Invoice))
-		if err != nil {
-			return nil, &Nip47Error{
-				Code: NIP47_ERROR_INTERNAL,
-				Message: "could not decode invoice",
-			}
-		}
-		paymentHash = paymentRequest.PaymentHash
-	} else {
-		paymentHash = params.PaymentHash
+	result := &Transaction{
+		Type: txType,
+		Invoice: tx.Invoice,
+		Description: tx.Description,
+		DescriptionHash: bolt11.DescriptionHash,
+		PaymentHash: tx.PaymentHash,
+		Amount: uint64(bolt11.MSatoshi),
+		FeesPaid: tx.Fees * 1000, // msats
+		CreatedAt: tx.CreatedAt / 1000, // seconds
+		Settled: tx.IsPaid,
 	}
 
-	result, err := b.lookupInvoice(paymentHash)
-
-	if result == nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_NOT_FOUND,
-			Message: "could not find invoice",
-		}
+	if txType == "incoming" && tx.ReceivedSat > 0 {
+		result.Amount = tx.ReceivedSat * 1000 // msats
+	} else if txType == "outgoing" && tx.Sent > 0 {
+		result.Amount = tx.Sent * 1000 // msats
 	}
 
-	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not load invoice",
-		}
+	if txType == "outgoing" && !tx.IsPaid && tx.CompletedAt > 0 {
+		// payments are completed once they have either been paid or
+		// failed
+		result.Failed = true
 	}
 
-	bolt11, err := decodepay.Decodepay(result.Invoice)
-
-	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not decode invoice",
+	if tx.IsPaid {
+		result.Preimage = tx.Preimage
+		result.SettledAt = tx.CompletedAt / 1000 // seconds
+		if result.SettledAt == 0 {
+			result.SettledAt = result.CreatedAt
 		}
 	}
 
-	var expiresAt uint
 	if bolt11.Expiry > 0 {
-		expiresAt = result.CreatedAt + (uint(bolt11.Expiry) * 1000)
-	} else {
-		expiresAt = 0
+		result.ExpiresAt = uint(bolt11.CreatedAt + bolt11.Expiry)
 	}
 
-	nip47result := Nip47InvoiceResult{
-		Type: "incoming",
-		Invoice: result.Invoice,
-		Description: result.Description,
-		DescriptionHash: bolt11.DescriptionHash,
-		Preimage: result.Preimage,
-		PaymentHash: paymentHash,
-		Amount: uint64(bolt11.MSatoshi),
-		FeesPaid: result.Fees,
-		CreatedAt: result.CreatedAt / 1000, // seconds
-		// TODO metadata
-	}
+	return result, nil
+}
 
-	if result.IsPaid {
-		nip47result.SettledAt = result.CreatedAt / 1000 // seconds
+func (b *PhoenixBackend) Capabilities() []string {
+	return []string{
+		NIP47_PAY_INVOICE_METHOD,
+		NIP47_GET_BALANCE_METHOD,
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+		NIP47_GET_INFO_METHOD,
+		NIP47_LIST_TRANSACTIONS_METHOD,
 	}
+}
 
-	if expiresAt > 0 {
-		nip47result.ExpiresAt = expiresAt / 1000
-	}
+func (b *PhoenixBackend) GetBalance(ctx context.Context) (uint64, error) {
+	sats, err := b.getBalance()
 
-	response := Nip47Response{
-		ResultType: "lookup_invoice",
-		Result: nip47result,
+	if err != nil {
+		return 0, err
 	}
 
-	return &response, nil
+	return sats * 1000, nil
 }
 
-func (b *PhoenixBackend) HandleListTransactions(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
-	var params Nip47ListTransactionsParams
-
-	err := json.Unmarshal(nip47req.Params, &params)
+func (b *PhoenixBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	txType := "incoming"
 
-	result, err := b.listTransactions(params)
+	result, err := b.lookupIncomingInvoice(paymentHash)
 
-	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: fmt.Sprintf("could not list transactions (%s)", err),
-		}
+	if errors.Is(err, ErrNotFound) {
+		txType = "outgoing"
+		result, err = b.lookupOutgoingInvoice(paymentHash)
 	}
 
-	payments, err := b.listPayments(params)
-
 	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: fmt.Sprintf("could not list payments (%s)", err),
-		}
+		return nil, err
 	}
 
-	txs := make([]Nip47InvoiceResult, len(*result) + len(*payments))
-	var offset int
-
-	for i, tx := range *result {
-		bolt11, err := decodepay.Decodepay(tx.Invoice)
-
-		if err != nil {
-			return nil, &Nip47Error{
-				Code: NIP47_ERROR_INTERNAL,
-				Message: "could not decode invoice",
-			}
-		}
-
-		var expiresAt uint
-		if bolt11.Expiry > 0 {
-			expiresAt = tx.CreatedAt + (uint(bolt11.Expiry) * 1000)
-		} else {
-			expiresAt = 0
-		}
+	return phoenixTransaction(txType, &PhoenixTransactionResult{
+		CompletedAt: result.CompletedAt,
+		CreatedAt: result.CreatedAt,
+		Description: result.Description,
+		Fees: result.Fees,
+		Invoice: result.Invoice,
+		IsPaid: result.IsPaid,
+		PaymentHash: paymentHash,
+		Preimage: result.Preimage,
+		ReceivedSat: result.ReceivedSat,
+	})
+}
 
-		txs[i].Type = "incoming"
+func (b *PhoenixBackend) ListTransactions(ctx context.Context, params Nip47ListTransactionsParams) ([]Transaction, error) {
+	var txs []Transaction
 
-		txs[i].PaymentHash = tx.PaymentHash
+	if params.Type == "" || params.Type == "incoming" {
+		result, err := b.listTransactions(params)
 
-		if tx.IsPaid {
-			txs[i].Preimage = tx.Preimage
+		if err != nil {
+			return nil, err
 		}
 
-		txs[i].Description = tx.Description
-		txs[i].DescriptionHash = bolt11.DescriptionHash
-		txs[i].Invoice = tx.Invoice
-		txs[i].FeesPaid = tx.Fees * 1000 // msats
-		txs[i].Amount = tx.ReceivedSat * 1000 // msats
-		txs[i].CreatedAt = tx.CreatedAt / 1000 // seconds
+		for i := range *result {
+			tx, err := phoenixTransaction("incoming", &(*result)[i])
 
-		if tx.IsPaid {
-			txs[i].SettledAt = tx.CompletedAt / 1000 // seconds
-		}
+			if err != nil {
+				return nil, err
+			}
 
-		if expiresAt > 0 {
-			txs[i].ExpiresAt = expiresAt / 1000 // seconds
+			txs = append(txs, *tx)
 		}
-
-		offset += 1
 	}
 
-	for i, payment := range *payments {
-		bolt11, err := decodepay.Decodepay(payment.Invoice)
+	if params.Type == "" || params.Type == "outgoing" {
+		payments, err := b.listPayments(params)
 
 		if err != nil {
-			return nil, &Nip47Error{
-				Code: NIP47_ERROR_INTERNAL,
-				Message: "could not decode invoice",
-			}
-		}
-
-		var expiresAt uint
-		if bolt11.Expiry > 0 {
-			expiresAt = payment.CreatedAt + (uint(bolt11.Expiry) * 1000)
-		} else {
-			expiresAt = 0
-		}
-
-		txs[offset + i].Type = "outgoing"
-
-		txs[offset + i].PaymentHash = payment.PaymentHash
-
-		if payment.IsPaid {
-			txs[offset + i].Preimage = payment.Preimage
+			return nil, err
 		}
 
-		txs[offset + i].Description = payment.Description
-		txs[offset + i].DescriptionHash = bolt11.DescriptionHash
-		txs[offset + i].Invoice = payment.Invoice
-		txs[offset + i].FeesPaid = payment.Fees * 1000 // msats
-		txs[offset + i].Amount = payment.Sent * 1000 // msats
-		txs[offset + i].CreatedAt = payment.CreatedAt / 1000 // seconds
+		for i := range *payments {
+			tx, err := phoenixTransaction("outgoing", &(*payments)[i])
 
-		if payment.IsPaid {
-			txs[offset + i].SettledAt = payment.CompletedAt / 1000 // seconds
-		}
+			if err != nil {
+				return nil, err
+			}
 
-		if expiresAt > 0 {
-			txs[offset + i].ExpiresAt = expiresAt / 1000 // seconds
+			txs = append(txs, *tx)
 		}
 	}
 
-	sort.SliceStable(txs, func(i, j int) bool {
-		return txs[i].CreatedAt > txs[j].CreatedAt
-	})
-
-	max := len(txs) - 1
-	if max + 1 > int(params.Limit) {
-		max = int(params.Limit) - 1
-	}
-
-	response := &Nip47Response{
-		ResultType: "list_transactions",
-		Result: Nip47ListTransactionsResult{
-			Transactions: txs[:max],
-		},
-	}
-
-	return response, nil
+	return txs, nil
 }
 
-func (b *PhoenixBackend) HandleMakeInvoice(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
-
-	var params Nip47InvoiceParams
-
-	err := json.Unmarshal(nip47req.Params, &params)
+func (b *PhoenixBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	// phoenixd makes the preimage of its invoices
+	if params.Preimage != "" {
+		return nil, fmt.Errorf("invoice with preimage: %w", ErrNotImplemented)
+	}
 
 	result, err := b.makeInvoice(params)
 
 	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not create invoice",
-		}
+		return nil, err
 	}
 
 	bolt11, err := decodepay.Decodepay(result.Invoice)
 
 	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not decode invoice",
-		}
-	}
-
-	var expiresAt uint
-	if bolt11.Expiry > 0 {
-		expiresAt = uint(bolt11.CreatedAt) + (uint(bolt11.Expiry) * 1000)
-	} else {
-		expiresAt = 0
+		return nil, err
 	}
 
-	nip47result := Nip47InvoiceResult{
+	tx := &Transaction{
 		Type: "incoming",
 		Invoice: result.Invoice,
 		Description: bolt11.Description,
@@ -801,77 +707,91 @@ func (b *PhoenixBackend) HandleMakeInvoice(ctx context.Context, nip47req Nip47Re
 		CreatedAt: uint(bolt11.CreatedAt),
 	}
 
-	if expiresAt > 0 {
-		nip47result.ExpiresAt = expiresAt
-	}
-
-	response := &Nip47Response{
-		ResultType: "make_invoice",
-		Result: nip47result,
+	if bolt11.Expiry > 0 {
+		tx.ExpiresAt = uint(bolt11.CreatedAt + bolt11.Expiry)
 	}
 
-	return response, nil
+	return tx, nil
 }
 
-func (b *PhoenixBackend) HandleGetInfo(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+func (b *PhoenixBackend) GetInfo(ctx context.Context) (*NodeInfo, error) {
 	result, err := b.getInfo()
 
 	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not get information",
-		}
+		return nil, err
 	}
 
-	response := &Nip47Response{
-		ResultType: "get_info",
-		Result: Nip47GetInfoResult{
-			//Alias: nil,
-			//Color: nil,
-			//PubKey: nil,
-			Network: result.Chain, // mainnet, testnet, signet, or regtest
-			//BlockHeight: nil,
-			//BlockHash: nil,
-			Methods: strings.Split(NIP47_CAPABILITIES, " "),
-		},
+	return &NodeInfo{
+		PubKey: result.NodeId,
+		Network: result.Chain, // mainnet, testnet, signet, or regtest
+	}, nil
+}
+
+func (b *PhoenixBackend) PayInvoice(ctx context.Context, params PayParams) (*Transaction, error) {
+	result, err := b.payInvoice(params.Invoice, params.Amount)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return response, nil
+	return &Transaction{
+		Type: "outgoing",
+		Invoice: params.Invoice,
+		Preimage: result.PaymentPreimage,
+		PaymentHash: result.PaymentHash,
+		Amount: result.RecipientAmountSat * 1000, // msats
+		FeesPaid: result.RoutingFeeSat * 1000, // msats
+		CreatedAt: uint(time.Now().Unix()),
+		SettledAt: uint(time.Now().Unix()),
+		Settled: true,
+	}, nil
 }
 
-func (b *PhoenixBackend) HandlePayInvoice(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
-
-	var params Nip47PayParams
+// PayKeysend is not supported, phoenixd can only pay invoices and
+// offers.
+func (b *PhoenixBackend) PayKeysend(ctx context.Context, params KeysendParams) (*Transaction, error) {
+	return nil, ErrNotImplemented
+}
 
-	err := json.Unmarshal(nip47req.Params, &params)
+// SubscribeSettlements listens for payment_received events on the
+// phoenixd websocket.
+func (b *PhoenixBackend) SubscribeSettlements(ctx context.Context, settled chan<- Settlement) error {
+	header := http.Header{}
+	header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("phoenix-cli:"+b.Key)))
 
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws://"+b.Host+"/websocket", header)
 	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not decode",
-		}
+		return err
 	}
+	defer conn.Close()
 
-	result, err := b.payInvoice(params.Invoice)
+	// unblock reads when ctx is done
+	done := make(chan struct{})
+	defer close(done)
 
-	if err != nil {
-		return nil, &Nip47Error{
-			Code: NIP47_ERROR_INTERNAL,
-			Message: "could not pay",
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
 		}
-	}
-
-	response := Nip47Response{
-		ResultType: "pay_invoice",
-		Result: Nip47PayInvoiceResult{
-			Preimage: result.PaymentPreimage,
-		},
-	}
+	}()
 
-	return &response, nil
-}
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
 
-func (b *PhoenixBackend) HandleUnknownMethod(ctx context.Context, nip47req Nip47Request) (*Nip47Response, *Nip47Error) {
+		if gjson.GetBytes(msg, "type").String() != "payment_received" {
+			continue
+		}
 
-	return &Nip47Response{}, &Nip47Error{}
+		err = sendSettlement(ctx, settled, Settlement{
+			PaymentHash: gjson.GetBytes(msg, "paymentHash").String(),
+		})
+		if err != nil {
+			return err
+		}
+	}
 }
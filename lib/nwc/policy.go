@@ -0,0 +1,80 @@
+package nwc
+
+import (
+	"time"
+)
+
+const (
+	BUDGET_RENEWAL_DAILY   = "daily"
+	BUDGET_RENEWAL_WEEKLY  = "weekly"
+	BUDGET_RENEWAL_MONTHLY = "monthly"
+	BUDGET_RENEWAL_YEARLY  = "yearly"
+	BUDGET_RENEWAL_NEVER   = "never"
+)
+
+// Policy restricts what a wallet connection is allowed to do, the zero
+// value allows everything.
+type Policy struct {
+	// allowed methods, all when empty
+	Methods []string
+
+	MaxAmount uint64 // msats, per payment
+	MaxFee    uint64 // msats, per payment
+
+	Budget        uint64 // msats, per renewal period
+	BudgetRenewal string // daily, weekly, monthly, yearly or never
+}
+
+func (policy *Policy) Allows(method string) bool {
+	if len(policy.Methods) == 0 {
+		return true
+	}
+
+	for _, m := range policy.Methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowedMethods returns the methods of the backend that are allowed.
+func (policy *Policy) AllowedMethods(methods []string) []string {
+	var allowed []string
+
+	for _, method := range methods {
+		if policy.Allows(method) {
+			allowed = append(allowed, method)
+		}
+	}
+
+	return allowed
+}
+
+// BudgetPeriod returns the start of the current budget period and when
+// it renews, in UTC. Budgets that never renew start at the zero time and
+// have a zero renewal.
+func (policy *Policy) BudgetPeriod(now time.Time) (start time.Time, renewsAt time.Time) {
+	now = now.UTC()
+	year, month, day := now.Date()
+
+	switch policy.BudgetRenewal {
+	case BUDGET_RENEWAL_DAILY:
+		start = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		renewsAt = start.AddDate(0, 0, 1)
+	case BUDGET_RENEWAL_WEEKLY:
+		// weeks start on monday
+		offset := (int(now.Weekday()) + 6) % 7
+		start = time.Date(year, month, day-offset, 0, 0, 0, 0, time.UTC)
+		renewsAt = start.AddDate(0, 0, 7)
+	case BUDGET_RENEWAL_MONTHLY:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		renewsAt = start.AddDate(0, 1, 0)
+	case BUDGET_RENEWAL_YEARLY:
+		start = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		renewsAt = start.AddDate(1, 0, 0)
+	}
+
+	return start, renewsAt
+}
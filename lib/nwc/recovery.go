@@ -0,0 +1,241 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// how often payments that were in flight during a restart are looked up
+var RecoveryInterval = time.Minute
+
+// RecoverRequests resolves requests left running by a crash or restart.
+// Payments are looked up with the backend instead of being paid again,
+// requests that did not reach the backend are executed again, and
+// payments that are still in flight are left running until the next
+// recovery. Items of multi requests are resolved one by one. Requests
+// that are executing are skipped.
+func RecoverRequests(ctx context.Context, db *gorm.DB, p *NWCParams, user NWCUser, responses chan<- ResponseEvent, executing map[string]bool) {
+	var requests []RequestEvent
+
+	result := db.Table("request_events").Where("user = ?", user.Name).Where("status = ?", REQUEST_EVENT_STATUS_RUNNING).Find(&requests)
+
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	for _, request := range requests {
+		if executing[request.NostrId] {
+			continue
+		}
+
+		p.Logger.Info().Str("request_nostr_id", request.NostrId).Msg("recovering request")
+
+		response, err := recoverRequest(ctx, db, p, &user, &request)
+
+		if err != nil {
+			p.Logger.Warn().Err(err).Str("request_nostr_id", request.NostrId).Msg("unable to recover request")
+		} else if response != nil {
+			select {
+			case responses <- *response:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func recoverRequest(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent) (*ResponseEvent, error) {
+	cipher, err := request.GetCipher(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nip47req, err := request.GetNip47Request(p, cipher)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if itemIds, ok := multiItemIds(*nip47req); ok {
+		return recoverMultiRequest(ctx, db, p, user, request, cipher, nip47req.Method, itemIds)
+	}
+
+	payment, err := p.ledger.FindByRequest(request.NostrId, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if payment == nil {
+		return nil, executeAgain(db, p, request)
+	}
+
+	resolved, err := recoverPayment(ctx, p, user, payment)
+
+	if err != nil || !resolved {
+		return nil, err
+	}
+
+	resp, nip47err := paymentResponse(nip47req.Method, payment)
+
+	return CommitNip47Response(db, p, user, request, cipher, resp, nip47err)
+}
+
+// recoverMultiRequest answers the items of a multi request that have no
+// response. Items that were not paid before the restart are not paid
+// anymore, unless no item was.
+func recoverMultiRequest(ctx context.Context, db *gorm.DB, p *NWCParams, user *NWCUser, request *RequestEvent, cipher Cipher, method string, itemIds []string) (*ResponseEvent, error) {
+	responded, err := respondedItems(db, request.NostrId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	payments := make(map[string]*Payment)
+
+	for _, itemId := range itemIds {
+		if responded[itemId] {
+			continue
+		}
+
+		payment, err := p.ledger.FindByRequest(request.NostrId, itemId)
+		if err != nil {
+			return nil, err
+		}
+
+		if payment != nil {
+			payments[itemId] = payment
+		}
+	}
+
+	if len(responded) == 0 && len(payments) == 0 {
+		return nil, executeAgain(db, p, request)
+	}
+
+	var last *ResponseEvent
+	inFlight := false
+
+	for _, itemId := range itemIds {
+		if responded[itemId] {
+			continue
+		}
+
+		var resp *Nip47Response
+		var nip47err *Nip47Error
+
+		if payment, ok := payments[itemId]; ok {
+			resolved, err := recoverPayment(ctx, p, user, payment)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !resolved {
+				inFlight = true
+				continue
+			}
+
+			resp, nip47err = paymentResponse(method, payment)
+		} else {
+			nip47err = &Nip47Error{
+				Code: NIP47_ERROR_OTHER,
+				Message: "The payment was interrupted before it was made",
+			}
+		}
+
+		re, err := CommitNip47ItemResponse(db, p, user, request, cipher, itemId, resp, nip47err)
+		if err != nil {
+			return nil, err
+		}
+
+		last = re
+	}
+
+	if !inFlight {
+		if err := CompleteRequest(db, request.NostrId); err != nil {
+			return nil, err
+		}
+	}
+
+	return last, nil
+}
+
+// executeAgain returns a request that did not reach the backend to the
+// backlog, it's executed again unless it's stale by now.
+func executeAgain(db *gorm.DB, p *NWCParams, request *RequestEvent) error {
+	p.Logger.Info().Str("request_nostr_id", request.NostrId).Msg("request did not reach the backend, executing again")
+
+	return db.Table("request_events").Where("id = ?", request.ID).Update("status", REQUEST_EVENT_STATUS_RECEIVED).Error
+}
+
+// recoverPayment looks up the outcome of a pending payment with the
+// backend and updates the ledger, it's not resolved while the payment is
+// still in flight.
+func recoverPayment(ctx context.Context, p *NWCParams, user *NWCUser, payment *Payment) (bool, error) {
+	if payment.Status != PAYMENT_STATUS_PENDING {
+		return true, nil
+	}
+
+	if payment.PaymentHash == "" {
+		// a keysend with a preimage chosen by the backend, its budget
+		// stays reserved
+		p.Logger.Warn().Uint("payment_id", payment.ID).Msg("unable to look up payment without payment hash")
+		return true, nil
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	tx, err := user.Backend.LookupInvoice(lctx, payment.PaymentHash)
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		// the payment was interrupted before the backend saw it
+		err = p.ledger.Fail(payment)
+		payment.Status = PAYMENT_STATUS_FAILED
+	case err != nil:
+		return false, err
+	case tx.Type != "outgoing":
+		return false, errors.New("payment hash is not of an outgoing payment")
+	case tx.Settled:
+		err = p.ledger.Settle(payment, tx)
+		payment.Status = PAYMENT_STATUS_SETTLED
+		payment.Preimage = tx.Preimage
+		p.notifier.Notify(user, NIP47_NOTIFICATION_PAYMENT_SENT, tx)
+	case tx.Failed:
+		err = p.ledger.Fail(payment)
+		payment.Status = PAYMENT_STATUS_FAILED
+	default:
+		p.Logger.Info().Str("payment_hash", payment.PaymentHash).Msg("payment still in flight")
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// paymentResponse returns the response to a recovered payment.
+func paymentResponse(method string, payment *Payment) (*Nip47Response, *Nip47Error) {
+	switch payment.Status {
+	case PAYMENT_STATUS_SETTLED:
+		return &Nip47Response{
+			ResultType: method,
+			Result: Nip47PayInvoiceResult{
+				Preimage: payment.Preimage,
+			},
+		}, nil
+	case PAYMENT_STATUS_FAILED:
+		return nil, &Nip47Error{
+			Code: NIP47_ERROR_PAYMENT_FAILED,
+			Message: "The payment failed",
+		}
+	}
+
+	return nil, &Nip47Error{
+		Code: NIP47_ERROR_OTHER,
+		Message: "The outcome of the payment is unknown",
+	}
+}
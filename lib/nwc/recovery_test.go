@@ -0,0 +1,549 @@
+package nwc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"gorm.io/gorm"
+)
+
+// newTestConnection creates a connection of the user without limits.
+func newTestConnection(t testing.TB, db *gorm.DB, user string) *Connection {
+	t.Helper()
+
+	c, err := NewConnection(user, "app", nil, Policy{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateConnection(db, c); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// newTestRequest returns a request of the connection, encrypted with
+// nip04.
+func newTestRequest(t testing.TB, p *NWCParams, c *Connection, method string, params interface{}, createdAt time.Time, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	cipher, err := NewCipher(NIP47_ENCRYPTION_NIP04, p.PublicKey, c.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jparams, _ := json.Marshal(params)
+	payload, _ := json.Marshal(Nip47Request{Method: method, Params: jparams})
+
+	content, err := cipher.Encrypt(string(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signTestRequest(t, p, c, content, createdAt, tags...)
+}
+
+func signTestRequest(t testing.TB, p *NWCParams, c *Connection, content string, createdAt time.Time, tags ...nostr.Tag) *nostr.Event {
+	t.Helper()
+
+	evt := &nostr.Event{
+		PubKey:    c.PubKey,
+		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		Kind:      NIP47_REQUEST_KIND,
+		Tags:      append(nostr.Tags{{"p", p.PublicKey}}, tags...),
+		Content:   content,
+	}
+
+	if err := evt.Sign(c.Secret); err != nil {
+		t.Fatal(err)
+	}
+
+	return evt
+}
+
+// testResponse is a decrypted response.
+type testResponse struct {
+	Error      *Nip47Error     `json:"error"`
+	Result     json.RawMessage `json:"result"`
+	ResultType string          `json:"result_type"`
+}
+
+func decryptResponse(t testing.TB, p *NWCParams, c *Connection, response ResponseEvent) testResponse {
+	t.Helper()
+
+	var evt nostr.Event
+	if err := json.Unmarshal([]byte(response.Raw), &evt); err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := NewCipher(NIP47_ENCRYPTION_NIP04, p.PublicKey, c.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := cipher.Decrypt(evt.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp testResponse
+	if err := json.Unmarshal([]byte(payload), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// receiveTestRequest saves the request as the listener does.
+func receiveTestRequest(t testing.TB, db *gorm.DB, p *NWCParams, user *NWCUser, evt *nostr.Event) *RequestEvent {
+	t.Helper()
+
+	request, nip47err := HandleEvent(db, p, user, evt)
+	if nip47err != nil {
+		t.Fatalf("request not received: %s", nip47err.Message)
+	}
+
+	return request
+}
+
+// runExecuter runs the executer of the user, as after a restart, until
+// it has sent the number of responses, and a little longer to catch
+// responses that should not be sent.
+func runExecuter(t testing.TB, db *gorm.DB, p *NWCParams, user NWCUser, want int) []ResponseEvent {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	requests := make(chan RequestEvent)
+	responses := make(chan ResponseEvent, 100)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		StartExecuter(ctx, db, p, user, requests, responses)
+	}()
+
+	var received []ResponseEvent
+
+	timeout := time.After(5 * time.Second)
+
+	for len(received) < want {
+		select {
+		case response := <-responses:
+			received = append(received, response)
+		case <-timeout:
+			cancel()
+			<-stopped
+			t.Fatalf("received %d responses, expected %d", len(received), want)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	cancel()
+	<-stopped
+
+	close(responses)
+	for response := range responses {
+		received = append(received, response)
+	}
+
+	if len(received) != want {
+		t.Fatalf("received %d responses, expected %d", len(received), want)
+	}
+
+	return received
+}
+
+func requestStatus(t testing.TB, db *gorm.DB, nostrId string) string {
+	t.Helper()
+
+	var request RequestEvent
+	if err := db.Table("request_events").Where("nostr_id = ?", nostrId).First(&request).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return request.Status
+}
+
+func TestCheckRequestAge(t *testing.T) {
+	p := &NWCParams{MaxRequestAge: 10 * time.Minute}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		createdAt time.Time
+		expiresAt time.Time
+		stale     bool
+	}{
+		{"fresh", now.Add(-time.Minute), time.Time{}, false},
+		{"old", now.Add(-11 * time.Minute), time.Time{}, true},
+		{"future", now.Add(11 * time.Minute), time.Time{}, true},
+		{"not expired", now.Add(-time.Minute), now.Add(time.Minute), false},
+		{"expired", now.Add(-time.Minute), now.Add(-time.Second), true},
+		{"expires now", now.Add(-time.Minute), now, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evt := &nostr.Event{CreatedAt: nostr.Timestamp(test.createdAt.Unix())}
+
+			if nip47err := CheckRequestAge(p, evt, test.expiresAt, now); (nip47err != nil) != test.stale {
+				t.Fatalf("stale %t, error %v", test.stale, nip47err)
+			}
+		})
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	db := newTestDB(t)
+	user := NWCUser{Name: "jane", Backend: newFakeBackend()}
+	p := newTestParams(t, db, user)
+	c := newTestConnection(t, db, "jane")
+
+	now := time.Now()
+
+	fresh := newTestRequest(t, p, c, NIP47_GET_INFO_METHOD, nil, now)
+	expiration := nostr.Tag{"expiration", "1"}
+
+	other := &Connection{PubKey: "", Secret: nostr.GeneratePrivateKey()}
+	other.PubKey, _ = nostr.GetPublicKey(other.Secret)
+
+	tests := []struct {
+		name  string
+		event *nostr.Event
+		saved bool
+		code  string
+	}{
+		{"fresh", fresh, true, ""},
+		{"already received", fresh, false, ""},
+		{"stale", newTestRequest(t, p, c, NIP47_GET_INFO_METHOD, nil, now.Add(-time.Hour)), false, NIP47_ERROR_OTHER},
+		{"expired", newTestRequest(t, p, c, NIP47_GET_INFO_METHOD, nil, now, expiration), false, NIP47_ERROR_OTHER},
+		{"unknown connection", newTestRequest(t, p, other, NIP47_GET_INFO_METHOD, nil, now), false, NIP47_ERROR_UNAUTHORIZED},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, nip47err := HandleEvent(db, p, &user, test.event)
+
+			if (request != nil) != test.saved {
+				t.Fatalf("saved %t", request != nil)
+			}
+
+			if test.code == "" && nip47err != nil {
+				t.Fatalf("error %s", nip47err.Message)
+			} else if test.code != "" && (nip47err == nil || nip47err.Code != test.code) {
+				t.Fatalf("error %v, expected %s", nip47err, test.code)
+			}
+
+			if request != nil && (request.Status != REQUEST_EVENT_STATUS_RECEIVED || !request.ExpiresAt.IsZero()) {
+				t.Fatalf("request %+v", request)
+			}
+		})
+	}
+}
+
+func TestExecuterBacklog(t *testing.T) {
+	db := newTestDB(t)
+	backend := newFakeBackend()
+	user := NWCUser{Name: "jane", Backend: backend}
+	p := newTestParams(t, db, user)
+	c := newTestConnection(t, db, "jane")
+
+	invoice1, hash1 := newTestInvoice(t, 1000, "")
+	invoice2, hash2 := newTestInvoice(t, 2000, "")
+
+	// received before a restart, not executed yet
+	request1 := receiveTestRequest(t, db, p, &user, newTestRequest(t, p, c, NIP47_PAY_INVOICE_METHOD, Nip47PayParams{Invoice: invoice1}, time.Now()))
+	request2 := receiveTestRequest(t, db, p, &user, newTestRequest(t, p, c, NIP47_PAY_INVOICE_METHOD, Nip47PayParams{Invoice: invoice2}, time.Now()))
+
+	responses := runExecuter(t, db, p, user, 2)
+
+	for _, response := range responses {
+		if resp := decryptResponse(t, p, c, response); resp.Error != nil || resp.ResultType != NIP47_PAY_INVOICE_METHOD {
+			t.Fatalf("response %+v", resp)
+		}
+	}
+
+	if backend.payments(hash1) != 1 || backend.payments(hash2) != 1 {
+		t.Fatalf("paid %d and %d times", backend.payments(hash1), backend.payments(hash2))
+	}
+
+	for _, request := range []*RequestEvent{request1, request2} {
+		if status := requestStatus(t, db, request.NostrId); status != REQUEST_EVENT_STATUS_DONE {
+			t.Fatalf("request is %s", status)
+		}
+	}
+
+	// answered requests are not executed again after another restart
+	runExecuter(t, db, p, user, 0)
+
+	if backend.payments(hash1) != 1 || backend.payments(hash2) != 1 {
+		t.Fatalf("paid %d and %d times", backend.payments(hash1), backend.payments(hash2))
+	}
+
+	// nor when they are received again from a relay
+	if request, _ := HandleEvent(db, p, &user, newTestRequestWithID(t, db, request1.NostrId)); request != nil {
+		t.Fatal("request was received again")
+	}
+}
+
+// newTestRequestWithID returns the saved event of the request.
+func newTestRequestWithID(t testing.TB, db *gorm.DB, nostrId string) *nostr.Event {
+	t.Helper()
+
+	var request RequestEvent
+	if err := db.Table("request_events").Where("nostr_id = ?", nostrId).First(&request).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	evt, err := request.GetEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return evt
+}
+
+func TestExecuterBacklogStale(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration // of the request once executed
+		maxAge  time.Duration
+		expired bool
+	}{
+		{"expired", time.Second, 0, true},
+		{"too old", time.Minute, 30 * time.Second, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			backend := newFakeBackend()
+			user := NWCUser{Name: "jane", Backend: backend}
+			p := newTestParams(t, db, user)
+			c := newTestConnection(t, db, "jane")
+
+			invoice, hash := newTestInvoice(t, 1000, "")
+
+			request := receiveTestRequest(t, db, p, &user, newTestRequest(t, p, c, NIP47_PAY_INVOICE_METHOD, Nip47PayParams{Invoice: invoice}, time.Now().Add(-test.age)))
+
+			// the request became stale while the server was down
+			if test.expired {
+				if err := db.Table("request_events").Where("id = ?", request.ID).Update("expires_at", time.Now().Add(-time.Second)).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p.MaxRequestAge = test.maxAge
+
+			responses := runExecuter(t, db, p, user, 1)
+
+			if resp := decryptResponse(t, p, c, responses[0]); resp.Error == nil || resp.Error.Code != NIP47_ERROR_OTHER {
+				t.Fatalf("response %+v", resp)
+			}
+
+			if backend.payments(hash) != 0 {
+				t.Fatal("stale request was paid")
+			}
+		})
+	}
+}
+
+func TestExecuterUndecryptableRequest(t *testing.T) {
+	db := newTestDB(t)
+	user := NWCUser{Name: "jane", Backend: newFakeBackend()}
+	p := newTestParams(t, db, user)
+	c := newTestConnection(t, db, "jane")
+
+	request := receiveTestRequest(t, db, p, &user, signTestRequest(t, p, c, "not encrypted", time.Now()))
+
+	responses := runExecuter(t, db, p, user, 1)
+
+	if resp := decryptResponse(t, p, c, responses[0]); resp.Error == nil || resp.Error.Code != NIP47_ERROR_OTHER {
+		t.Fatalf("response %+v", resp)
+	}
+
+	if status := requestStatus(t, db, request.NostrId); status != REQUEST_EVENT_STATUS_DONE {
+		t.Fatalf("request is %s", status)
+	}
+
+	// not replayed after a restart
+	runExecuter(t, db, p, user, 0)
+}
+
+func TestRecoverRunningRequest(t *testing.T) {
+	preimage := "0707070707070707070707070707070707070707070707070707070707070707"
+
+	tests := []struct {
+		name     string
+		reserved bool // the payment was journaled before the restart
+		sent     bool // the backend made the payment before the restart
+		paid     int  // times paid after the restart
+		code     string
+	}{
+		{"paid before the restart", true, true, 0, ""},
+		{"reserved, not seen by the backend", true, false, 0, NIP47_ERROR_PAYMENT_FAILED},
+		{"not reserved", false, false, 1, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			backend := newFakeBackend()
+			user := NWCUser{Name: "jane", Backend: backend}
+			p := newTestParams(t, db, user)
+			c := newTestConnection(t, db, "jane")
+
+			invoice := newTestInvoiceWith(t, 1000, mustHex(preimage), "")
+			sum := sha256.Sum256(mustHex(preimage))
+			hash := hex.EncodeToString(sum[:])
+			backend.preimages[hash] = preimage
+
+			request := receiveTestRequest(t, db, p, &user, newTestRequest(t, p, c, NIP47_PAY_INVOICE_METHOD, Nip47PayParams{Invoice: invoice}, time.Now()))
+
+			// interrupted while executing
+			if err := db.Table("request_events").Where("id = ?", request.ID).Update("status", REQUEST_EVENT_STATUS_RUNNING).Error; err != nil {
+				t.Fatal(err)
+			}
+
+			if test.reserved {
+				_, err := p.ledger.Reserve(user.WithConnection(c), &Payment{RequestNostrId: request.NostrId, PaymentHash: hash, Amount: 1000})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.sent {
+				backend.add(&Transaction{Type: "outgoing", PaymentHash: hash, Preimage: preimage, Amount: 1000, Settled: true})
+			}
+
+			responses := runExecuter(t, db, p, user, 1)
+			resp := decryptResponse(t, p, c, responses[0])
+
+			if test.code != "" {
+				if resp.Error == nil || resp.Error.Code != test.code {
+					t.Fatalf("response %+v", resp)
+				}
+			} else if resp.Error != nil || !json.Valid(resp.Result) || string(resp.Result) != `{"preimage":"`+preimage+`"}` {
+				t.Fatalf("response %+v", resp)
+			}
+
+			if backend.payments(hash) != test.paid {
+				t.Fatalf("paid %d times", backend.payments(hash))
+			}
+
+			if status := requestStatus(t, db, request.NostrId); status != REQUEST_EVENT_STATUS_DONE {
+				t.Fatalf("request is %s", status)
+			}
+		})
+	}
+}
+
+func TestPayKeysendPreimage(t *testing.T) {
+	pubkey := "02" + strings.Repeat("05", 32)
+
+	tests := []struct {
+		name    string
+		chooses bool  // the backend chooses the preimage
+		err     error // of the backend, the outcome is unknown
+	}{
+		{"chosen up front", false, nil},
+		{"chosen by the backend", true, nil},
+		{"chosen by the backend, interrupted", true, context.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := newTestDB(t)
+			backend := newFakeBackend()
+			backend.choosesPreimage = test.chooses
+			backend.keysendErr = test.err
+			user := NWCUser{Name: "jane", Backend: backend}
+			p := newTestParams(t, db, user)
+			c := newTestConnection(t, db, "jane")
+
+			request := receiveTestRequest(t, db, p, &user, newTestRequest(t, p, c, NIP47_PAY_KEYSEND_METHOD, Nip47PayKeysendParams{Amount: 1000, PubKey: pubkey}, time.Now()))
+
+			if test.err != nil {
+				// without a response until the outcome is known
+				runExecuter(t, db, p, user, 0)
+
+				// after a restart, a payment without a hash can't be
+				// looked up
+				responses := runExecuter(t, db, p, user, 1)
+
+				if resp := decryptResponse(t, p, c, responses[0]); resp.Error == nil || resp.Error.Code != NIP47_ERROR_OTHER {
+					t.Fatalf("response %+v", resp)
+				}
+
+				payment, err := p.ledger.FindByRequest(request.NostrId, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// the budget stays reserved
+				if payment.Status != PAYMENT_STATUS_PENDING || payment.PaymentHash != "" {
+					t.Fatalf("payment %+v", payment)
+				}
+
+				return
+			}
+
+			responses := runExecuter(t, db, p, user, 1)
+
+			var result Nip47PayInvoiceResult
+
+			resp := decryptResponse(t, p, c, responses[0])
+			if resp.Error != nil || json.Unmarshal(resp.Result, &result) != nil {
+				t.Fatalf("response %+v", resp)
+			}
+
+			if (backend.keysends[0].Preimage == "") != test.chooses {
+				t.Fatalf("keysend with preimage %q", backend.keysends[0].Preimage)
+			}
+
+			payment, err := p.ledger.FindByRequest(request.NostrId, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sum := sha256.Sum256(mustHex(result.Preimage))
+
+			// the hash of a preimage chosen by the backend is filled in
+			if payment.Status != PAYMENT_STATUS_SETTLED || payment.PaymentHash != hex.EncodeToString(sum[:]) || payment.Preimage != result.Preimage {
+				t.Fatalf("payment %+v", payment)
+			}
+		})
+	}
+}
+
+func TestCommitResponseEventError(t *testing.T) {
+	db := newTestDB(t)
+	user := NWCUser{Name: "jane", Backend: newFakeBackend()}
+	p := newTestParams(t, db, user)
+	c := newTestConnection(t, db, "jane")
+
+	request := receiveTestRequest(t, db, p, &user, newTestRequest(t, p, c, NIP47_GET_BUDGET_METHOD, struct{}{}, time.Now()))
+
+	if err := db.Migrator().DropTable("response_events"); err != nil {
+		t.Fatal(err)
+	}
+
+	response := newTestRequest(t, p, c, NIP47_GET_BUDGET_METHOD, struct{}{}, time.Now())
+	if _, err := CommitResponseEvent(db, p, &user, response, request.NostrId); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// without a response the request is executed again
+	if status := requestStatus(t, db, request.NostrId); status == REQUEST_EVENT_STATUS_DONE {
+		t.Fatalf("status %q", status)
+	}
+}
@@ -0,0 +1,227 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// the delay before connecting again to a relay that is down, it grows
+// with each failure up to RelayMaxBackoff
+var (
+	RelayMinBackoff = 3 * time.Second
+	RelayMaxBackoff = 5 * time.Minute
+)
+
+var ErrRelayBackoff = errors.New("relay is backed off")
+var ErrNotPublished = errors.New("no relay accepted the event")
+
+type relayBackoff struct {
+	failures int
+	retryAt time.Time
+}
+
+// Relays connects to relays through the pool, relays that are down are
+// skipped until their backoff has passed instead of blocking until they
+// are back. Relays of NWCParams.AuthRelays are authenticated with right
+// after connecting, others once they ask for it.
+type Relays struct {
+	p *NWCParams
+	pool *nostr.SimplePool
+
+	mu sync.Mutex
+	backoff map[string]*relayBackoff // by url
+	info map[string]bool // relays with the current info event
+	authed map[string]*nostr.Relay // by url, the authenticated connection
+}
+
+func NewRelays(ctx context.Context, p *NWCParams) *Relays {
+	return &Relays{
+		p: p,
+		pool: nostr.NewSimplePool(ctx, nostr.WithAuthHandler(AuthHandler(p.PrivateKey))),
+		backoff: make(map[string]*relayBackoff),
+		info: make(map[string]bool),
+		authed: make(map[string]*nostr.Relay),
+	}
+}
+
+// backoffDelay returns the delay after the number of failures, with
+// jitter so that relays that went down together are not retried at once.
+func backoffDelay(failures int) time.Duration {
+	delay := RelayMinBackoff
+
+	for i := 1; i < failures && delay < RelayMaxBackoff; i++ {
+		delay = delay * 17 / 10
+	}
+
+	if delay > RelayMaxBackoff {
+		delay = RelayMaxBackoff
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Relay returns the connected relay of the url, connecting to it unless
+// it's backed off.
+func (r *Relays) Relay(ctx context.Context, url string) (*nostr.Relay, error) {
+	r.mu.Lock()
+	b, ok := r.backoff[url]
+	if ok && time.Now().Before(b.retryAt) {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrRelayBackoff, url)
+	}
+	r.mu.Unlock()
+
+	relay, err := r.pool.EnsureRelay(url)
+
+	if err == nil {
+		err = r.authenticate(ctx, url, relay)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		if !ok {
+			b = &relayBackoff{}
+			r.backoff[url] = b
+		}
+
+		b.failures++
+		delay := backoffDelay(b.failures)
+		b.retryAt = time.Now().Add(delay)
+
+		// the info event is checked again once it's back
+		delete(r.info, url)
+
+		r.p.Logger.Warn().Err(err).Str("relay_url", url).Int("failures", b.failures).Dur("retry_in", delay).Msg("unable to connect")
+
+		return nil, err
+	}
+
+	if ok {
+		r.p.Logger.Info().Str("relay_url", url).Msg("connected")
+		delete(r.backoff, url)
+	}
+
+	return relay, nil
+}
+
+// authenticate authenticates with the relay once per connection if it's
+// one of the relays that require it.
+func (r *Relays) authenticate(ctx context.Context, url string, relay *nostr.Relay) error {
+	if !RequiresAuth(r.p.AuthRelays, url) {
+		return nil
+	}
+
+	r.mu.Lock()
+	authed := r.authed[url] == relay
+	r.mu.Unlock()
+
+	if authed {
+		return nil
+	}
+
+	if err := Authenticate(ctx, relay, r.p.PrivateKey); err != nil {
+		return err
+	}
+
+	r.p.Logger.Info().Str("relay_url", url).Msg("authenticated")
+
+	r.mu.Lock()
+	r.authed[url] = relay
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Publish publishes the event to every relay at once, it's published
+// once any relay accepts it.
+func (r *Relays) Publish(ctx context.Context, urls []string, event nostr.Event) error {
+	if len(urls) == 0 {
+		return ErrNotPublished
+	}
+
+	type result struct {
+		url string
+		err error
+	}
+
+	results := make(chan result, len(urls))
+
+	for _, url := range urls {
+		go func(url string) {
+			relay, err := r.Relay(ctx, url)
+
+			if err == nil {
+				pctx, cancel := context.WithTimeout(ctx, Timeout)
+				err = PublishWithAuth(pctx, relay, r.p.PrivateKey, event)
+				cancel()
+			}
+
+			results <- result{url: url, err: err}
+		}(url)
+	}
+
+	accepted := 0
+	var errs []error
+
+	for range urls {
+		res := <-results
+
+		if res.err != nil {
+			r.p.Logger.Debug().Err(res.err).Str("relay_url", res.url).Str("event_id", event.ID).Msg("not published")
+			errs = append(errs, fmt.Errorf("%s: %w", res.url, res.err))
+			continue
+		}
+
+		r.p.Logger.Debug().Str("relay_url", res.url).Str("event_id", event.ID).Msg("published")
+		accepted++
+	}
+
+	if accepted == 0 {
+		return fmt.Errorf("%w: %w", ErrNotPublished, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// PublishInfo publishes the info event to the relays that don't have the
+// current one, relays that are down are tried again on the next call.
+func (r *Relays) PublishInfo(ctx context.Context, urls []string) {
+	for _, url := range urls {
+		r.mu.Lock()
+		current := r.info[url]
+		r.mu.Unlock()
+
+		if current {
+			continue
+		}
+
+		relay, err := r.Relay(ctx, url)
+		if err != nil {
+			continue
+		}
+
+		info, err := GetNip47Info(ctx, r.p, relay)
+		if err != nil {
+			r.p.Logger.Warn().Err(err).Str("relay_url", url).Msg("could not get nwc info from relay")
+		}
+
+		if info != nil && InfoIsCurrent(r.p, info) {
+			r.p.Logger.Info().Str("relay_url", url).Str("info", info.ID).Msg("received info from relay")
+		} else if err := PublishNip47Info(ctx, r.p, relay); err != nil {
+			r.p.Logger.Warn().Err(err).Str("relay_url", url).Msg("could not publish info")
+			continue
+		}
+
+		r.mu.Lock()
+		r.info[url] = true
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,317 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// how often invoices without a live subscription are looked up
+	PollInterval = 5 * time.Second
+	// how often every pending invoice is looked up, in case a
+	// subscription missed a settlement while reconnecting
+	SweepInterval = 5 * time.Minute
+	// maximum number of concurrent backend lookups
+	PollConcurrency = 10
+)
+
+// Watch is an invoice waiting to be paid.
+type Watch struct {
+	User        string
+	Backend     Backend
+	PaymentHash string
+	ExpiresAt   time.Time
+	OnPaid      func(Settlement)
+	OnExpired   func()
+}
+
+// userSettlement is a settlement of one of the user's invoices.
+type userSettlement struct {
+	User string
+	Settlement
+}
+
+// Settler watches pending invoices and calls back once they are paid or
+// expired. Backends that can push settlements are subscribed to once
+// per user, everything else is looked up by a single shared poller.
+type Settler struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	settled chan userSettlement
+
+	mu          sync.Mutex
+	listeners   []func(user string, settlement Settlement)
+	pending     map[string]*Watch // by payment hash
+	subscribed  map[string]bool   // by user
+	live        map[string]bool   // by user, while connected
+	unsupported map[string]bool   // by user, without subscriptions
+}
+
+func NewSettler(ctx context.Context, logger *zerolog.Logger) *Settler {
+	st := &Settler{
+		ctx:         ctx,
+		logger:      logger,
+		settled:     make(chan userSettlement, 100),
+		pending:     make(map[string]*Watch),
+		subscribed:  make(map[string]bool),
+		live:        make(map[string]bool),
+		unsupported: make(map[string]bool),
+	}
+
+	go st.dispatch()
+	go st.poll()
+
+	return st
+}
+
+// Subscribe starts a settlement subscription for the user, if the
+// backend supports one.
+func (st *Settler) Subscribe(user string, backend Backend) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.subscribed[user] {
+		return
+	}
+	st.subscribed[user] = true
+
+	go st.runSubscription(user, backend)
+}
+
+// OnSettled calls the listener for every settlement of any user, also
+// of invoices that are not watched. The same settlement may be seen more
+// than once.
+func (st *Settler) OnSettled(listener func(user string, settlement Settlement)) {
+	st.mu.Lock()
+	st.listeners = append(st.listeners, listener)
+	st.mu.Unlock()
+}
+
+// Watch waits for the invoice to be paid.
+func (st *Settler) Watch(w Watch) {
+	st.mu.Lock()
+	st.pending[w.PaymentHash] = &w
+	st.mu.Unlock()
+
+	st.Subscribe(w.User, w.Backend)
+}
+
+func (st *Settler) setLive(user string, live bool) {
+	st.mu.Lock()
+	st.live[user] = live
+	st.mu.Unlock()
+}
+
+func (st *Settler) runSubscription(user string, backend Backend) {
+	interval := 3 * time.Second
+
+	for {
+		st.logger.Info().Str("user", user).Msg("subscribing to settlements")
+
+		started := time.Now()
+
+		st.setLive(user, true)
+		err := st.subscribe(user, backend)
+		st.setLive(user, false)
+
+		if errors.Is(err, ErrNotImplemented) {
+			st.mu.Lock()
+			st.unsupported[user] = true
+			st.mu.Unlock()
+			return
+		}
+
+		if st.ctx.Err() != nil {
+			return
+		}
+
+		st.logger.Warn().Err(err).Str("user", user).Msg("settlement subscription closed, polling until reconnected")
+
+		if time.Since(started) > time.Minute {
+			interval = 3 * time.Second
+		}
+
+		select {
+		case <-st.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		if interval < 5*time.Minute {
+			interval = interval * 17 / 10
+		}
+	}
+}
+
+// subscribe runs the backend subscription, tagging the settlements with
+// the user.
+func (st *Settler) subscribe(user string, backend Backend) error {
+	settled := make(chan Settlement)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for settlement := range settled {
+			select {
+			case st.settled <- userSettlement{User: user, Settlement: settlement}:
+			case <-st.ctx.Done():
+			}
+		}
+	}()
+
+	err := backend.SubscribeSettlements(st.ctx, settled)
+
+	close(settled)
+	<-done
+
+	return err
+}
+
+func (st *Settler) dispatch() {
+	for {
+		select {
+		case <-st.ctx.Done():
+			return
+		case us := <-st.settled:
+			settlement := us.Settlement
+
+			st.mu.Lock()
+			w, ok := st.pending[settlement.PaymentHash]
+			if ok && w.User != us.User {
+				ok = false
+			} else {
+				delete(st.pending, settlement.PaymentHash)
+			}
+			listeners := st.listeners
+			st.mu.Unlock()
+
+			for _, listener := range listeners {
+				go listener(us.User, settlement)
+			}
+
+			// not an invoice we are waiting for, or already handled
+			if !ok {
+				continue
+			}
+
+			st.logger.Info().Str("user", w.User).Str("payment_hash", w.PaymentHash).Msg("invoice paid")
+
+			if w.OnPaid != nil {
+				go w.OnPaid(settlement)
+			}
+		}
+	}
+}
+
+func (st *Settler) poll() {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	lastSweep := time.Now()
+
+	for {
+		select {
+		case <-st.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sweep := time.Since(lastSweep) >= SweepInterval
+		if sweep {
+			lastSweep = time.Now()
+		}
+
+		st.lookupPending(sweep)
+	}
+}
+
+// lookupPending looks up invoices of users without a live subscription,
+// or every pending invoice when sweeping, and drops expired invoices.
+func (st *Settler) lookupPending(sweep bool) {
+	now := time.Now()
+
+	var lookups []*Watch
+
+	st.mu.Lock()
+	for hash, w := range st.pending {
+		if now.After(w.ExpiresAt) {
+			st.logger.Debug().Str("payment_hash", hash).Msg("invoice expired")
+			delete(st.pending, hash)
+			if w.OnExpired != nil {
+				go w.OnExpired()
+			}
+			continue
+		}
+
+		if sweep || !st.live[w.User] {
+			lookups = append(lookups, w)
+		}
+	}
+	st.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(lookups))
+
+	// Create a buffered channel to control the number of active lookups
+	goroutines := make(chan struct{}, PollConcurrency)
+
+	for _, w := range lookups {
+		goroutines <- struct{}{}
+		go func(w *Watch) {
+			defer func() {
+				<-goroutines
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(st.ctx, Timeout)
+			defer cancel()
+
+			_, err := st.Lookup(ctx, w.User, w.Backend, w.PaymentHash)
+			if errors.Is(err, ErrNotImplemented) {
+				st.mu.Lock()
+				if st.unsupported[w.User] {
+					st.logger.Warn().Str("user", w.User).Str("payment_hash", w.PaymentHash).Msg("unable to watch invoice for backend")
+					delete(st.pending, w.PaymentHash)
+				}
+				st.mu.Unlock()
+				return
+			} else if err != nil {
+				st.logger.Debug().Err(err).Str("payment_hash", w.PaymentHash).Msg("unable to look up invoice")
+			}
+		}(w)
+	}
+
+	wg.Wait()
+}
+
+// Lookup looks up the invoice of the user with the backend, returning
+// its settlement or nil while it's not paid. Settlements are dispatched
+// as if received from a subscription, so that watches of the invoice
+// are called back once.
+func (st *Settler) Lookup(ctx context.Context, user string, backend Backend, paymentHash string) (*Settlement, error) {
+	tx, err := backend.LookupInvoice(ctx, paymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !tx.Settled {
+		return nil, nil
+	}
+
+	settlement := Settlement{
+		PaymentHash: paymentHash,
+		Preimage:    tx.Preimage,
+	}
+
+	select {
+	case st.settled <- userSettlement{User: user, Settlement: settlement}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return &settlement, nil
+}
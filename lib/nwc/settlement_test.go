@@ -0,0 +1,334 @@
+package nwc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/rs/zerolog"
+)
+
+// fakeBackend is a backend of invoices and payments kept in memory, its
+// subscription sends the settlements of the channel.
+type fakeBackend struct {
+	unsupportedBackend
+
+	mu        sync.Mutex
+	invoices  map[string]*Transaction // by payment hash
+	preimages map[string]string       // of invoices to pay, by payment hash
+	paid      map[string]int          // times paid, by payment hash
+	lookups   int
+
+	keysends        []KeysendParams
+	keysendErr      error // of every keysend
+	choosesPreimage bool  // of keysends
+
+	settlements chan Settlement // nil without a subscription
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		invoices:  make(map[string]*Transaction),
+		preimages: make(map[string]string),
+		paid:      make(map[string]int),
+	}
+}
+
+func (b *fakeBackend) Capabilities() []string {
+	return []string{NIP47_PAY_INVOICE_METHOD, NIP47_PAY_KEYSEND_METHOD, NIP47_LOOKUP_INVOICE_METHOD}
+}
+
+func (b *fakeBackend) payments(paymentHash string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.paid[paymentHash]
+}
+
+func (b *fakeBackend) PayInvoice(ctx context.Context, params PayParams) (*Transaction, error) {
+	bolt11, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.paid[bolt11.PaymentHash]++
+
+	tx := &Transaction{
+		Type:        "outgoing",
+		Invoice:     params.Invoice,
+		PaymentHash: bolt11.PaymentHash,
+		Preimage:    b.preimages[bolt11.PaymentHash],
+		Amount:      uint64(bolt11.MSatoshi),
+		CreatedAt:   uint(time.Now().Unix()),
+		SettledAt:   uint(time.Now().Unix()),
+		Settled:     true,
+	}
+
+	b.invoices[tx.PaymentHash] = tx
+
+	paid := *tx
+	return &paid, nil
+}
+
+func (b *fakeBackend) ChoosesKeysendPreimage() bool {
+	return b.choosesPreimage
+}
+
+func (b *fakeBackend) PayKeysend(ctx context.Context, params KeysendParams) (*Transaction, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.keysends = append(b.keysends, params)
+
+	if b.keysendErr != nil {
+		return nil, b.keysendErr
+	}
+
+	if params.Preimage == "" && !b.choosesPreimage {
+		return nil, errors.New("keysend without preimage")
+	}
+
+	preimage, hash, err := keysendPreimage(params.Preimage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transaction{
+		Type:        "outgoing",
+		PaymentHash: hex.EncodeToString(hash),
+		Preimage:    hex.EncodeToString(preimage),
+		Amount:      params.Amount,
+		CreatedAt:   uint(time.Now().Unix()),
+		SettledAt:   uint(time.Now().Unix()),
+		Settled:     true,
+	}, nil
+}
+
+func (b *fakeBackend) add(tx *Transaction) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.invoices[tx.PaymentHash] = tx
+}
+
+func (b *fakeBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lookups++
+
+	tx, ok := b.invoices[paymentHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	found := *tx
+	return &found, nil
+}
+
+func (b *fakeBackend) SubscribeSettlements(ctx context.Context, settled chan<- Settlement) error {
+	if b.settlements == nil {
+		return ErrNotImplemented
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case settlement := <-b.settlements:
+			if err := sendSettlement(ctx, settled, settlement); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func newTestSettler(t *testing.T) *Settler {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	logger := zerolog.Nop()
+
+	return NewSettler(ctx, &logger)
+}
+
+func waitPaid(t *testing.T, paid <-chan Settlement) Settlement {
+	t.Helper()
+
+	select {
+	case settlement := <-paid:
+		return settlement
+	case <-time.After(5 * time.Second):
+		t.Fatal("invoice was not paid")
+	}
+
+	return Settlement{}
+}
+
+// waitSettler waits until the condition on the state of the settler is
+// true.
+func waitSettler(t *testing.T, st *Settler, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		st.mu.Lock()
+		ok := cond()
+		st.mu.Unlock()
+
+		if ok {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("settler did not get to the state")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSettlerSubscription(t *testing.T) {
+	st := newTestSettler(t)
+
+	backend := newFakeBackend()
+	backend.settlements = make(chan Settlement)
+
+	paid := make(chan Settlement, 1)
+
+	st.Watch(Watch{
+		User:        "jane",
+		Backend:     backend,
+		PaymentHash: "aa",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		OnPaid:      func(s Settlement) { paid <- s },
+	})
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+
+	st.OnSettled(func(user string, s Settlement) {
+		mu.Lock()
+		seen[user+"/"+s.PaymentHash]++
+		mu.Unlock()
+	})
+
+	// of an invoice that isn't watched
+	backend.settlements <- Settlement{PaymentHash: "bb"}
+	backend.settlements <- Settlement{PaymentHash: "aa", Preimage: "cc"}
+
+	settlement := waitPaid(t, paid)
+	if settlement.Preimage != "cc" {
+		t.Fatalf("settlement %+v", settlement)
+	}
+
+	// settled once, the watch is done
+	backend.settlements <- Settlement{PaymentHash: "aa", Preimage: "cc"}
+
+	select {
+	case <-paid:
+		t.Fatal("invoice was paid twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// listeners see every settlement
+	if seen["jane/aa"] != 2 || seen["jane/bb"] != 1 {
+		t.Fatalf("listeners saw %v", seen)
+	}
+}
+
+func TestSettlerPolling(t *testing.T) {
+	st := newTestSettler(t)
+
+	// without a subscription the invoices are looked up
+	backend := newFakeBackend()
+	backend.add(&Transaction{PaymentHash: "aa"})
+
+	paid := make(chan Settlement, 1)
+	expired := make(chan struct{}, 1)
+
+	st.Watch(Watch{
+		User:        "jane",
+		Backend:     backend,
+		PaymentHash: "aa",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		OnPaid:      func(s Settlement) { paid <- s },
+	})
+
+	st.Watch(Watch{
+		User:        "jane",
+		Backend:     backend,
+		PaymentHash: "dd",
+		ExpiresAt:   time.Now().Add(-time.Second),
+		OnExpired:   func() { expired <- struct{}{} },
+	})
+
+	// the subscription is tried in the background
+	waitSettler(t, st, func() bool { return st.unsupported["jane"] })
+
+	st.lookupPending(false)
+
+	select {
+	case <-paid:
+		t.Fatal("unpaid invoice was paid")
+	case <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("invoice did not expire")
+	}
+
+	backend.add(&Transaction{PaymentHash: "aa", Preimage: "cc", Settled: true})
+
+	st.lookupPending(false)
+
+	settlement := waitPaid(t, paid)
+	if settlement.PaymentHash != "aa" || settlement.Preimage != "cc" {
+		t.Fatalf("settlement %+v", settlement)
+	}
+}
+
+func TestSettlerLiveSubscriptionNotPolled(t *testing.T) {
+	st := newTestSettler(t)
+
+	backend := newFakeBackend()
+	backend.settlements = make(chan Settlement)
+	backend.add(&Transaction{PaymentHash: "aa"})
+
+	st.Watch(Watch{
+		User:        "jane",
+		Backend:     backend,
+		PaymentHash: "aa",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	waitSettler(t, st, func() bool { return st.live["jane"] })
+
+	st.lookupPending(false)
+
+	backend.mu.Lock()
+	lookups := backend.lookups
+	backend.mu.Unlock()
+
+	if lookups != 0 {
+		t.Fatalf("looked up %d times", lookups)
+	}
+
+	// sweeps look up every invoice
+	st.lookupPending(true)
+
+	backend.mu.Lock()
+	lookups = backend.lookups
+	backend.mu.Unlock()
+
+	if lookups != 1 {
+		t.Fatalf("looked up %d times", lookups)
+	}
+}
@@ -0,0 +1,53 @@
+package nwc
+
+import (
+	"context"
+
+	"github.com/fiatjaf/makeinvoice"
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+)
+
+type SparkoBackend struct {
+	unsupportedBackend
+
+	Host string
+	Key  string
+}
+
+func init() {
+	RegisterBackend("sparko", func(c BackendConfig) Backend {
+		return &SparkoBackend{
+			Host: c.Host,
+			Key:  c.Key,
+		}
+	})
+}
+
+func (b *SparkoBackend) Capabilities() []string {
+	return []string{
+		NIP47_MAKE_INVOICE_METHOD,
+		NIP47_LOOKUP_INVOICE_METHOD,
+	}
+}
+
+func (b *SparkoBackend) MakeInvoice(ctx context.Context, params InvoiceParams) (*Transaction, error) {
+	return makeInvoiceWith(makeinvoice.SparkoParams{
+		Host: b.Host,
+		Key:  b.Key,
+	}, params)
+}
+
+func (b *SparkoBackend) LookupInvoice(ctx context.Context, paymentHash string) (*Transaction, error) {
+	spark := &lightning.Client{
+		SparkURL:    b.Host,
+		SparkToken:  b.Key,
+		CallTimeout: Timeout,
+	}
+
+	res, err := spark.CallNamed("listinvoices", "payment_hash", paymentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return clnLookupInvoice(res)
+}
@@ -0,0 +1,207 @@
+package nwc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TransactionRecord is a transaction of a user's wallet, kept so that
+// list_transactions is the same for every backend.
+type TransactionRecord struct {
+	ID              uint
+	User            string
+	Type            string // incoming or outgoing
+	Invoice         string
+	Description     string
+	DescriptionHash string
+	Preimage        string
+	PaymentHash     string
+	Amount          uint64 // msats
+	FeesPaid        uint64 // msats
+	CreatedAt       uint   // seconds
+	ExpiresAt       uint   // seconds
+	SettledAt       uint   // seconds
+	Settled         bool
+	UpdatedAt       time.Time
+}
+
+func (r *TransactionRecord) Transaction() Transaction {
+	return Transaction{
+		Type:            r.Type,
+		Invoice:         r.Invoice,
+		Description:     r.Description,
+		DescriptionHash: r.DescriptionHash,
+		Preimage:        r.Preimage,
+		PaymentHash:     r.PaymentHash,
+		Amount:          r.Amount,
+		FeesPaid:        r.FeesPaid,
+		CreatedAt:       r.CreatedAt,
+		ExpiresAt:       r.ExpiresAt,
+		SettledAt:       r.SettledAt,
+		Settled:         r.Settled,
+	}
+}
+
+// Transactions keeps the transactions of users, from the invoices made
+// and paid and the payments made with wallet connections.
+type Transactions struct {
+	db *gorm.DB
+}
+
+func NewTransactions(db *gorm.DB) *Transactions {
+	return &Transactions{db: db}
+}
+
+// Record adds the transaction of the user, or updates it once it's
+// settled.
+func (t *Transactions) Record(user string, tx *Transaction) error {
+	return recordTransaction(t.db, user, tx)
+}
+
+func recordTransaction(db *gorm.DB, user string, tx *Transaction) error {
+	if tx.PaymentHash == "" || tx.Type == "" {
+		return errors.New("transaction without payment hash or type")
+	}
+
+	var existing TransactionRecord
+
+	result := db.Table("transactions").
+		Where("user = ?", user).
+		Where("payment_hash = ?", tx.PaymentHash).
+		Where("type = ?", tx.Type).
+		Limit(1).
+		Find(&existing)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		record := TransactionRecord{
+			User:            user,
+			Type:            tx.Type,
+			Invoice:         tx.Invoice,
+			Description:     tx.Description,
+			DescriptionHash: tx.DescriptionHash,
+			Preimage:        tx.Preimage,
+			PaymentHash:     tx.PaymentHash,
+			Amount:          tx.Amount,
+			FeesPaid:        tx.FeesPaid,
+			CreatedAt:       tx.CreatedAt,
+			ExpiresAt:       tx.ExpiresAt,
+			SettledAt:       tx.SettledAt,
+			Settled:         tx.Settled,
+		}
+
+		if record.CreatedAt == 0 {
+			record.CreatedAt = uint(time.Now().Unix())
+		}
+
+		return db.Table("transactions").Create(&record).Error
+	}
+
+	if existing.Settled || !tx.Settled {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"settled":    true,
+		"settled_at": tx.SettledAt,
+		"preimage":   tx.Preimage,
+		"fees_paid":  tx.FeesPaid,
+	}
+
+	if tx.SettledAt == 0 {
+		updates["settled_at"] = uint(time.Now().Unix())
+	}
+
+	if tx.Amount > 0 {
+		updates["amount"] = tx.Amount
+	}
+
+	return db.Table("transactions").Where("id = ?", existing.ID).Updates(updates).Error
+}
+
+// List returns the transactions of the user matching the params, newest
+// first.
+func (t *Transactions) List(user string, params Nip47ListTransactionsParams) ([]Transaction, error) {
+	var records []TransactionRecord
+
+	query := t.db.Table("transactions").Where("user = ?", user)
+
+	if !params.Unpaid {
+		query = query.Where("settled = ?", true)
+	}
+
+	if params.Type != "" {
+		query = query.Where("type = ?", params.Type)
+	}
+
+	if params.From > 0 {
+		query = query.Where("created_at >= ?", params.From)
+	}
+
+	if params.Until > 0 {
+		query = query.Where("created_at <= ?", params.Until)
+	}
+
+	query = query.Order("created_at DESC").Order("id DESC")
+
+	if params.Offset > 0 {
+		query = query.Offset(int(params.Offset))
+	}
+
+	if params.Limit > 0 {
+		query = query.Limit(int(params.Limit))
+	}
+
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	txs := make([]Transaction, len(records))
+	for i := range records {
+		txs[i] = records[i].Transaction()
+	}
+
+	return txs, nil
+}
+
+// Import adds the transactions of the backend for users without any, so
+// that transactions from before they were recorded are listed.
+func (t *Transactions) Import(ctx context.Context, user *NWCUser) error {
+	var count int64
+
+	err := t.db.Table("transactions").Where("user = ?", user.Name).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	txs, err := user.Backend.ListTransactions(lctx, Nip47ListTransactionsParams{Unpaid: true})
+
+	if errors.Is(err, ErrNotImplemented) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return t.db.Transaction(func(db *gorm.DB) error {
+		for i := range txs {
+			if txs[i].PaymentHash == "" || txs[i].Failed {
+				continue
+			}
+
+			if err := recordTransaction(db, user.Name, &txs[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
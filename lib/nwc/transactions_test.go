@@ -0,0 +1,116 @@
+package nwc
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTransactionsList(t *testing.T) {
+	db := newTestDB(t)
+	transactions := NewTransactions(db)
+
+	records := []Transaction{
+		{Type: "incoming", PaymentHash: "a1", Amount: 1000, CreatedAt: 100, Settled: true},
+		{Type: "outgoing", PaymentHash: "b2", Amount: 2000, CreatedAt: 200, Settled: true},
+		{Type: "incoming", PaymentHash: "c3", Amount: 3000, CreatedAt: 300},
+		{Type: "outgoing", PaymentHash: "d4", Amount: 4000, CreatedAt: 400, Settled: true},
+		{Type: "incoming", PaymentHash: "e5", Amount: 5000, CreatedAt: 500, Settled: true},
+	}
+
+	for i := range records {
+		if err := transactions.Record("jane", &records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// of another user
+	if err := transactions.Record("bob", &Transaction{Type: "incoming", PaymentHash: "f6", CreatedAt: 600, Settled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		params Nip47ListTransactionsParams
+		hashes []string
+	}{
+		{"settled", Nip47ListTransactionsParams{}, []string{"e5", "d4", "b2", "a1"}},
+		{"unpaid", Nip47ListTransactionsParams{Unpaid: true}, []string{"e5", "d4", "c3", "b2", "a1"}},
+		{"incoming", Nip47ListTransactionsParams{Type: "incoming"}, []string{"e5", "a1"}},
+		{"outgoing", Nip47ListTransactionsParams{Type: "outgoing"}, []string{"d4", "b2"}},
+		{"from", Nip47ListTransactionsParams{From: 200}, []string{"e5", "d4", "b2"}},
+		{"until", Nip47ListTransactionsParams{Until: 400}, []string{"d4", "b2", "a1"}},
+		{"from until", Nip47ListTransactionsParams{From: 200, Until: 400, Unpaid: true}, []string{"d4", "c3", "b2"}},
+		{"limit", Nip47ListTransactionsParams{Limit: 2}, []string{"e5", "d4"}},
+		{"offset", Nip47ListTransactionsParams{Offset: 1, Limit: 2}, []string{"d4", "b2"}},
+		{"offset without limit", Nip47ListTransactionsParams{Offset: 3}, []string{"a1"}},
+		{"offset past the end", Nip47ListTransactionsParams{Offset: 10}, []string{}},
+		{"none in range", Nip47ListTransactionsParams{From: 1000}, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			txs, err := transactions.List("jane", test.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hashes := []string{}
+			for _, tx := range txs {
+				hashes = append(hashes, tx.PaymentHash)
+			}
+
+			if !slices.Equal(hashes, test.hashes) {
+				t.Fatalf("listed %v, expected %v", hashes, test.hashes)
+			}
+		})
+	}
+}
+
+func TestTransactionsRecordSettles(t *testing.T) {
+	db := newTestDB(t)
+	transactions := NewTransactions(db)
+
+	tests := []struct {
+		name    string
+		update  Transaction
+		settled bool
+		amount  uint64
+	}{
+		{"unsettled update", Transaction{Type: "incoming", PaymentHash: "a1", Amount: 2000}, false, 1000},
+		{"settled update", Transaction{Type: "incoming", PaymentHash: "a1", Amount: 2000, Preimage: "00", Settled: true}, true, 2000},
+		{"after settled", Transaction{Type: "incoming", PaymentHash: "a1", Amount: 3000, Settled: true}, true, 2000},
+	}
+
+	if err := transactions.Record("jane", &Transaction{Type: "incoming", PaymentHash: "a1", Amount: 1000, CreatedAt: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := transactions.Record("jane", &test.update); err != nil {
+				t.Fatal(err)
+			}
+
+			txs, err := transactions.List("jane", Nip47ListTransactionsParams{Unpaid: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(txs) != 1 {
+				t.Fatalf("listed %d transactions", len(txs))
+			}
+
+			if txs[0].Settled != test.settled || txs[0].Amount != test.amount {
+				t.Fatalf("settled %t amount %d", txs[0].Settled, txs[0].Amount)
+			}
+
+			if test.settled && txs[0].SettledAt == 0 {
+				t.Fatal("settled without settled_at")
+			}
+		})
+	}
+
+	if err := transactions.Record("jane", &Transaction{Type: "incoming"}); err == nil {
+		t.Fatal("recorded a transaction without payment hash")
+	}
+}
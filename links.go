@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// PaymentLink is a pay endpoint of the user besides their lightning
+// address, at /.well-known/lnurlp/<user>/<link>. Its description and
+// success action are used instead of the user's when set.
+type PaymentLink struct {
+	Name          string         `koanf:"name"`
+	Description   string         `koanf:"description"`
+	SuccessAction *SuccessAction `koanf:"successaction"`
+}
+
+// checkLinksConfig checks the payment links of the user's config.
+func checkLinksConfig(user User) error {
+	seen := make(map[string]bool)
+
+	for _, link := range user.Links {
+		if link.Name == "" {
+			return fmt.Errorf("link name is empty")
+		}
+
+		if url.PathEscape(link.Name) != link.Name {
+			return fmt.Errorf("link name %s is not a path segment", link.Name)
+		}
+
+		if seen[link.Name] {
+			return fmt.Errorf("duplicate link: %s", link.Name)
+		}
+		seen[link.Name] = true
+
+		if err := checkSuccessAction(link.SuccessAction); err != nil {
+			return fmt.Errorf("link %s: %w", link.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// getLinkParams returns the params of the user's payment link, or of the
+// user's lightning address when the link is empty. It's nil when either
+// is unknown.
+func getLinkParams(name string, link string) *UserParams {
+	params := getParams(name)
+	if params == nil || link == "" {
+		return params
+	}
+
+	for _, l := range userMap[name].Links {
+		if l.Name != link {
+			continue
+		}
+
+		params.Link = l.Name
+
+		if l.Description != "" {
+			params.Description = l.Description
+		}
+
+		if l.SuccessAction != nil {
+			params.SuccessAction = l.SuccessAction
+		}
+
+		return params
+	}
+
+	return nil
+}
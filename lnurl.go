@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fiatjaf/go-lnurl"
 	"github.com/gorilla/mux"
@@ -13,12 +15,12 @@ import (
 	decodepay "github.com/nbd-wtf/ln-decodepay"
 )
 
-var allowNostr bool = false
-var nostrPrivkeyHex string = ""
-var nostrPubkey string = ""
 var minSendable uint64 = 1000
 var maxSendable uint64 = 1000000000
-var CommentAllowed int = 2000
+
+// how long the verify url waits for the backend, within the write
+// timeout of the server
+var verifyLookupTimeout = 10 * time.Second
 
 type LNURLPayParamsCustom struct {
 	lnurl.LNURLResponse
@@ -34,47 +36,59 @@ type LNURLPayParamsCustom struct {
 	Metadata        lnurl.Metadata       `json:"-"`
 }
 
+// LNURLPayValuesCustom is the callback response with the verify url of
+// LUD-21.
 type LNURLPayValuesCustom struct {
+	lnurl.LNURLPayValues
+	Verify string `json:"verify,omitempty"`
+}
+
+// LNURLVerifyResponse is the response of the verify url (LUD-21), the
+// preimage is null until the invoice is settled.
+type LNURLVerifyResponse struct {
 	lnurl.LNURLResponse
-	SuccessAction      *lnurl.SuccessAction `json:"successAction"`
-	Routes             interface{}          `json:"routes"` // ignored
-	PR                 string               `json:"pr"`
-	Disposable         *bool                `json:"disposable,omitempty"`
-	Comment            string               `json:"comment"`
-	CreatedAt          time.Time            `json:"created_at"`
-	Paid               bool                 `json:"paid"`
-	PaidAt             time.Time            `json:"paid_at"`
-	From               string               `json:"from"`
-	ParsedInvoice      decodepay.Bolt11     `json:"-"`
-	PayerDataJSON      string               `json:"-"`
-	Nip57Receipt       nostr.Event          `json:"nip57Receipt"`
-	Nip57ReceiptRelays []string             `json:"nip57ReceiptRelays"`
-	AwaitInvoicePaid   bool                 `json:"awaitInvoicePaid"`
-	Sender             string               `json:"sender"`
-	Note               string               `json:"note"`
+	Settled  bool    `json:"settled"`
+	Preimage *string `json:"preimage"`
+	PR       string  `json:"pr"`
 }
 
-func handleLNURL(w http.ResponseWriter, r *http.Request) {
-	var response interface{}
+// PaymentRequest carries the state of a single LNURL-pay callback, from
+// the invoice through to the zap receipt and notifications. Every
+// callback gets its own value so that concurrent zaps never share state.
+type PaymentRequest struct {
+	Params     *UserParams
+	Msat       uint64
+	Comment    string
+	PayerData  *lnurl.PayerDataValues // nil without payer data
+	PayerDataJSON string            // as sent, committed to by the invoice
+	Preimage   []byte       // made for aes success actions, nil if made by the backend
+	ZapEvent   *nostr.Event // nil for regular payments
+	ZapRequest string       // serialized zap event, committed to by the invoice
+	Relays     []string     // relays to publish the zap receipt to
+	Receipt    *nostr.Event
+	Bolt11     string
+	Invoice    decodepay.Bolt11
+	Sender     string
+	Note       string
+	CreatedAt  time.Time
+}
 
+func handleLNURL(w http.ResponseWriter, r *http.Request) {
 	username := mux.Vars(r)["user"]
+	link := mux.Vars(r)["link"]
 	domain := s.Domain
 
-	params := getParams(username)
+	params := getLinkParams(username, link)
 	if params == nil {
-		log.Debug().Str("name", username).Str("domain", domain).Msg("failed to get name")
+		log.Debug().Str("name", username).Str("link", link).Str("domain", domain).Msg("failed to get name")
 		json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
 			"failed to get name %s@%s", username, domain)))
 		return
 	}
 
-	log.Info().Str("username", username).Str("domain", domain).Msg("got lnurl request")
+	log.Info().Str("username", username).Str("link", link).Str("domain", domain).Msg("got lnurl request")
 
 	if amount := r.URL.Query().Get("amount"); amount == "" {
-		// check if the receiver accepts comments
-		var commentLength int64 = 0
-		// TODO: support webhook comments
-
 		// convert configured sendable amounts to integer
 		minSendable, err := strconv.ParseInt(params.MinSendable, 10, 64)
 		// set defaults
@@ -86,24 +100,19 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 			maxSendable = 1000000000
 		}
 
-		// if a nostr private nsec key is set, set nostr nip57 flags
-		if len(s.NostrPrivateKey) > 0 {
-			//allows users to use nsec keys, work with hex internally.
-			//This can be any private key, not necessarily from the user.
-			nostrPrivkeyHex = DecodeBech32(s.NostrPrivateKey)
-			allowNostr = true
-			pk := nostrPrivkeyHex
-			pub, _ := nostr.GetPublicKey(pk)
-			nostrPubkey = pub
+		callback := fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, username)
+		if link != "" {
+			callback += "/" + link
 		}
 
 		json.NewEncoder(w).Encode(LNURLPayParamsCustom{
 			LNURLResponse:   lnurl.LNURLResponse{Status: "OK"},
-			Callback:        fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, username),
+			Callback:        callback,
 			MinSendable:     minSendable,
 			MaxSendable:     maxSendable,
 			EncodedMetadata: makeMetadata(params),
-			CommentAllowed:  commentLength,
+			CommentAllowed:  params.CommentAllowed,
+			PayerData:       payerDataSpec(params),
 			Tag:             "payRequest",
 			AllowsNostr:     allowNostr,
 			NostrPubKey:     nostrPubkey,
@@ -117,7 +126,8 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var comment = ""
-		var payerData lnurl.PayerDataValues
+		var payerData *lnurl.PayerDataValues
+		var payerDataJSON = ""
 		// nostr NIP-57
 		// the "nostr" query param has a zap request which is a nostr event
 		// that specifies which nostr note has been zapped.
@@ -125,157 +135,266 @@ func handleLNURL(w http.ResponseWriter, r *http.Request) {
 		// and whether the event has the necessary tags that we need (p and relays are necessary, e is optional)
 
 		zapEventQuery := r.FormValue("nostr")
-		var zapEvent nostr.Event
+		var zapEvent *nostr.Event
 		if len(zapEventQuery) > 0 {
-			err = json.Unmarshal([]byte(zapEventQuery), &zapEvent)
+			zapEvent = &nostr.Event{}
+			err = json.Unmarshal([]byte(zapEventQuery), zapEvent)
 			if err != nil {
-				log.Error().Err(err).Str("Couldn't parse nostr event: ", err.Error())
-			} else {
-				valid, err := zapEvent.CheckSignature()
-				if !valid || err != nil {
-					log.Error().Err(err).Str("Nostr NIP-57 zap event signature invalid: ", err.Error())
-					return
-				}
-				if len(zapEvent.Tags) == 0 || zapEvent.Tags.GetFirst([]string{"p"}) == nil {
-					log.Error().Err(err).Str("Nostr NIP-57 zap event validation error ", "")
-					return
-				}
+				log.Error().Err(err).Msg("couldn't parse nostr event")
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse("Couldn't parse nostr event."))
+				return
+			}
+
+			valid, err := zapEvent.CheckSignature()
+			if !valid || err != nil {
+				log.Error().Err(err).Msg("nostr NIP-57 zap event signature invalid")
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid zap request signature."))
+				return
 			}
+			if len(zapEvent.Tags) == 0 || zapEvent.Tags.GetFirst([]string{"p"}) == nil {
+				log.Error().Msg("nostr NIP-57 zap event validation error")
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid zap request."))
+				return
+			}
+
 			if len(zapEvent.Content) > 0 {
 				comment = zapEvent.Content
 				log.Debug().Str("NIP57 Comment received", comment).Msg("Comment")
 			}
-
 		}
 		//We can't handle comments and payerdata in NIP57 at the same time...
 
 		// If a comment is send with the Invoice, always use it (?)
 		regularcomment := r.FormValue("comment")
-		if len(regularcomment) > CommentAllowed {
-			log.Error().Err(err).Str("Comment is too long", err.Error())
+		if err := params.checkComment(regularcomment); err != nil {
+			log.Debug().Int("length", utf8.RuneCountInString(regularcomment)).Msg("comment rejected")
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(err.Error()))
 			return
 		}
 		if len(regularcomment) > 0 {
 			comment = regularcomment
 			log.Debug().Str("Comment received", comment).Msg("Comment")
 		}
-		// payer data, not used currently
+		// LUD-18 payer data, committed to by the invoice unless it's a
+		// zap, which commits to the zap request
 		payerdata := r.FormValue("payerdata")
 
-		if len(payerdata) > 0 {
-			err = json.Unmarshal([]byte(payerdata), &payerData)
+		if zapEvent == nil && len(params.PayerData) > 0 {
+			// without payer data only the mandatory fields are checked
+			sent := payerdata
+			if len(sent) == 0 {
+				sent = "{}"
+			}
+
+			values, err := parsePayerData(params, sent, time.Now())
 			if err != nil {
-				log.Error().Err(err).Str("Couldn't parse payerdata", err.Error())
+				log.Debug().Err(err).Msg("payer data rejected")
+				json.NewEncoder(w).Encode(lnurl.ErrorResponse(err.Error()))
+				return
 			}
+
+			if len(payerdata) > 0 {
+				payerData = values
+				payerDataJSON = payerdata
+			}
+		}
+
+		pr := &PaymentRequest{
+			Params:    params,
+			Msat:      msat,
+			Comment:   comment,
+			PayerData: payerData,
+			PayerDataJSON: payerDataJSON,
+			ZapEvent:  zapEvent,
+			CreatedAt: time.Now(),
 		}
 
 		//we outsource the second part in a function, we should do this for the first one too.
-		response, err = serveLNURLpSecond(w, params, username, msat, comment, payerData, zapEvent)
-		var payvaluescustom = response.(LNURLPayValuesCustom)
+		err = serveLNURLpSecond(pr)
 		if err != nil {
-			// there is a valid error response
-			json.NewEncoder(w).Encode(response)
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(err.Error()))
 			return
 		}
 
-		json.NewEncoder(w).Encode(lnurl.LNURLPayValues{
-			LNURLResponse: payvaluescustom.LNURLResponse,
-			PR:            payvaluescustom.PR,
-			Routes:        payvaluescustom.Routes,
-			SuccessAction: payvaluescustom.SuccessAction,
+		successAction, err := pr.successAction()
+		if err != nil {
+			log.Warn().Err(err).Str("username", username).Msg("invalid success action")
+			successAction = lnurl.Action(DefaultSuccessAction.Message, "")
+		}
+
+		json.NewEncoder(w).Encode(LNURLPayValuesCustom{
+			LNURLPayValues: lnurl.LNURLPayValues{
+				LNURLResponse: lnurl.LNURLResponse{Status: "OK"},
+				PR:            pr.Bolt11,
+				Routes:        make([]struct{}, 0),
+				SuccessAction: successAction,
+			},
+			Verify: fmt.Sprintf("https://%s/.well-known/lnurlp/%s/verify/%s", domain, username, pr.Invoice.PaymentHash),
 		})
 
-		//if we provided a nsec and the response contained zap information, we wait for the invoice to be paid
-		//in order to submit the zap on nostr
-		//also check for invoice paid for regular ln payments for nostr notificaitons
-		if payvaluescustom.AwaitInvoicePaid {
-			go WaitForInvoicePaid(payvaluescustom, params)
+		// wait for the invoice to be paid in order to submit the zap on
+		// nostr and to send notifications for regular payments
+		watchInvoice(pr)
+	}
+}
+
+// handleVerify serves the settlement of invoices made by the callback
+// (LUD-21). Pending invoices are looked up with the backend, in case it
+// was paid since it was last watched.
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["user"]
+	paymentHash := mux.Vars(r)["payment_hash"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	params := getParams(username)
+	if params == nil {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Not found"))
+		return
+	}
+
+	inv, err := getInvoice(paymentHash)
+	if err != nil {
+		log.Error().Err(err).Str("payment_hash", paymentHash).Msg("error loading invoice")
+		w.WriteHeader(500)
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Couldn't load invoice."))
+		return
+	}
+
+	if inv == nil || inv.User != username {
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Not found"))
+		return
+	}
+
+	// an invoice is marked expired once its expiry has passed, though it
+	// may have been paid just before
+	unsettled := inv.Status == INVOICE_STATUS_PENDING || inv.Status == INVOICE_STATUS_EXPIRED
+
+	if unsettled && params.Backend != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), verifyLookupTimeout)
+		defer cancel()
+
+		settlement, err := settler.Lookup(ctx, username, params.Backend, paymentHash)
+		if err != nil {
+			log.Debug().Err(err).Str("payment_hash", paymentHash).Msg("unable to look up invoice")
+		} else if settlement != nil {
+			// the preimage of aes actions is saved with the invoice
+			preimage := settlement.Preimage
+			if preimage == "" {
+				preimage = inv.Preimage
+			}
+
+			if err := settleInvoice(paymentHash, preimage); err != nil {
+				log.Error().Err(err).Str("payment_hash", paymentHash).Msg("unable to settle invoice")
+			}
+
+			inv.Status = INVOICE_STATUS_SETTLED
+			inv.Preimage = preimage
 		}
 	}
+
+	res := LNURLVerifyResponse{
+		LNURLResponse: lnurl.LNURLResponse{Status: "OK"},
+		Settled:       inv.Status == INVOICE_STATUS_SETTLED,
+		PR:            inv.Bolt11,
+	}
+
+	if res.Settled && inv.Preimage != "" {
+		res.Preimage = &inv.Preimage
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// checkComment checks the comment against the length advertised in
+// commentAllowed (LUD-12), comments are not accepted when it's 0.
+func (params *UserParams) checkComment(comment string) error {
+	length := int64(utf8.RuneCountInString(comment))
+
+	if length == 0 {
+		return nil
+	}
+
+	if params.CommentAllowed == 0 {
+		return fmt.Errorf("Comments are not accepted.")
+	}
+
+	if length > params.CommentAllowed {
+		return fmt.Errorf("Comment is too long (max: %d characters).", params.CommentAllowed)
+	}
+
+	return nil
 }
 
-func serveLNURLpSecond(w http.ResponseWriter, params *UserParams, username string, amount_msat uint64, comment string, payerData lnurl.PayerDataValues, zapEvent nostr.Event) (LNURLPayValuesCustom, error) {
-	log.Debug().Any("Serving invoice for user %s", username)
-	if amount_msat < minSendable || amount_msat > maxSendable {
+func serveLNURLpSecond(pr *PaymentRequest) error {
+	log.Debug().Str("username", pr.Params.Name).Msg("serving invoice")
+	if pr.Msat < minSendable || pr.Msat > maxSendable {
 		// amount is not ok
-		return LNURLPayValuesCustom{
-			LNURLResponse: lnurl.LNURLResponse{
-				Status: "Error",
-				Reason: fmt.Sprintf("Amount out of bounds (min: %d sat, max: %d sat).", minSendable/1000, maxSendable/1000)},
-		}, fmt.Errorf("amount out of bounds")
+		return fmt.Errorf("Amount out of bounds (min: %d sat, max: %d sat).", minSendable/1000, maxSendable/1000)
 	}
 
 	// NIP57 ZAPs
 	// for nip57 use the nostr event as the descriptionHash
-	if zapEvent.Sig != "" {
-
+	if pr.ZapEvent != nil {
 		// we calculate the descriptionHash here, create an invoice with it
 		// and store the invoice in the zap receipt later down the line
-		zapEventSerialized, err := json.Marshal(zapEvent)
-		zapEventSerializedStr = fmt.Sprintf("%s", zapEventSerialized)
+		zapEventSerialized, err := json.Marshal(pr.ZapEvent)
 		if err != nil {
-			return LNURLPayValuesCustom{
-				LNURLResponse: lnurl.LNURLResponse{
-					Status: "Error",
-					Reason: "Couldn't serialize zap event."},
-			}, err
+			log.Error().Err(err).Msg("couldn't serialize zap event")
+			return fmt.Errorf("Couldn't serialize zap event.")
 		}
-		// we extract the relays from the zap request
-		nip57ReceiptRelays = ExtractNostrRelays(zapEvent)
+		pr.ZapRequest = string(zapEventSerialized)
 
+		// we extract the relays from the zap request
+		pr.Relays = ExtractNostrRelays(*pr.ZapEvent)
 	} else {
 		//If we have a regular call, we ignore zapEvent in makeinvoice later.
-		zapEventSerializedStr = ""
 		log.Debug().Str("Regular Invoice", "Not an NIP57 event").Msg("Note")
 	}
 
-	var response LNURLPayValuesCustom
-	invoice, err := makeInvoice(params, amount_msat, zapEventSerializedStr, comment)
-	if err != nil {
-		err = fmt.Errorf("couldn't create invoice: %v", err.Error())
-		response = LNURLPayValuesCustom{
-			LNURLResponse: lnurl.LNURLResponse{
-				Status: "Error",
-				Reason: "Couldn't create invoice."},
+	// LUD-10, the plaintext is encrypted with the preimage
+	if action := pr.Params.SuccessAction; action != nil && action.Tag == SUCCESS_ACTION_AES {
+		preimage, err := newPreimage()
+		if err != nil {
+			log.Error().Err(err).Msg("couldn't make preimage")
+			return fmt.Errorf("Couldn't create invoice.")
 		}
-		return response, err
+		pr.Preimage = preimage
+	}
+
+	_, err := makeInvoice(pr)
+	if err != nil {
+		log.Error().Err(err).Msg("couldn't create invoice")
+		return fmt.Errorf("Couldn't create invoice.")
 	}
 
-	//Check invoice paid only if we actually have a NIP57 event
-	var awaitPaid = true
-	var sender = ""
-	var note = ""
 	// nip57 - we need to store the newly created invoice in the zap receipt
-	if zapEvent.Sig != "" {
-		// TODO: Handle the err
-		nip57Receipt, err = CreateNostrReceipt(zapEvent, invoice)
-		sender = "@" + EncodeBech32Public(zapEvent.PubKey)
-		if zapEvent.Tags.GetFirst([]string{"e"}) != nil {
-			note = "@" + EncodeBech32Note(zapEvent.Tags.GetFirst([]string{"e"}).Value())
-		}
-		if zapEvent.Tags.GetFirst([]string{"anon"}) != nil {
-			if zapEvent.Tags.GetFirst([]string{"anon"}).Value() == "" {
-				sender = "anonymous Zapper 🤙"
-			}
+	if pr.ZapEvent != nil {
+		receipt, err := CreateNostrReceipt(*pr.ZapEvent, pr.Bolt11)
+		if err != nil {
+			log.Error().Err(err).Msg("couldn't create zap receipt")
+			return fmt.Errorf("Couldn't create zap receipt.")
 		}
-		log.Debug().Str("Zap from", sender).Msg("Nostr")
+		pr.Receipt = &receipt
+		pr.describeZap()
+		log.Debug().Str("Zap from", pr.Sender).Msg("Nostr")
 	}
 
-	decoded_invoice, _ := decodepay.Decodepay(invoice)
-	return LNURLPayValuesCustom{
-		LNURLResponse:      lnurl.LNURLResponse{Status: "OK"},
-		PR:                 invoice,
-		Routes:             make([]struct{}, 0),
-		SuccessAction:      &lnurl.SuccessAction{Message: "Payment Received!", Tag: "message"},
-		Comment:            comment,
-		Paid:               false,
-		CreatedAt:          time.Now(),
-		ParsedInvoice:      decoded_invoice,
-		Nip57Receipt:       nip57Receipt,
-		Nip57ReceiptRelays: nip57ReceiptRelays,
-		AwaitInvoicePaid:   awaitPaid,
-		Sender:             sender,
-		Note:               note,
-	}, nil
+	return nil
+}
 
+// describeZap sets the sender and note used in notifications from the
+// zap request.
+func (pr *PaymentRequest) describeZap() {
+	pr.Sender = "@" + EncodeBech32Public(pr.ZapEvent.PubKey)
+	if eTag := pr.ZapEvent.Tags.GetFirst([]string{"e"}); eTag != nil {
+		pr.Note = "@" + EncodeBech32Note(eTag.Value())
+	}
+	if anonTag := pr.ZapEvent.Tags.GetFirst([]string{"anon"}); anonTag != nil {
+		if anonTag.Value() == "" {
+			pr.Sender = "anonymous Zapper 🤙"
+		}
+	}
 }
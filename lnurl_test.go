@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	nwc "github.com/braydonf/go-nwc"
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestZap returns a zap request to the recipient signed by a new key.
+func newTestZap(t testing.TB, recipient string, msat uint64, content string) *nostr.Event {
+	t.Helper()
+
+	zap := &nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      9734,
+		Tags: nostr.Tags{
+			{"p", recipient},
+			{"amount", fmt.Sprint(msat)},
+			{"relays"},
+		},
+		Content: content,
+	}
+
+	if err := zap.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Error(err)
+	}
+
+	return zap
+}
+
+// checkZap checks that the invoice and the receipt of the payment request
+// are of its own zap request.
+func checkZap(t *testing.T, pr *PaymentRequest) {
+	t.Helper()
+
+	var zap nostr.Event
+	if err := json.Unmarshal([]byte(pr.ZapRequest), &zap); err != nil {
+		t.Fatal(err)
+	}
+
+	if zap.ID != pr.ZapEvent.ID {
+		t.Fatalf("zap request %s is not of zap %s", zap.ID, pr.ZapEvent.ID)
+	}
+
+	if amount := zap.Tags.GetFirst([]string{"amount"}); amount == nil || amount.Value() != fmt.Sprint(pr.Invoice.MSatoshi) {
+		t.Fatalf("invoice of %d msat is of zap %v", pr.Invoice.MSatoshi, zap.Tags)
+	}
+
+	if pr.Invoice.DescriptionHash != Nip57DescriptionHash(pr.ZapRequest) {
+		t.Fatalf("invoice %s does not commit to its zap request", pr.Invoice.PaymentHash)
+	}
+
+	receipt := pr.Receipt
+
+	if ok, _ := receipt.CheckSignature(); !ok || receipt.PubKey != nostrPubkey {
+		t.Fatalf("receipt %s is not signed by the server", receipt.ID)
+	}
+
+	if description := receipt.Tags.GetFirst([]string{"description"}); description == nil || description.Value() != pr.ZapRequest {
+		t.Fatalf("receipt of %s is not of its zap request", pr.Invoice.PaymentHash)
+	}
+
+	if bolt11 := receipt.Tags.GetFirst([]string{"bolt11"}); bolt11 == nil || bolt11.Value() != pr.Bolt11 {
+		t.Fatalf("receipt of %s is not of its invoice", pr.Invoice.PaymentHash)
+	}
+}
+
+// TestConcurrentZaps makes invoices for many zap requests at once and
+// pays them, each receipt must be of its own zap request and invoice,
+// also once rebuilt from the store.
+func TestConcurrentZaps(t *testing.T) {
+	setupTest(t)
+
+	const zaps = 300
+
+	backend := newTestBackend()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settler = nwc.NewSettler(ctx, &log)
+	settler.Subscribe("jane", backend)
+
+	params := &UserParams{Name: "jane", Domain: "example.com", Kind: "lnd", Backend: backend}
+	recipient, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prs := make([]*PaymentRequest, zaps)
+
+	var wg sync.WaitGroup
+
+	for i := range prs {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			msat := uint64(1000 * (i + 1))
+
+			pr := &PaymentRequest{
+				Params:    params,
+				Msat:      msat,
+				ZapEvent:  newTestZap(t, recipient, msat, fmt.Sprintf("zap %d", i)),
+				CreatedAt: time.Now(),
+			}
+
+			if err := serveLNURLpSecond(pr); err != nil {
+				t.Error(err)
+				return
+			}
+
+			prs[i] = pr
+
+			watchInvoice(pr)
+			backend.pay(pr.Invoice.PaymentHash)
+		}(i)
+	}
+
+	wg.Wait()
+
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	for _, pr := range prs {
+		checkZap(t, pr)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		var settled int64
+		if err := invoiceDB.Table("invoices").Where("status = ?", INVOICE_STATUS_SETTLED).Count(&settled).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if settled == zaps {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d invoices settled", settled, zaps)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var invoices []Invoice
+	if err := invoiceDB.Table("invoices").Find(&invoices).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invoices) != zaps {
+		t.Fatalf("%d of %d invoices saved", len(invoices), zaps)
+	}
+
+	for _, inv := range invoices {
+		pr, err := inv.paymentRequest(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if uint64(pr.Invoice.MSatoshi) != inv.Msat {
+			t.Fatalf("invoice of %d msat saved with %d msat", pr.Invoice.MSatoshi, inv.Msat)
+		}
+
+		checkZap(t, pr)
+
+		preimage, _ := hex.DecodeString(inv.Preimage)
+		if hash := sha256.Sum256(preimage); hex.EncodeToString(hash[:]) != inv.PaymentHash {
+			t.Fatalf("invoice %s settled with preimage %s", inv.PaymentHash, inv.Preimage)
+		}
+	}
+}
+
+// TestLinkSuccessAction makes invoices of the lightning address and of a
+// payment link, the link's aes action is encrypted with the preimage of
+// its invoice, also once rebuilt from the store.
+func TestLinkSuccessAction(t *testing.T) {
+	setupTest(t)
+
+	backend := newTestBackend()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	settler = nwc.NewSettler(ctx, &log)
+
+	s.Domain = "example.com"
+	userMap["jane"] = User{
+		Name:          "jane",
+		Kind:          "lnd",
+		SuccessAction: &SuccessAction{Tag: SUCCESS_ACTION_MESSAGE, Message: "Thanks!"},
+		Links: []PaymentLink{{
+			Name:          "ebook",
+			SuccessAction: &SuccessAction{Tag: SUCCESS_ACTION_AES, Plaintext: "{{ .Link }} of {{ .Sats }} sats"},
+		}},
+	}
+	backendMap["jane"] = backend
+
+	t.Cleanup(func() {
+		delete(userMap, "jane")
+		delete(backendMap, "jane")
+	})
+
+	callback := func(link string) *lnurl.SuccessAction {
+		t.Helper()
+
+		r := httptest.NewRequest("GET", "/.well-known/lnurlp/jane?amount=21000", nil)
+		r = mux.SetURLVars(r, map[string]string{"user": "jane", "link": link})
+		w := httptest.NewRecorder()
+
+		handleLNURL(w, r)
+
+		var values LNURLPayValuesCustom
+		if err := json.Unmarshal(w.Body.Bytes(), &values); err != nil || values.Status != "OK" {
+			t.Fatalf("response %s", w.Body.String())
+		}
+
+		return values.SuccessAction
+	}
+
+	if action := callback(""); action.Tag != SUCCESS_ACTION_MESSAGE || action.Message != "Thanks!" {
+		t.Fatalf("success action %+v", action)
+	}
+
+	action := callback("ebook")
+	if action.Tag != SUCCESS_ACTION_AES {
+		t.Fatalf("success action %+v", action)
+	}
+
+	var inv Invoice
+	if err := invoiceDB.Table("invoices").Where("link = ?", "ebook").First(&inv).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	backend.mu.Lock()
+	preimage, _ := hex.DecodeString(backend.preimages[inv.PaymentHash])
+	backend.mu.Unlock()
+
+	if plaintext, err := action.Decipher(preimage); err != nil || plaintext != "ebook of 21 sats" {
+		t.Fatalf("plaintext %q: %v", plaintext, err)
+	}
+
+	// the preimage is saved with the invoice, before it's paid
+	if inv.Preimage != hex.EncodeToString(preimage) {
+		t.Fatalf("invoice %s saved with preimage %q", inv.PaymentHash, inv.Preimage)
+	}
+
+	pr, err := inv.paymentRequest(getLinkParams(inv.User, inv.Link))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, err := pr.successAction()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext, err := rebuilt.Decipher(preimage); err != nil || plaintext != "ebook of 21 sats" {
+		t.Fatalf("rebuilt plaintext %q: %v", plaintext, err)
+	}
+
+	if params := getLinkParams("jane", "unknown"); params != nil {
+		t.Fatalf("params of unknown link %+v", params)
+	}
+}
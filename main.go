@@ -7,10 +7,10 @@ import (
 	"fmt"
 	"html/template"
 	"path/filepath"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"strconv"
 	"strings"
@@ -21,7 +21,6 @@ import (
 	"github.com/fiatjaf/makeinvoice"
 	nwc "github.com/braydonf/go-nwc"
 	"github.com/gorilla/mux"
-	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
@@ -34,6 +33,7 @@ import (
 
 type UserParams struct {
 	Name   string `json:"name"`
+	Link   string `json:"link"` // payment link, empty for the lightning address
 	Domain string `json:"domain"`
 	Kind   string `json:"kind"`
 
@@ -47,15 +47,28 @@ type UserParams struct {
 	MinSendable string `json:"minSendable"`
 	MaxSendable string `json:"maxSendable"`
 
+	Description     string `json:"description"`     // text/plain of the metadata
+	LongDescription string `json:"longDescription"` // text/long-desc of the metadata
+
+	CommentAllowed int64 `json:"commentAllowed"` // characters, LUD-12
+	PayerData map[string]string `json:"payerData"` // by field, optional or mandatory, LUD-18
+	SuccessAction *SuccessAction `json:"successAction"` // LUD-09 and LUD-10, nil for the default
+
 	Npub             string `json:"npub"`
 	NotifyZaps       bool   `json:"notifyzaps"`
 	NotifyZapComment bool   `json:"notifycomments"`
 	NotifyNonZap     bool   `json:"notifynonzaps"`
-	Image            struct {
-		DataURI string
-		Bytes   []byte
-		Ext     string
-	}
+
+	Backend nwc.Backend `json:"-"`
+
+	Image UserImage
+}
+
+// UserImage is the image of the LNURL metadata.
+type UserImage struct {
+	DataURI string
+	Bytes   []byte
+	Ext     string
 }
 
 type User struct {
@@ -63,12 +76,48 @@ type User struct {
 	Kind string `koanf:"kind"`
 	Host string `koanf:"host"`
 	Key string `koanf:"key"`
+	AdminKey string `koanf:"adminkey"`
 	Pak string `koanf:"pak"`
 	Waki string `koanf:"waki"`
 	NodeId string `koanf:"nodeid"`
 	Rune string `koanf:"rune"`
 	NWCSecret string `koanf:"nwcsecret"`
 	NWCRelay string `koanf:"nwcrelay"`
+	NWCRelays []string `koanf:"nwcrelays"`
+	NWCMethods []string `koanf:"nwcmethods"`
+	NWCMaxAmount uint64 `koanf:"nwcmaxamount"` // sats
+	NWCMaxFee uint64 `koanf:"nwcmaxfee"` // sats
+	NWCBudget uint64 `koanf:"nwcbudget"` // sats
+	NWCBudgetRenewal string `koanf:"nwcbudgetrenewal"`
+	CommentAllowed int64 `koanf:"commentallowed"`
+	PayerData map[string]string `koanf:"payerdata"`
+	SuccessAction *SuccessAction `koanf:"successaction"`
+	Links []PaymentLink `koanf:"links"`
+	Description string `koanf:"description"`
+	LongDescription string `koanf:"longdescription"`
+	Image string `koanf:"image"` // path or url
+	NostrAvatar bool `koanf:"nostravatar"`
+	Npub string `koanf:"npub"`
+	NotifyZaps bool `koanf:"notifyzaps"`
+	NotifyZapComment bool `koanf:"notifycomments"`
+	NotifyNonZap bool `koanf:"notifynonzaps"`
+}
+
+// nwcRelays returns the relays of nwcrelay and nwcrelays.
+func (u User) nwcRelays() []string {
+	var relays []string
+
+	if u.NWCRelay != "" {
+		relays = append(relays, u.NWCRelay)
+	}
+
+	for _, relay := range u.NWCRelays {
+		if relay != "" && !slices.Contains(relays, relay) {
+			relays = append(relays, relay)
+		}
+	}
+
+	return relays
 }
 
 type Settings struct {
@@ -83,6 +132,8 @@ type Settings struct {
 	NostrPrivateKey    string `koanf:"nostrprivatekey"`
 	DataDir string `koanf:"datadir"`
 	NWC bool `koanf:"nwc"`
+	NWCMaxRequestAge time.Duration `koanf:"nwcmaxrequestage"`
+	RelayAuth []string `koanf:"relayauth"`
 	LogLevel string `koanf:"loglevel"`
 }
 
@@ -97,6 +148,13 @@ var (
 	// Username lookup map.
 	userMap = make(map[string]User)
 
+	// Backend by username.
+	backendMap = make(map[string]nwc.Backend)
+
+	// LNURL metadata image by username, loaded once at startup so that
+	// the metadata is the same for every invoice.
+	imageMap = make(map[string]UserImage)
+
 	router = mux.NewRouter()
 	log    = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: os.Stderr})
 )
@@ -119,20 +177,6 @@ type Response struct {
 	Data    interface{} `json:"data"`
 }
 
-func randomString(len int) string {
-	bytes := make([]byte, len)
-
-	for i := 0; i < len; i++ {
-		bytes[i] = byte(randInt(97, 122))
-	}
-
-	return string(bytes)
-}
-
-func randInt(min int, max int) int {
-	return min + rand.Intn(max-min)
-}
-
 func sendError(w http.ResponseWriter, code int, msg string, args ...interface{}) {
 	b, _ := json.Marshal(Response{false, fmt.Sprintf(msg, args...), nil})
 	w.Header().Set("Content-Type", "application/json")
@@ -155,6 +199,17 @@ func getParams(name string) (*UserParams) {
 		params.Waki = user.Waki
 		params.NodeId = user.NodeId
 		params.Rune = user.Rune
+		params.Npub = user.Npub
+		params.NotifyZaps = user.NotifyZaps
+		params.NotifyZapComment = user.NotifyZapComment
+		params.NotifyNonZap = user.NotifyNonZap
+		params.CommentAllowed = user.CommentAllowed
+		params.PayerData = user.PayerData
+		params.SuccessAction = user.SuccessAction
+		params.Description = user.Description
+		params.LongDescription = user.LongDescription
+		params.Image = imageMap[user.Name]
+		params.Backend = backendMap[user.Name]
 	} else {
 		return nil
 	}
@@ -162,13 +217,7 @@ func getParams(name string) (*UserParams) {
 	return &params
 }
 
-func init() {
-    rand.Seed(time.Now().UnixNano())
-}
-
 func main() {
-	cache := expirable.NewLRU[string, string](100, nil, time.Millisecond * 1000 * 10)
-
 	f := flag.NewFlagSet("conf", flag.ContinueOnError)
 	f.Usage = func() {
 		fmt.Println(f.FlagUsages())
@@ -226,6 +275,7 @@ func main() {
 
 	if s.TorProxyURL != "" {
 		makeinvoice.TorProxyURL = s.TorProxyURL
+		nwc.TorProxyURL = s.TorProxyURL
 	}
 
 	// Load templates.
@@ -244,52 +294,148 @@ func main() {
 
 	// Setup username lookup map.
 	for _, user := range s.Users {
+		if err := checkPayerDataConfig(user); err != nil {
+			log.Fatal().Err(err).Str("user", user.Name).Msg("invalid config")
+		}
+
+		if err := checkSuccessActionConfig(user); err != nil {
+			log.Fatal().Err(err).Str("user", user.Name).Msg("invalid config")
+		}
+
+		if err := checkLinksConfig(user); err != nil {
+			log.Fatal().Err(err).Str("user", user.Name).Msg("invalid config")
+		}
+
 		userMap[user.Name] = user
 	}
 
-	pubkey, err := nostr.GetPublicKey(s.NostrPrivateKey)
-	if err != nil {
+	// Setup backends.
+	for _, user := range s.Users {
+		backend, err := nwc.NewBackend(nwc.BackendConfig{
+			Kind: user.Kind,
+			Host: user.Host,
+			Key: user.Key,
+			AdminKey: user.AdminKey,
+			Pak: user.Pak,
+			Waki: user.Waki,
+			NodeId: user.NodeId,
+			Rune: user.Rune,
+		})
+
+		if err != nil {
+			log.Fatal().Err(err).Str("user", user.Name).Msg("error loading backend")
+		}
+
+		backendMap[user.Name] = backend
+	}
+
+	// Setup LNURL metadata images.
+	for _, user := range s.Users {
+		params := getParams(user.Name)
+
+		var err error
+		if strings.HasPrefix(user.Image, "https://") || strings.HasPrefix(user.Image, "http://") {
+			err = addImageToProfile(params, user.Image)
+		} else if user.Image != "" {
+			err = addImageFileToProfile(params, user.Image)
+		} else if user.NostrAvatar && user.Npub != "" {
+			err = addNostrAvatarToProfile(params)
+		} else {
+			continue
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Str("user", user.Name).Msg("unable to load image")
+			continue
+		}
+
+		imageMap[user.Name] = params.Image
+	}
+
+	if err := setupNostrKeys(s.NostrPrivateKey); err != nil {
 		log.Fatal().Err(err).Msg("unable to get pubkey")
 	}
 
-	log.Info().Str("pubkey", pubkey).Msg("starting nostr with pubkey")
+	log.Info().Str("pubkey", nostrPubkey).Msg("starting nostr with pubkey")
 
-	// Setup NWC daemon.
+	absdatadir, err := filepath.Abs(s.DataDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("absolute path required for datadir")
+	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, os.Kill)
 	defer cancel()
 
+	// Setup invoice settlement.
+
+	settler = nwc.NewSettler(ctx, &log)
+
+	for _, user := range s.Users {
+		settler.Subscribe(user.Name, backendMap[user.Name])
+	}
+
+	// Setup invoice store and resume watching unpaid invoices.
+
+	invoicedbpath := filepath.Join(absdatadir, "invoices.db")
+
+	log.Info().Str("dbpath", invoicedbpath).Msg("using invoice database file")
+
+	if err := openInvoiceStore(invoicedbpath); err != nil {
+		log.Fatal().Err(err).Msg("error loading invoice database")
+	}
+
+	resumePendingInvoices()
+
+	// Setup NWC daemon.
+
+	// closed once nwc has finished the requests being executed
+	nwcDone := make(chan struct{})
+
 	if s.NWC {
-		absdatadir, err := filepath.Abs(s.DataDir)
-		if err != nil {
-			log.Fatal().Err(err).Msg("absolute path required for datadir")
-		}
 		dbpath := filepath.Join(absdatadir, "nwc.db")
 
 		nwcParams := nwc.NWCParams {
-			PrivateKey: s.NostrPrivateKey,
-			PublicKey: pubkey,
+			PrivateKey: nostrPrivkeyHex,
+			PublicKey: nostrPubkey,
 			Users: make([]nwc.NWCUser, len(s.Users)),
 			Logger: &log,
 			DBPath: dbpath,
+			MaxRequestAge: s.NWCMaxRequestAge,
+			AuthRelays: s.RelayAuth,
+			Settler: settler,
 		}
 
 		for i, user := range s.Users {
-			pk, err := nostr.GetPublicKey(user.NWCSecret)
-			if err != nil {
-				log.Fatal().Err(err).Msg("unable to get nwc pubkey")
+			// the secret of the config is optional, as connections
+			// can also be created with satdress-cli
+			if user.NWCSecret != "" {
+				pk, err := nostr.GetPublicKey(user.NWCSecret)
+				if err != nil {
+					log.Fatal().Err(err).Msg("unable to get nwc pubkey")
+				}
+
+				nwcParams.Users[i].NWCSecret = user.NWCSecret
+				nwcParams.Users[i].NWCPubKey = pk
 			}
 
 			nwcParams.Users[i].Name = user.Name
-			nwcParams.Users[i].NWCSecret = user.NWCSecret
-			nwcParams.Users[i].NWCPubKey = pk
-			nwcParams.Users[i].Relay = user.NWCRelay
-			nwcParams.Users[i].Kind = user.Kind
-			nwcParams.Users[i].Key = user.Key
-			nwcParams.Users[i].Host = user.Host
+			nwcParams.Users[i].Relays = user.nwcRelays()
+			nwcParams.Users[i].Backend = backendMap[user.Name]
+			nwcParams.Users[i].Policy = nwc.Policy{
+				Methods: user.NWCMethods,
+				MaxAmount: user.NWCMaxAmount * 1000,
+				MaxFee: user.NWCMaxFee * 1000,
+				Budget: user.NWCBudget * 1000,
+				BudgetRenewal: user.NWCBudgetRenewal,
+			}
 		}
 
-		go nwc.Start(ctx, &nwcParams)
+		go func() {
+			defer close(nwcDone)
+			nwc.Start(ctx, &nwcParams)
+		}()
+	} else {
+		close(nwcDone)
 	}
 
 	// TODO Setup API routes for nwc deeplink.
@@ -299,6 +445,12 @@ func main() {
 	router.Path("/.well-known/lnurlp/{user}").Methods("GET").
 		HandlerFunc(handleLNURL)
 
+	router.Path("/.well-known/lnurlp/{user}/verify/{payment_hash}").Methods("GET").
+		HandlerFunc(handleVerify)
+
+	router.Path("/.well-known/lnurlp/{user}/{link}").Methods("GET").
+		HandlerFunc(handleLNURL)
+
 	router.Path("/").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			data := struct {
@@ -346,12 +498,14 @@ func main() {
 				SiteOwnerURL string
 				Domain string
 				UserName string
+				CommentAllowed int64
 			}{
 				SiteName: s.SiteName,
 				SiteOwnerName: s.SiteOwnerName,
 				SiteOwnerURL: s.SiteOwnerURL,
 				Domain: s.Domain,
 				UserName: name,
+				CommentAllowed: params.CommentAllowed,
 			}
 
 			err = userTmpl.Execute(w, data)
@@ -390,11 +544,14 @@ func main() {
 		func(w http.ResponseWriter, r *http.Request) {
 			id := mux.Vars(r)["id"]
 
-			bolt11, ok := cache.Get(id)
+			inv, err := getInvoice(id)
 
-			if ok {
+			if err != nil {
+				sendError(w, 500, "internal error")
+				log.Error().Err(err).Msg("error loading invoice")
+			} else if inv != nil {
 				var png []byte
-				png, err := qrcode.Encode("lightning:" + bolt11,
+				png, err := qrcode.Encode("lightning:" + inv.Bolt11,
 					qrcode.Medium, 512)
 
 				if err != nil {
@@ -423,26 +580,34 @@ func main() {
 
 			comment := r.URL.Query().Get("comment")
 
-			if len(comment) > 639 {
-				comment = ""
-			}
-
 			params := getParams(name)
 			if params == nil {
 				sendError(w, 404, "user not found")
 				return
 			}
 
-			inv, err := makeInvoice(params, msats, "", comment)
+			if err := params.checkComment(comment); err != nil {
+				sendError(w, 400, err.Error())
+				return
+			}
+
+			pr := &PaymentRequest{
+				Params: params,
+				Msat: msats,
+				Comment: comment,
+				CreatedAt: time.Now(),
+			}
+
+			inv, err := makeInvoice(pr)
 
 			if err != nil {
 				sendError(w, 503, "couldn't make an invoice")
 				return
 			}
 
-			id := randomString(12)
+			id := pr.Invoice.PaymentHash
 
-			cache.Add(id, inv)
+			watchInvoice(pr)
 
 			data := struct {
 				SiteName string
@@ -454,7 +619,7 @@ func main() {
 				ID string
 				Sats string
 				SatsHuman string
-
+				Comment string
 			}{
 				SiteName: s.SiteName,
 				SiteOwnerName: s.SiteOwnerName,
@@ -465,6 +630,7 @@ func main() {
 				ID: id,
 				Sats: strconv.FormatUint(sats, 10),
 				SatsHuman: humanize.Comma(int64(sats)),
+				Comment: comment,
 			}
 
 			err = invoiceTmpl.Execute(w, data)
@@ -475,22 +641,33 @@ func main() {
 		},
 	)
 
-	go func() {
-		srv := &http.Server{
-			Handler:      cors.Default().Handler(router),
-			Addr:         s.Host + ":" + s.Port,
-			WriteTimeout: 15 * time.Second,
-			ReadTimeout:  15 * time.Second,
-		}
+	srv := &http.Server{
+		Handler:      cors.Default().Handler(router),
+		Addr:         s.Host + ":" + s.Port,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
 
+	go func() {
 		log.Info().Str("addr", srv.Addr).Msg("listening")
 
-		err = srv.ListenAndServe()
+		err := srv.ListenAndServe()
 
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("error starting server")
 		}
 	}()
 
 	<-ctx.Done()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 15 * time.Second)
+	defer shutdownCancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Warn().Err(err).Msg("error shutting down server")
+	}
+
+	<-nwcDone
+
+	log.Info().Msg("stopped")
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	nwc "github.com/braydonf/go-nwc"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+// setupTest opens an invoice store of the test's temporary directory
+// and sets up a new server key.
+func setupTest(t testing.TB) {
+	t.Helper()
+
+	log = zerolog.Nop()
+
+	if err := openInvoiceStore(filepath.Join(t.TempDir(), "invoices.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := invoiceDB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	if err := setupNostrKeys(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBackend makes signed invoices, its subscription sends the
+// settlements of the invoices that are paid. Other methods are not
+// implemented.
+type testBackend struct {
+	nwc.Backend
+
+	mu        sync.Mutex
+	preimages map[string]string // by payment hash
+
+	settlements chan nwc.Settlement
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{
+		preimages:   make(map[string]string),
+		settlements: make(chan nwc.Settlement),
+	}
+}
+
+func (b *testBackend) Capabilities() []string {
+	return []string{nwc.NIP47_MAKE_INVOICE_METHOD, nwc.NIP47_LOOKUP_INVOICE_METHOD}
+}
+
+func (b *testBackend) MakeInvoice(ctx context.Context, ip nwc.InvoiceParams) (*nwc.Transaction, error) {
+	preimage := make([]byte, 32)
+
+	if ip.Preimage != "" {
+		var err error
+		if preimage, err = hex.DecodeString(ip.Preimage); err != nil {
+			return nil, err
+		}
+	} else if _, err := rand.Read(preimage); err != nil {
+		return nil, err
+	}
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var paymentAddr [32]byte
+	if _, err := rand.Read(paymentAddr[:]); err != nil {
+		return nil, err
+	}
+
+	options := []func(*zpay32.Invoice){
+		zpay32.Amount(lnwire.MilliSatoshi(ip.Amount)),
+		zpay32.PaymentAddr(paymentAddr),
+		zpay32.Expiry(time.Hour),
+	}
+
+	if ip.UseDescriptionHash {
+		options = append(options, zpay32.DescriptionHash(sha256.Sum256([]byte(ip.Description))))
+	} else {
+		options = append(options, zpay32.Description(ip.Description))
+	}
+
+	paymentHash := sha256.Sum256(preimage)
+
+	invoice, err := zpay32.NewInvoice(&chaincfg.MainNetParams, paymentHash, time.Now(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	bolt11, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			return ecdsa.SignCompact(key, chainhash.HashB(msg), true)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.preimages[hex.EncodeToString(paymentHash[:])] = hex.EncodeToString(preimage)
+	b.mu.Unlock()
+
+	return &nwc.Transaction{
+		Type:        "incoming",
+		Invoice:     bolt11,
+		PaymentHash: hex.EncodeToString(paymentHash[:]),
+		Amount:      ip.Amount,
+	}, nil
+}
+
+// LookupInvoice finds every invoice unpaid, payments are only sent by
+// the subscription.
+func (b *testBackend) LookupInvoice(ctx context.Context, paymentHash string) (*nwc.Transaction, error) {
+	return &nwc.Transaction{Type: "incoming", PaymentHash: paymentHash}, nil
+}
+
+func (b *testBackend) SubscribeSettlements(ctx context.Context, settled chan<- nwc.Settlement) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case settlement := <-b.settlements:
+			select {
+			case settled <- settlement:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// pay settles the invoice, as if it was paid.
+func (b *testBackend) pay(paymentHash string) {
+	b.mu.Lock()
+	preimage := b.preimages[paymentHash]
+	b.mu.Unlock()
+
+	b.settlements <- nwc.Settlement{PaymentHash: paymentHash, Preimage: preimage}
+}
@@ -1,96 +1,130 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/fiatjaf/makeinvoice"
+	nwc "github.com/braydonf/go-nwc"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/tidwall/sjson"
 )
 
+// makeMetadata returns the LNURL metadata of the user (LUD-06), which
+// invoices commit to with their description hash.
 func makeMetadata(params *UserParams) string {
+	description := params.Description
+	if description == "" {
+		description = "Satoshis to " + params.Name + "@" + params.Domain + "."
+	}
+
 	metadata, _ := sjson.Set("[]", "0.0", "text/identifier")
 	metadata, _ = sjson.Set(metadata, "0.1", params.Name+"@"+params.Domain)
 
 	metadata, _ = sjson.Set(metadata, "1.0", "text/plain")
-	metadata, _ = sjson.Set(metadata, "1.1", "Satoshis to "+params.Name+"@"+params.Domain+".")
+	metadata, _ = sjson.Set(metadata, "1.1", description)
+
+	if params.LongDescription != "" {
+		metadata, _ = sjson.Set(metadata, "-1", []string{"text/long-desc", params.LongDescription})
+	}
+
+	if len(params.Image.Bytes) > 0 {
+		metadata, _ = sjson.Set(metadata, "-1", []string{
+			"image/" + params.Image.Ext + ";base64",
+			base64.StdEncoding.EncodeToString(params.Image.Bytes),
+		})
+	}
 
 	return metadata
 }
 
-func makeInvoice(
-	params *UserParams,
-	msat uint64,
-	zap string,
-	comment string,
-) (bolt11 string, err error) {
-	// prepare params
-	var backend makeinvoice.LNBackendParams
-	switch params.Kind {
-	case "sparko":
-		backend = makeinvoice.SparkoParams{
-			Host: params.Host,
-			Key:  params.Key,
-		}
-	case "lnd":
-		backend = makeinvoice.LNDParams{
-			Host:     params.Host,
-			Macaroon: params.Key,
-			Private:  true,
-		}
-	case "lnbits":
-		backend = makeinvoice.LNBitsParams{
-			Host: params.Host,
-			Key:  params.Key,
-		}
-	case "lnpay":
-		backend = makeinvoice.LNPayParams{
-			PublicAccessKey:  params.Pak,
-			WalletInvoiceKey: params.Waki,
-		}
-	case "eclair":
-		backend = makeinvoice.EclairParams{
-			Host:     params.Host,
-			Password: "",
-		}
-	case "commando":
-		backend = makeinvoice.CommandoParams{
-			Host:   params.Host,
-			NodeId: params.NodeId,
-			Rune:   params.Rune,
-		}
-	case "phoenix":
-		backend = makeinvoice.PhoenixParams{
-			Host:   params.Host,
-			Key: params.Key,
-		}
+func makeInvoice(pr *PaymentRequest) (bolt11 string, err error) {
+	params := pr.Params
+
+	if params.Backend == nil {
+		return "", fmt.Errorf("no backend for user: %s", params.Name)
 	}
 
-	mip := makeinvoice.LNParams{
-		Msatoshi: int64(msat),
-		Backend:  backend,
+	ip := nwc.InvoiceParams{
+		Amount: pr.Msat,
 
 		Label: params.Domain + "/" + strconv.FormatInt(time.Now().Unix(), 16),
 	}
 
 	// make the lnurlpay description_hash
 
-	if zap != "" {
-		mip.UseDescriptionHash = true
-		mip.Description = zap
-	} else if comment != "" {
-		mip.Description = comment
+	if pr.ZapRequest != "" {
+		ip.UseDescriptionHash = true
+		ip.Description = pr.ZapRequest
+	} else if pr.PayerDataJSON != "" {
+		// LUD-18
+		ip.UseDescriptionHash = true
+		ip.Description = makeMetadata(params) + pr.PayerDataJSON
 	} else {
-		mip.Description = makeMetadata(params)
+		// LUD-06, the comment is not part of the description (LUD-12)
+		ip.UseDescriptionHash = true
+		ip.Description = makeMetadata(params)
+	}
+
+	if pr.Preimage != nil {
+		ip.Preimage = hex.EncodeToString(pr.Preimage)
 	}
 
 	// actually generate the invoice
-	bolt11, err = makeinvoice.MakeInvoice(mip)
+	tx, err := params.Backend.MakeInvoice(context.Background(), ip)
+
+	if errors.Is(err, nwc.ErrNotImplemented) && pr.Preimage != nil {
+		// the backend makes the preimage, the aes success action falls
+		// back to a message
+		log.Warn().Str("kind", params.Kind).Msg("backend does not accept preimages")
 
-	log.Debug().Uint64("msatoshi", msat).
-		Interface("backend", backend).
+		pr.Preimage = nil
+		ip.Preimage = ""
+		tx, err = params.Backend.MakeInvoice(context.Background(), ip)
+	}
+
+	if tx != nil {
+		bolt11 = tx.Invoice
+	}
+
+	log.Debug().Uint64("msatoshi", pr.Msat).
+		Str("kind", params.Kind).
 		Str("bolt11", bolt11).Err(err).
 		Msg("invoice generation")
 
-	return bolt11, err
+	if err != nil {
+		return "", err
+	}
+
+	pr.Bolt11 = bolt11
+	pr.Invoice, err = decodepay.Decodepay(bolt11)
+	if err != nil {
+		return "", err
+	}
+
+	// wallets reject invoices that don't commit to the metadata
+	if ip.UseDescriptionHash {
+		descriptionHash := sha256.Sum256([]byte(ip.Description))
+		if pr.Invoice.DescriptionHash != hex.EncodeToString(descriptionHash[:]) {
+			return "", fmt.Errorf("invoice description hash %s does not match", pr.Invoice.DescriptionHash)
+		}
+	}
+
+	if pr.Preimage != nil {
+		if err := checkPreimage(pr.Preimage, pr.Invoice.PaymentHash); err != nil {
+			log.Warn().Err(err).Str("kind", params.Kind).Msg("preimage was not used")
+			pr.Preimage = nil
+		}
+	}
+
+	if err := saveInvoice(pr); err != nil {
+		log.Error().Err(err).Str("payment_hash", pr.Invoice.PaymentHash).Msg("unable to save invoice")
+	}
+
+	return bolt11, nil
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// TestMakeInvoiceDescriptionHash checks the description hash of the
+// decoded invoice against the metadata, and the payer data (LUD-18).
+func TestMakeInvoiceDescriptionHash(t *testing.T) {
+	setupTest(t)
+
+	tests := []struct {
+		name            string
+		description     string
+		longDescription string
+		payerData       string
+	}{
+		{name: "default description"},
+		{name: "description", description: "Coffee for jane.", longDescription: "Thanks for the coffee!"},
+		{name: "payer data", payerData: `{"name":"John","email":"john@example.com"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := &UserParams{
+				Name:            "jane",
+				Domain:          "example.com",
+				Kind:            "lnd",
+				Description:     test.description,
+				LongDescription: test.longDescription,
+				Backend:         newTestBackend(),
+			}
+
+			pr := &PaymentRequest{Params: params, Msat: 21000, PayerDataJSON: test.payerData}
+
+			bolt11, err := makeInvoice(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			invoice, err := decodepay.Decodepay(bolt11)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hash := sha256.Sum256([]byte(makeMetadata(params) + test.payerData))
+
+			if invoice.DescriptionHash != hex.EncodeToString(hash[:]) {
+				t.Fatalf("description hash %s, metadata %s", invoice.DescriptionHash, makeMetadata(params))
+			}
+
+			inv, err := getInvoice(invoice.PaymentHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if inv == nil || inv.PayerData != test.payerData {
+				t.Fatalf("saved invoice %+v", inv)
+			}
+		})
+	}
+}
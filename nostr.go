@@ -13,7 +13,9 @@ import (
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,7 @@ import (
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip04"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	nwc "github.com/braydonf/go-nwc"
 	"github.com/nfnt/resize"
 )
 
@@ -69,9 +72,30 @@ func ParseMetadata(event nostr.Event) (*ProfileMetadata, error) {
 	return &meta, nil
 }
 
-var nip57Receipt nostr.Event
-var zapEventSerializedStr string
-var nip57ReceiptRelays []string
+// Server nostr key material, computed once at startup by setupNostrKeys
+// and only read afterwards.
+var (
+	allowNostr      bool
+	nostrPrivkeyHex string
+	nostrPubkey     string
+)
+
+// setupNostrKeys decodes the configured server key, which may be given
+// as nsec or hex. This can be any private key, not necessarily from the
+// user.
+func setupNostrKeys(key string) error {
+	nostrPrivkeyHex = DecodeBech32(key)
+
+	pub, err := nostr.GetPublicKey(nostrPrivkeyHex)
+	if err != nil {
+		return err
+	}
+
+	nostrPubkey = pub
+	allowNostr = true
+
+	return nil
+}
 
 func Nip57DescriptionHash(zapEventSerialized string) string {
 	hash := sha256.Sum256([]byte(zapEventSerialized))
@@ -124,10 +148,7 @@ func sendMessage(receiverKey string, message string) {
 	//}
 
 	// parse and encrypt content
-	privkeyhex := DecodeBech32(s.NostrPrivateKey)
-	pubkey, _ := nostr.GetPublicKey(privkeyhex)
-
-	sharedSecret, err := nip04.ComputeSharedSecret(reckey, privkeyhex)
+	sharedSecret, err := nip04.ComputeSharedSecret(reckey, nostrPrivkeyHex)
 	if err != nil {
 		log.Printf("Error computing shared key: %s. x\n", err.Error())
 		return
@@ -140,13 +161,13 @@ func sendMessage(receiverKey string, message string) {
 	}
 
 	event := nostr.Event{
-		PubKey:    pubkey,
+		PubKey:    nostrPubkey,
 		CreatedAt: nostr.Now(),
 		Kind:      nostr.KindEncryptedDirectMessage,
 		Tags:      tags,
 		Content:   encryptedMessage,
 	}
-	event.Sign(privkeyhex)
+	event.Sign(nostrPrivkeyHex)
 	publishNostrEvent(event, relays)
 	log.Printf("%+v\n", event)
 }
@@ -230,6 +251,48 @@ func addImageToProfile(params *UserParams, imageURL string) (err error) {
 		return err
 	}
 
+	return setImage(params, picture, contentType)
+}
+
+// addNostrAvatarToProfile adds the picture of the user's nostr profile to
+// the LNURL metadata.
+func addNostrAvatarToProfile(params *UserParams) error {
+	profile, err := GetNostrProfileMetaData(params.Npub, 0)
+	if err != nil {
+		return err
+	}
+
+	if profile.Picture == "" {
+		return fmt.Errorf("nostr profile has no picture")
+	}
+
+	return addImageToProfile(params, profile.Picture)
+}
+
+// addImageFileToProfile adds the image file to the LNURL metadata.
+func addImageFileToProfile(params *UserParams, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	picture, contentType, err := makeThumbnail(f, http.DetectContentType(head[:n]))
+	if err != nil {
+		return err
+	}
+
+	return setImage(params, picture, contentType)
+}
+
+// setImage sets the image of the LNURL metadata.
+func setImage(params *UserParams, picture []byte, contentType string) error {
 	// Determine image format
 	var ext string
 	switch contentType {
@@ -260,19 +323,25 @@ func DownloadProfilePicture(url string) ([]byte, string, error) {
 	}
 	defer res.Body.Close()
 
-	contentType := res.Header.Get("Content-Type")
+	return makeThumbnail(res.Body, res.Header.Get("Content-Type"))
+}
+
+// makeThumbnail resizes the image to a thumbnail, which is a jpeg
+// whatever the format of the image.
+func makeThumbnail(r io.Reader, contentType string) ([]byte, string, error) {
 	if contentType != "image/jpeg" && contentType != "image/png" && contentType != "image/gif" {
 		return nil, "", errors.New("unsupported image format")
 	}
 
 	var img image.Image
+	var err error
 	switch contentType {
 	case "image/jpeg":
-		img, err = jpeg.Decode(res.Body)
+		img, err = jpeg.Decode(r)
 	case "image/png":
-		img, err = png.Decode(res.Body)
+		img, err = png.Decode(r)
 	case "image/gif":
-		img, err = gif.Decode(res.Body)
+		img, err = gif.Decode(r)
 	}
 	if err != nil {
 		return nil, "", errors.New("failed to decode image: " + err.Error())
@@ -285,14 +354,14 @@ func DownloadProfilePicture(url string) ([]byte, string, error) {
 	if err := jpeg.Encode(buf, img, nil); err != nil {
 		return nil, "", errors.New("failed to encode image: " + err.Error())
 	}
-	return buf.Bytes(), contentType, nil
+	return buf.Bytes(), "image/jpeg", nil
 }
 
 func publishNostrEvent(ev nostr.Event, relays []string) {
 	// Add more relays, remove trailing slashes, and ensure unique relays
 	relays = uniqueSlice(cleanUrls(append(relays, Relays...)))
 
-	ev.Sign(s.NostrPrivateKey)
+	ev.Sign(nostrPrivkeyHex)
 
 	var wg sync.WaitGroup
 	wg.Add(len(relays))
@@ -329,9 +398,23 @@ func publishNostrEvent(ev nostr.Event, relays []string) {
 				}
 				defer conn.Close()
 
-				// Set a timeout for publishing to the relay
+				if nwc.RequiresAuth(s.RelayAuth, url) {
+					authCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					err = nwc.Authenticate(authCtx, conn, nostrPrivkeyHex)
+					cancel()
+
+					if err != nil {
+						log.Printf("Error authenticating to relay %s: %v", url, err)
+						time.Sleep(retryDelay)
+						retryDelay *= 2
+						continue
+					}
+				}
+
+				// Set a timeout for publishing to the relay, and
+				// authenticate if the relay asks for it
 				pubCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				err = conn.Publish(pubCtx, ev)
+				err = nwc.PublishWithAuth(pubCtx, conn, nostrPrivkeyHex, ev)
 				cancel()
 
 				if err != nil {
@@ -366,18 +449,13 @@ func ExtractNostrRelays(zapEvent nostr.Event) []string {
 }
 
 func CreateNostrReceipt(zapEvent nostr.Event, invoice string) (nostr.Event, error) {
-	pub, err := nostr.GetPublicKey(nostrPrivkeyHex)
-	if err != nil {
-		return nostr.Event{}, err
-	}
-
 	zapEventSerialized, err := json.Marshal(zapEvent)
 	if err != nil {
 		return nostr.Event{}, err
 	}
 
 	nip57Receipt := nostr.Event{
-		PubKey:    pub,
+		PubKey:    nostrPubkey,
 		CreatedAt: nostr.Now(),
 		Kind:      9735,
 		Tags: nostr.Tags{
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/fiatjaf/go-lnurl"
+)
+
+// how long the k1 of the payerData auth field can be signed (LUD-18)
+var PayerDataK1Expiry = time.Hour
+
+const (
+	PAYER_DATA_OPTIONAL  = "optional"
+	PAYER_DATA_MANDATORY = "mandatory"
+)
+
+// payerDataSpec returns the payer fields requested from the sender, from
+// the payerdata of the user's config, or nil if none are.
+func payerDataSpec(params *UserParams) *lnurl.PayerDataSpec {
+	if len(params.PayerData) == 0 {
+		return nil
+	}
+
+	spec := &lnurl.PayerDataSpec{}
+
+	for field, requirement := range params.PayerData {
+		mandatory := requirement == PAYER_DATA_MANDATORY
+
+		switch field {
+		case "name":
+			spec.FreeName = &lnurl.PayerDataItemSpec{Mandatory: mandatory}
+		case "pubkey":
+			spec.PubKey = &lnurl.PayerDataItemSpec{Mandatory: mandatory}
+		case "identifier":
+			spec.LightningAddress = &lnurl.PayerDataItemSpec{Mandatory: mandatory}
+		case "email":
+			spec.Email = &lnurl.PayerDataItemSpec{Mandatory: mandatory}
+		case "auth":
+			spec.KeyAuth = &lnurl.PayerDataKeyAuthSpec{
+				Mandatory: mandatory,
+				K1: newPayerDataK1(params.Name, time.Now()),
+			}
+		}
+	}
+
+	return spec
+}
+
+// checkPayerDataConfig checks the payerdata of the user's config.
+func checkPayerDataConfig(user User) error {
+	for field, requirement := range user.PayerData {
+		switch field {
+		case "name", "pubkey", "identifier", "email", "auth":
+		default:
+			return fmt.Errorf("unknown payerdata field: %s", field)
+		}
+
+		if requirement != PAYER_DATA_OPTIONAL && requirement != PAYER_DATA_MANDATORY {
+			return fmt.Errorf("payerdata %s must be optional or mandatory", field)
+		}
+	}
+
+	return nil
+}
+
+// payerDataKey is the key of the k1 values, so that they can be verified
+// without keeping them.
+func payerDataKey() []byte {
+	key := sha256.Sum256([]byte("satdress/payerdata/k1/" + nostrPrivkeyHex))
+	return key[:]
+}
+
+func payerDataMAC(user string, prefix []byte) []byte {
+	mac := hmac.New(sha256.New, payerDataKey())
+	mac.Write([]byte(user))
+	mac.Write(prefix)
+	return mac.Sum(nil)[:16]
+}
+
+// newPayerDataK1 returns a k1 for the user of 32 bytes: the time it was
+// made, a random nonce and a mac of both.
+func newPayerDataK1(user string, now time.Time) string {
+	k1 := make([]byte, 32)
+
+	binary.BigEndian.PutUint64(k1[:8], uint64(now.Unix()))
+	rand.Read(k1[8:16])
+	copy(k1[16:], payerDataMAC(user, k1[:16]))
+
+	return hex.EncodeToString(k1)
+}
+
+func checkPayerDataK1(user string, k1Hex string, now time.Time) error {
+	k1, err := hex.DecodeString(k1Hex)
+	if err != nil || len(k1) != 32 {
+		return fmt.Errorf("Invalid payer data auth k1.")
+	}
+
+	if !hmac.Equal(k1[16:], payerDataMAC(user, k1[:16])) {
+		return fmt.Errorf("Unknown payer data auth k1.")
+	}
+
+	madeAt := time.Unix(int64(binary.BigEndian.Uint64(k1[:8])), 0)
+	if now.Sub(madeAt) > PayerDataK1Expiry {
+		return fmt.Errorf("Payer data auth k1 has expired.")
+	}
+
+	return nil
+}
+
+// checkPayerDataAuth checks the signature of the k1 by the linking key
+// of the sender (LUD-04).
+func checkPayerDataAuth(user string, auth *lnurl.PayerDataKeyAuthValues, now time.Time) error {
+	if err := checkPayerDataK1(user, auth.K1, now); err != nil {
+		return err
+	}
+
+	keyBytes, err := hex.DecodeString(auth.Key)
+	if err != nil {
+		return fmt.Errorf("Invalid payer data auth key.")
+	}
+
+	key, err := btcec.ParsePubKey(keyBytes)
+	if err != nil {
+		return fmt.Errorf("Invalid payer data auth key.")
+	}
+
+	sigBytes, err := hex.DecodeString(auth.Sig)
+	if err != nil {
+		return fmt.Errorf("Invalid payer data auth signature.")
+	}
+
+	sig, err := ecdsa.ParseDERSignature(sigBytes)
+	if err != nil {
+		return fmt.Errorf("Invalid payer data auth signature.")
+	}
+
+	k1, _ := hex.DecodeString(auth.K1)
+
+	if !sig.Verify(k1, key) {
+		return fmt.Errorf("Payer data auth signature does not match.")
+	}
+
+	return nil
+}
+
+// parsePayerData checks the payerData sent in the callback against the
+// fields requested by the user, returning its values.
+func parsePayerData(params *UserParams, payerData string, now time.Time) (*lnurl.PayerDataValues, error) {
+	var values lnurl.PayerDataValues
+
+	if err := json.Unmarshal([]byte(payerData), &values); err != nil {
+		return nil, fmt.Errorf("Couldn't parse payer data.")
+	}
+
+	type field struct {
+		name string
+		sent bool
+	}
+
+	fields := []field{
+		{"name", values.FreeName != ""},
+		{"pubkey", values.PubKey != ""},
+		{"identifier", values.LightningAddress != ""},
+		{"email", values.Email != ""},
+		{"auth", values.KeyAuth != nil},
+	}
+
+	for _, f := range fields {
+		requirement, requested := params.PayerData[f.name]
+
+		if f.sent && !requested {
+			return nil, fmt.Errorf("Payer data %s was not requested.", f.name)
+		}
+
+		if !f.sent && requirement == PAYER_DATA_MANDATORY {
+			return nil, fmt.Errorf("Payer data %s is mandatory.", f.name)
+		}
+	}
+
+	if values.PubKey != "" {
+		if _, err := hex.DecodeString(values.PubKey); err != nil {
+			return nil, fmt.Errorf("Invalid payer data pubkey.")
+		}
+	}
+
+	if values.LightningAddress != "" && !strings.Contains(values.LightningAddress, "@") {
+		return nil, fmt.Errorf("Invalid payer data identifier.")
+	}
+
+	if values.Email != "" && !strings.Contains(values.Email, "@") {
+		return nil, fmt.Errorf("Invalid payer data email.")
+	}
+
+	if values.KeyAuth != nil {
+		if err := checkPayerDataAuth(params.Name, values.KeyAuth, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return &values, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	nwc "github.com/braydonf/go-nwc"
+)
+
+var settler *nwc.Settler
+
+func (pr *PaymentRequest) expiresAt() time.Time {
+	expiry := pr.Invoice.Expiry
+	if expiry == 0 {
+		expiry = 3600
+	}
+
+	return time.Unix(int64(pr.Invoice.CreatedAt+expiry), 0)
+}
+
+// watchInvoice waits for the invoice to be paid, or to expire.
+func watchInvoice(pr *PaymentRequest) {
+	paymentHash := pr.Invoice.PaymentHash
+
+	settler.Watch(nwc.Watch{
+		User:        pr.Params.Name,
+		Backend:     pr.Params.Backend,
+		PaymentHash: paymentHash,
+		ExpiresAt:   pr.expiresAt(),
+		OnPaid: func(settlement nwc.Settlement) {
+			onInvoicePaid(pr, settlement)
+		},
+		OnExpired: func() {
+			if err := expireInvoice(paymentHash); err != nil {
+				log.Error().Err(err).Str("payment_hash", paymentHash).Msg("unable to expire invoice")
+			}
+		},
+	})
+}
+
+// onInvoicePaid publishes the zap receipt and sends notifications for a
+// paid invoice.
+func onInvoicePaid(pr *PaymentRequest, settlement nwc.Settlement) {
+	params := pr.Params
+	bolt11 := pr.Invoice
+
+	preimage := settlement.Preimage
+	if preimage == "" && pr.Preimage != nil {
+		preimage = hex.EncodeToString(pr.Preimage)
+	}
+
+	if err := settleInvoice(bolt11.PaymentHash, preimage); err != nil {
+		log.Error().Err(err).Str("payment_hash", bolt11.PaymentHash).Msg("unable to settle invoice")
+	}
+
+	var amount = bolt11.MSatoshi / 1000
+	var satsr = "Sats"
+	if amount == 1 {
+		satsr = "Sat"
+	}
+
+	if pr.Receipt != nil {
+		// If DescriptionHash matches Nip57 DescriptionHash, publish Zap
+		// Nostr Event. This is rather a sanity check.
+		descriptionTag := pr.Receipt.Tags.GetFirst([]string{"description"})
+		if descriptionTag == nil || bolt11.DescriptionHash != Nip57DescriptionHash(descriptionTag.Value()) {
+			log.Warn().Str("payment_hash", bolt11.PaymentHash).Msg("invoice does not commit to zap request")
+			return
+		}
+
+		publishNostrEvent(*pr.Receipt, pr.Relays)
+
+		if params.Npub != "" && params.NotifyZapComment && pr.Comment != "" {
+			if pr.Note != "" {
+				go sendMessage(params.Npub, "Received Zap from "+pr.Sender+" with amount: "+strconv.FormatInt(amount, 10)+" "+satsr+" ⚡️ for note: "+pr.Note+" Comment: "+pr.Comment)
+			} else {
+				go sendMessage(params.Npub, "Received Profile Zap from "+pr.Sender+" with amount: "+strconv.FormatInt(amount, 10)+" "+satsr+" ⚡️. Comment: "+pr.Comment)
+			}
+		} else if params.Npub != "" && params.NotifyZaps {
+			if pr.Note != "" {
+				go sendMessage(params.Npub, "Received Zap from "+pr.Sender+" with amount: "+strconv.FormatInt(amount, 10)+" "+satsr+" ⚡️ for note: "+pr.Note)
+			} else {
+				go sendMessage(params.Npub, "Received Profile Zap from "+pr.Sender+" with amount: "+strconv.FormatInt(amount, 10)+" "+satsr+" ⚡️.")
+			}
+		}
+
+		log.Debug().Str("ZAPPED ⚡️", "Published zap on Nostr").Msg("Nostr")
+	} else if params.Npub != "" && params.NotifyNonZap {
+		if pr.Comment != "" {
+			go sendMessage(params.Npub, "Received Non-Zap! Amount: "+strconv.FormatInt(amount, 10)+" "+satsr+" ⚡️. Comment: "+pr.Comment)
+		} else {
+			go sendMessage(params.Npub, "Received Non-Zap! Amount: "+strconv.FormatInt(amount, 10)+" "+satsr+" ⚡️.")
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/fiatjaf/go-lnurl"
+	"github.com/glebarez/sqlite"
+	"github.com/nbd-wtf/go-nostr"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"gorm.io/gorm"
+)
+
+const (
+	INVOICE_STATUS_PENDING = "pending"
+	INVOICE_STATUS_SETTLED = "settled"
+	INVOICE_STATUS_EXPIRED = "expired"
+)
+
+//go:embed db/init.sql
+var dbInitSQL string
+
+// Invoice store, opened at startup.
+var invoiceDB *gorm.DB
+
+// Invoice is the persisted record of every invoice satdress creates, so
+// that pending zap receipts and notifications survive a restart.
+type Invoice struct {
+	ID          uint
+	PaymentHash string `validate:"required"`
+	User        string
+	Link        string // payment link, empty for the lightning address
+	Msat        uint64
+	Bolt11      string
+	Comment     string
+	PayerData   string // json, as sent
+	ZapRequest  string
+	Relays      string // json array
+	Status      string
+	Preimage    string // hex, once settled or made for an aes action
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ExpiresAt   time.Time
+	SettledAt   *time.Time
+}
+
+func openInvoiceStore(dbpath string) error {
+	db, err := gorm.Open(sqlite.Open(dbpath+"?_pragma=busy_timeout(5000)"), &gorm.Config{})
+	if err != nil {
+		return err
+	}
+
+	m := db.Migrator()
+
+	if m.HasTable("invoices") && !m.HasColumn("invoices", "payer_data") {
+		if err := db.Exec("ALTER TABLE `invoices` ADD COLUMN `payer_data` text").Error; err != nil {
+			return err
+		}
+	}
+
+	if m.HasTable("invoices") && !m.HasColumn("invoices", "preimage") {
+		if err := db.Exec("ALTER TABLE `invoices` ADD COLUMN `preimage` text").Error; err != nil {
+			return err
+		}
+	}
+
+	if m.HasTable("invoices") && !m.HasColumn("invoices", "link") {
+		if err := db.Exec("ALTER TABLE `invoices` ADD COLUMN `link` text").Error; err != nil {
+			return err
+		}
+	}
+
+	if err := db.Exec(dbInitSQL).Error; err != nil {
+		return err
+	}
+
+	invoiceDB = db
+
+	return nil
+}
+
+func saveInvoice(pr *PaymentRequest) error {
+	relays, err := json.Marshal(pr.Relays)
+	if err != nil {
+		return err
+	}
+
+	inv := &Invoice{
+		PaymentHash: pr.Invoice.PaymentHash,
+		User:        pr.Params.Name,
+		Link:        pr.Params.Link,
+		Msat:        pr.Msat,
+		Bolt11:      pr.Bolt11,
+		Comment:     pr.Comment,
+		PayerData:   pr.PayerDataJSON,
+		ZapRequest:  pr.ZapRequest,
+		Relays:      string(relays),
+		Status:      INVOICE_STATUS_PENDING,
+		ExpiresAt:   pr.expiresAt(),
+	}
+
+	if pr.Preimage != nil {
+		inv.Preimage = hex.EncodeToString(pr.Preimage)
+	}
+
+	return invoiceDB.Table("invoices").Create(inv).Error
+}
+
+func getInvoice(paymentHash string) (*Invoice, error) {
+	var inv Invoice
+
+	result := invoiceDB.Table("invoices").Where("payment_hash = ?", paymentHash).Limit(1).Find(&inv)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &inv, nil
+}
+
+// settleInvoice marks the invoice as settled, an invoice that expired
+// while its payment was looked up is settled as well.
+func settleInvoice(paymentHash string, preimage string) error {
+	return invoiceDB.Table("invoices").
+		Where("payment_hash = ?", paymentHash).
+		Where("status <> ?", INVOICE_STATUS_SETTLED).
+		Updates(map[string]interface{}{
+			"status":     INVOICE_STATUS_SETTLED,
+			"preimage":   preimage,
+			"settled_at": time.Now(),
+		}).Error
+}
+
+func expireInvoice(paymentHash string) error {
+	return invoiceDB.Table("invoices").
+		Where("payment_hash = ?", paymentHash).
+		Where("status = ?", INVOICE_STATUS_PENDING).
+		Update("status", INVOICE_STATUS_EXPIRED).Error
+}
+
+// pendingInvoices marks expired invoices and returns the invoices that
+// can still be paid.
+func pendingInvoices() ([]Invoice, error) {
+	err := invoiceDB.Table("invoices").
+		Where("status = ?", INVOICE_STATUS_PENDING).
+		Where("expires_at < ?", time.Now()).
+		Update("status", INVOICE_STATUS_EXPIRED).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var invoices []Invoice
+
+	err = invoiceDB.Table("invoices").Where("status = ?", INVOICE_STATUS_PENDING).Find(&invoices).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+// paymentRequest rebuilds the in-flight state of a stored invoice.
+func (inv *Invoice) paymentRequest(params *UserParams) (*PaymentRequest, error) {
+	bolt11, err := decodepay.Decodepay(inv.Bolt11)
+	if err != nil {
+		return nil, err
+	}
+
+	pr := &PaymentRequest{
+		Params:     params,
+		Msat:       inv.Msat,
+		Comment:    inv.Comment,
+		PayerDataJSON: inv.PayerData,
+		ZapRequest: inv.ZapRequest,
+		Bolt11:     inv.Bolt11,
+		Invoice:    bolt11,
+		CreatedAt:  inv.CreatedAt,
+	}
+
+	// the preimage of an aes action, so that the action can be made again
+	if inv.Preimage != "" {
+		preimage, err := hex.DecodeString(inv.Preimage)
+		if err != nil {
+			return nil, err
+		}
+		pr.Preimage = preimage
+	}
+
+	if inv.Relays != "" {
+		if err := json.Unmarshal([]byte(inv.Relays), &pr.Relays); err != nil {
+			return nil, err
+		}
+	}
+
+	if inv.PayerData != "" {
+		pr.PayerData = &lnurl.PayerDataValues{}
+		if err := json.Unmarshal([]byte(inv.PayerData), pr.PayerData); err != nil {
+			return nil, err
+		}
+	}
+
+	if inv.ZapRequest != "" {
+		pr.ZapEvent = &nostr.Event{}
+		if err := json.Unmarshal([]byte(inv.ZapRequest), pr.ZapEvent); err != nil {
+			return nil, err
+		}
+
+		receipt, err := CreateNostrReceipt(*pr.ZapEvent, inv.Bolt11)
+		if err != nil {
+			return nil, err
+		}
+		pr.Receipt = &receipt
+		pr.describeZap()
+	}
+
+	return pr, nil
+}
+
+// resumePendingInvoices watches every unexpired unpaid invoice from
+// before a restart.
+func resumePendingInvoices() {
+	invoices, err := pendingInvoices()
+	if err != nil {
+		log.Error().Err(err).Msg("unable to load pending invoices")
+		return
+	}
+
+	for _, inv := range invoices {
+		params := getLinkParams(inv.User, inv.Link)
+		if params == nil {
+			log.Warn().Str("user", inv.User).Str("link", inv.Link).Str("payment_hash", inv.PaymentHash).Msg("pending invoice for unknown user")
+			continue
+		}
+
+		pr, err := inv.paymentRequest(params)
+		if err != nil {
+			log.Warn().Err(err).Str("payment_hash", inv.PaymentHash).Msg("unable to resume invoice")
+			continue
+		}
+
+		log.Debug().Str("payment_hash", inv.PaymentHash).Msg("resuming pending invoice")
+
+		watchInvoice(pr)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/fiatjaf/go-lnurl"
+)
+
+const (
+	SUCCESS_ACTION_MESSAGE = "message" // LUD-09
+	SUCCESS_ACTION_URL     = "url"     // LUD-09
+	SUCCESS_ACTION_AES     = "aes"     // LUD-10
+)
+
+// the limits of LUD-09 and LUD-10
+const (
+	SuccessActionMaxText      = 144  // characters, of message and description
+	SuccessActionMaxPlaintext = 4096 // bytes, before encryption
+)
+
+// the action of wallets once paid when the user has not set one
+var DefaultSuccessAction = SuccessAction{
+	Tag:     SUCCESS_ACTION_MESSAGE,
+	Message: "Payment Received!",
+}
+
+// SuccessAction is the action of the wallet once the invoice is paid,
+// of the user or of one of their payment links. Its fields are templates
+// of SuccessActionData, e.g. a url of
+// "https://example.com/download/{{ .PaymentHash }}".
+type SuccessAction struct {
+	Tag         string `koanf:"tag" json:"tag"` // message, url or aes
+	Message     string `koanf:"message" json:"message"`
+	Description string `koanf:"description" json:"description"` // url and aes
+	URL         string `koanf:"url" json:"url"`
+	Plaintext   string `koanf:"plaintext" json:"plaintext"` // aes, encrypted with the preimage
+}
+
+// SuccessActionData is what the templates of success actions are
+// executed with.
+type SuccessActionData struct {
+	Name        string
+	Link        string // empty for the lightning address
+	Domain      string
+	Sats        string
+	PaymentHash string
+	Comment     string
+}
+
+// checkSuccessActionConfig checks the successaction of the user's
+// config.
+func checkSuccessActionConfig(user User) error {
+	return checkSuccessAction(user.SuccessAction)
+}
+
+func checkSuccessAction(action *SuccessAction) error {
+	if action == nil {
+		return nil
+	}
+
+	switch action.Tag {
+	case SUCCESS_ACTION_MESSAGE:
+		if action.Message == "" {
+			return fmt.Errorf("successaction message is empty")
+		}
+	case SUCCESS_ACTION_URL:
+		if action.URL == "" {
+			return fmt.Errorf("successaction url is empty")
+		}
+	case SUCCESS_ACTION_AES:
+		if action.Plaintext == "" {
+			return fmt.Errorf("successaction plaintext is empty")
+		}
+	default:
+		return fmt.Errorf("unknown successaction tag: %s", action.Tag)
+	}
+
+	for _, text := range []string{action.Message, action.Description, action.URL, action.Plaintext} {
+		if _, err := template.New("").Parse(text); err != nil {
+			return fmt.Errorf("invalid successaction template: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func executeSuccessTemplate(text string, data SuccessActionData) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// newPreimage returns a random preimage for invoices of aes actions, so
+// that the plaintext can be encrypted before the invoice is paid.
+func newPreimage() ([]byte, error) {
+	preimage := make([]byte, 32)
+	if _, err := rand.Read(preimage); err != nil {
+		return nil, err
+	}
+
+	return preimage, nil
+}
+
+// checkPreimage checks that the invoice is for the preimage, backends
+// could ignore it.
+func checkPreimage(preimage []byte, paymentHash string) error {
+	hash := sha256.Sum256(preimage)
+
+	if hex.EncodeToString(hash[:]) != paymentHash {
+		return fmt.Errorf("invoice payment hash %s is not for the preimage", paymentHash)
+	}
+
+	return nil
+}
+
+// successAction returns the action of the wallet once the invoice of the
+// payment request is paid. Aes actions of invoices made without the
+// preimage fall back to a message with their description.
+func (pr *PaymentRequest) successAction() (*lnurl.SuccessAction, error) {
+	action := DefaultSuccessAction
+	if pr.Params.SuccessAction != nil {
+		action = *pr.Params.SuccessAction
+	}
+
+	data := SuccessActionData{
+		Name:        pr.Params.Name,
+		Link:        pr.Params.Link,
+		Domain:      pr.Params.Domain,
+		Sats:        strconv.FormatUint(pr.Msat/1000, 10),
+		PaymentHash: pr.Invoice.PaymentHash,
+		Comment:     pr.Comment,
+	}
+
+	fields := []*string{&action.Message, &action.Description, &action.URL, &action.Plaintext}
+	for _, field := range fields {
+		text, err := executeSuccessTemplate(*field, data)
+		if err != nil {
+			return nil, err
+		}
+		*field = text
+	}
+
+	if action.Tag == SUCCESS_ACTION_AES && pr.Preimage == nil {
+		action.Tag = SUCCESS_ACTION_MESSAGE
+		action.Message = action.Description
+		if action.Message == "" {
+			action.Message = DefaultSuccessAction.Message
+		}
+	}
+
+	switch action.Tag {
+	case SUCCESS_ACTION_MESSAGE:
+		if utf8.RuneCountInString(action.Message) > SuccessActionMaxText {
+			return nil, fmt.Errorf("success action message is too long")
+		}
+
+		return lnurl.Action(action.Message, ""), nil
+	case SUCCESS_ACTION_URL:
+		if utf8.RuneCountInString(action.Description) > SuccessActionMaxText {
+			return nil, fmt.Errorf("success action description is too long")
+		}
+
+		u, err := url.Parse(action.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("invalid success action url: %s", action.URL)
+		}
+
+		return lnurl.Action(action.Description, action.URL), nil
+	case SUCCESS_ACTION_AES:
+		if utf8.RuneCountInString(action.Description) > SuccessActionMaxText {
+			return nil, fmt.Errorf("success action description is too long")
+		}
+
+		if len(action.Plaintext) > SuccessActionMaxPlaintext {
+			return nil, fmt.Errorf("success action plaintext is too long")
+		}
+
+		return lnurl.AESAction(action.Description, pr.Preimage, action.Plaintext)
+	}
+
+	return nil, fmt.Errorf("unknown success action tag: %s", action.Tag)
+}